@@ -15,4 +15,5 @@ require (
 	github.com/spf13/viper v1.6.1
 	github.com/tupyy/tview v0.0.0-20200224131948-26c249413419
 	golang.org/x/crypto v0.0.0-20191227163750-53104e6ec876
+	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
 )
@@ -3,32 +3,324 @@ package conf
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
+// Prompt can be set as password or passphrase. The secret is asked to the user when connecting.
+const Prompt = "prompt"
+
+// VaultPrefix marks a password or passphrase stored in the vault, e.g. vault:prod-db.
+const VaultPrefix = "vault:"
+
 type Host struct {
 	Address  string
 	Username string
 	Password string
 	Key      string
+
+	// Passphrase decrypts the key. If empty and the key is encrypted, it is asked to the user.
+	Passphrase string
+
+	// Certificate is the OpenSSH user certificate signed for the key. If empty, <key>-cert.pub is used if it exists.
+	Certificate string
+
+	// Auth lists the authentication methods (agent, key, password) in the order they are tried.
+	// If empty, key or password is used if set, otherwise the ssh-agent.
+	Auth []string
 }
 
 func (h *Host) String() string {
 	return fmt.Sprintf("%s:%d", h.Address, 22)
 }
 
+// Proxy is used to reach the host, or the jump host if any.
+type Proxy struct {
+	// URL of a SOCKS5 (socks5://[user:password@]host:port) or HTTP CONNECT (http://[user:password@]host:port) proxy.
+	URL string `mapstructure:"url"`
+
+	// Command is run locally and its stdin and stdout carry the connection, like the ProxyCommand of OpenSSH.
+	// %h and %p are replaced by the host and the port. It has precedence over URL.
+	Command string `mapstructure:"command"`
+}
+
+// IsEmpty returns true if no proxy is set.
+func (p Proxy) IsEmpty() bool {
+	return len(p.URL) == 0 && len(p.Command) == 0
+}
+
+// Poll modes
+const (
+	// PollFixed polls the file at a fixed interval.
+	PollFixed = "fixed"
+
+	// PollAdaptive polls faster while the file grows and backs off while it is idle.
+	PollAdaptive = "adaptive"
+)
+
+// Poll sets how often the size of the file is fetched.
+type Poll struct {
+	// Mode is fixed (default) or adaptive.
+	Mode string `mapstructure:"mode"`
+
+	// Interval between two polls in fixed mode and the first interval in adaptive mode.
+	Interval time.Duration `mapstructure:"interval"`
+
+	// Min and Max bound the interval in adaptive mode.
+	Min time.Duration `mapstructure:"min"`
+	Max time.Duration `mapstructure:"max"`
+}
+
+// withDefaults returns p with the fields not set taken from defaults.
+func (p Poll) withDefaults(defaults Poll) Poll {
+	if len(p.Mode) == 0 {
+		p.Mode = defaults.Mode
+	}
+	if p.Interval == 0 {
+		p.Interval = defaults.Interval
+	}
+	if p.Min == 0 {
+		p.Min = defaults.Min
+	}
+	if p.Max == 0 {
+		p.Max = defaults.Max
+	}
+	return p
+}
+
+// Filter selects the lines sent by the remote host. The expressions are extended regular expressions (grep -E).
+type Filter struct {
+	// Include keeps only the lines matching at least one expression. If empty, all lines are kept.
+	Include []string `mapstructure:"include"`
+
+	// Exclude drops the lines matching at least one expression.
+	Exclude []string `mapstructure:"exclude"`
+}
+
+// IsEmpty returns true if no expression is set.
+func (f Filter) IsEmpty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Spill keeps the data evicted from the cache in compressed files under the user cache directory.
+type Spill struct {
+	// Enabled is nil if not set: an explicit false is kept by the services.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// MaxSize is the maximum number of compressed bytes kept on disk. If zero, the default size is used.
+	MaxSize uint64 `mapstructure:"maxSize"`
+
+	// MaxAge is how long the data is kept on disk. If zero, the data is kept until MaxSize is reached.
+	MaxAge time.Duration `mapstructure:"maxAge"`
+}
+
+// IsEmpty returns true if no spill setting is set.
+func (s Spill) IsEmpty() bool {
+	return s == Spill{}
+}
+
+// IsEnabled returns true if the spill is enabled.
+func (s Spill) IsEnabled() bool {
+	return s.Enabled != nil && *s.Enabled
+}
+
+// withDefaults returns s with the fields not set taken from defaults.
+func (s Spill) withDefaults(defaults Spill) Spill {
+	if s.IsEmpty() {
+		return defaults
+	}
+	if s.Enabled == nil {
+		s.Enabled = defaults.Enabled
+	}
+	if s.MaxSize == 0 {
+		s.MaxSize = defaults.MaxSize
+	}
+	if s.MaxAge == 0 {
+		s.MaxAge = defaults.MaxAge
+	}
+	return s
+}
+
+// Resume reads a service from the position reached by the previous run instead of the beginning of the file.
+type Resume struct {
+	// Enabled is nil if not set: an explicit false is kept by the services.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// MaxCatchUp is the maximum number of bytes read at startup. If more has been logged meanwhile,
+	// the reading starts at the first line of the last MaxCatchUp bytes. If zero, the default size is used.
+	MaxCatchUp uint64 `mapstructure:"maxCatchUp"`
+
+	// Window saves the last lines received and shows them again at startup.
+	Window bool `mapstructure:"window"`
+}
+
+// IsEmpty returns true if no resume setting is set.
+func (r Resume) IsEmpty() bool {
+	return r == Resume{}
+}
+
+// IsEnabled returns true if the resume is enabled.
+func (r Resume) IsEnabled() bool {
+	return r.Enabled != nil && *r.Enabled
+}
+
+// withDefaults returns r with the fields not set taken from defaults. Window is taken only if nothing is set.
+func (r Resume) withDefaults(defaults Resume) Resume {
+	if r.IsEmpty() {
+		return defaults
+	}
+	if r.Enabled == nil {
+		r.Enabled = defaults.Enabled
+	}
+	if r.MaxCatchUp == 0 {
+		r.MaxCatchUp = defaults.MaxCatchUp
+	}
+	return r
+}
+
 type LoggerConfiguration struct {
 	Name     string `mapstructure:"name"`
 	Host     Host   `mapstructure:"host"`
 	JumpHost Host   `mapstructure:"jumpHost"`
 	File     string
+
+	// HostKeyPolicy is one of strict, accept-new or off. Default is accept-new, which is also the policy
+	// of the connections made without service (ssh.DefaultHostKeyPolicy).
+	HostKeyPolicy string `mapstructure:"hostKeyPolicy"`
+
+	// KnownHosts is a known_hosts file checked before ~/.ssh/known_hosts. New host keys are added to it.
+	KnownHosts string `mapstructure:"knownHosts"`
+
+	// HostCA is a file with the public keys of the authorities signing the host certificates.
+	HostCA string `mapstructure:"hostCA"`
+
+	// Proxy used to connect to the host. If empty, the global proxy is used.
+	Proxy Proxy `mapstructure:"proxy"`
+
+	// CommandTimeout is the maximum time a remote command can take (e.g. 10s). The ssh session is closed after it.
+	CommandTimeout time.Duration `mapstructure:"commandTimeout"`
+
+	// Poll sets how often the file is polled. The fields not set are taken from the global poll settings.
+	Poll Poll `mapstructure:"poll"`
+
+	// ChunkSize is the maximum number of bytes read by one command. If zero, DefaultChunkSize is used.
+	ChunkSize uint32 `mapstructure:"chunkSize"`
+
+	// Filter is applied by the remote host before sending the data.
+	Filter Filter `mapstructure:"filter"`
+
+	// Compression compresses the data with gzip on the remote host. If gzip is not found, the data is not compressed.
+	Compression bool `mapstructure:"compression"`
+
+	// CacheSize is the maximum number of bytes kept in memory for the service. If zero, the default size is used.
+	CacheSize uint32 `mapstructure:"cacheSize"`
+
+	// Spill moves the data evicted from the cache to disk.
+	Spill Spill `mapstructure:"spill"`
+
+	// Resume starts reading from the position reached by the previous run.
+	Resume Resume `mapstructure:"resume"`
+
+	// Merge lists the names of the services shown in one timeline sorted by timestamp.
+	// A merged service has no host and no file.
+	Merge []string `mapstructure:"merge"`
+
+	// ReorderWindow is how long the lines of a merged service are held to be sorted. If zero, the default window is used.
+	ReorderWindow time.Duration `mapstructure:"reorderWindow"`
+
+	// TimeFormats are the layouts (e.g. 2006-01-02 15:04:05.000) of the timestamps beginning the lines of a merged service.
+	// They are tried before the common formats (RFC 3339, syslog).
+	TimeFormats []string `mapstructure:"timeFormats"`
+
+	// Group is the group of the service in the menu (e.g. its environment).
+	Group string `mapstructure:"group"`
+
+	// Tags are labels of the service. The menu can group the services by tag.
+	Tags []string `mapstructure:"tags"`
+}
+
+// IsMerged returns true if the service merges the lines of other services.
+func (c LoggerConfiguration) IsMerged() bool {
+	return len(c.Merge) > 0
 }
 
 type Configuration struct {
 	LoggerConfigurations []LoggerConfiguration `mapstructure:"services"`
 	DefaultChunkSize     uint32
+
+	// Proxy is used by the services without proxy.
+	Proxy Proxy `mapstructure:"proxy"`
+
+	// Poll is used for the poll settings not set by the services.
+	Poll Poll `mapstructure:"poll"`
+
+	// CacheSize is used by the services without cache size.
+	CacheSize uint32 `mapstructure:"cacheSize"`
+
+	// CacheBudget is the maximum number of bytes kept in memory by all the services. If zero, there is no limit.
+	CacheBudget uint64 `mapstructure:"cacheBudget"`
+
+	// Spill is used by the services without spill settings.
+	Spill Spill `mapstructure:"spill"`
+
+	// Resume is used by the services without resume settings.
+	Resume Resume `mapstructure:"resume"`
+}
+
+// applyDefaults sets the global settings on the services which don't override them.
+func (c *Configuration) applyDefaults() {
+	for i := range c.LoggerConfigurations {
+		if c.LoggerConfigurations[i].Proxy.IsEmpty() {
+			c.LoggerConfigurations[i].Proxy = c.Proxy
+		}
+		if c.LoggerConfigurations[i].ChunkSize == 0 {
+			c.LoggerConfigurations[i].ChunkSize = c.DefaultChunkSize
+		}
+		if c.LoggerConfigurations[i].CacheSize == 0 {
+			c.LoggerConfigurations[i].CacheSize = c.CacheSize
+		}
+		c.LoggerConfigurations[i].Spill = c.LoggerConfigurations[i].Spill.withDefaults(c.Spill)
+		c.LoggerConfigurations[i].Resume = c.LoggerConfigurations[i].Resume.withDefaults(c.Resume)
+		c.LoggerConfigurations[i].Poll = c.LoggerConfigurations[i].Poll.withDefaults(c.Poll)
+	}
+}
+
+// VaultReferences returns the names of the vault secrets referenced by the configuration.
+func (c *Configuration) VaultReferences() []string {
+	var names []string
+	c.forEachSecret(func(secret *string) {
+		if strings.HasPrefix(*secret, VaultPrefix) {
+			names = append(names, strings.TrimPrefix(*secret, VaultPrefix))
+		}
+	})
+	return names
+}
+
+// ResolveSecrets replaces the vault references with the secrets returned by lookup.
+func (c *Configuration) ResolveSecrets(lookup func(name string) (string, error)) error {
+	var err error
+	c.forEachSecret(func(secret *string) {
+		if err != nil || !strings.HasPrefix(*secret, VaultPrefix) {
+			return
+		}
+		var s string
+		s, err = lookup(strings.TrimPrefix(*secret, VaultPrefix))
+		*secret = s
+	})
+	return err
+}
+
+// forEachSecret calls f with a pointer to every password and passphrase of the configuration.
+func (c *Configuration) forEachSecret(f func(secret *string)) {
+	for i := range c.LoggerConfigurations {
+		for _, host := range []*Host{&c.LoggerConfigurations[i].Host, &c.LoggerConfigurations[i].JumpHost} {
+			f(&host.Password)
+			f(&host.Passphrase)
+		}
+	}
 }
 
 var (
@@ -44,10 +336,30 @@ func ReadConfigurationFile(file string) Configuration {
 		os.Stderr.WriteString(fmt.Sprintf("Configuration error: %s", err))
 	}
 
-	err := mapstructure.Decode(viper.AllSettings(), &settings)
+	c, err := decodeConfiguration(viper.AllSettings())
 	if err != nil {
 		panic(err)
 	}
 
+	settings = c
 	return settings
 }
+
+// decodeConfiguration returns the configuration of the values read by viper with the global settings applied to the services.
+func decodeConfiguration(values map[string]interface{}) (Configuration, error) {
+	var c Configuration
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     &c,
+	})
+	if err != nil {
+		return Configuration{}, err
+	}
+
+	if err := decoder.Decode(values); err != nil {
+		return Configuration{}, err
+	}
+
+	c.applyDefaults()
+	return c, nil
+}
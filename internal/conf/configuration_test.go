@@ -0,0 +1,57 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestEnabledDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  string
+		service string
+		enabled bool
+	}{
+		{"omitted key takes the global setting", "enabled: true", "other: 1", true},
+		{"omitted setting takes the global setting", "enabled: true", "", true},
+		{"explicit true", "enabled: false", "enabled: true", true},
+		{"explicit false overrides the global setting", "enabled: true", "enabled: false", false},
+		{"omitted everywhere", "", "", false},
+	}
+
+	// a field other than enabled of each setting
+	others := map[string]string{"spill": "maxSize", "resume": "maxCatchUp"}
+
+	for _, test := range tests {
+		for key, other := range others {
+			yaml := "services:\n  - name: app\n"
+			if len(test.service) > 0 {
+				yaml += "    " + key + ":\n      " + strings.Replace(test.service, "other", other, 1) + "\n"
+			}
+			if len(test.global) > 0 {
+				yaml += key + ":\n  " + test.global + "\n"
+			}
+
+			v := viper.New()
+			v.SetConfigType("yaml")
+			if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			c, err := decodeConfiguration(v.AllSettings())
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			service := c.LoggerConfigurations[0]
+			enabled := service.Spill.IsEnabled()
+			if key == "resume" {
+				enabled = service.Resume.IsEnabled()
+			}
+			if enabled != test.enabled {
+				t.Errorf("%s %s: Expected: %v. Actual: %v", key, test.name, test.enabled, enabled)
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package gui
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gdamore/tcell"
+	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/tview"
+)
+
+// maxContextLines is the maximum number of lines shown before and after a line matching the filters.
+const maxContextLines = 20
+
+// lineFilter selects the lines matching a regular expression, or the lines not matching it if exclude is true.
+type lineFilter struct {
+	text    string
+	re      *regexp.Regexp
+	exclude bool
+}
+
+// newLineFilter returns the filter typed in the filter bar. A leading ! excludes the matching lines.
+// It returns false if the pattern is empty.
+func newLineFilter(text string) (lineFilter, bool) {
+	f := lineFilter{text: text}
+
+	pattern := text
+	if strings.HasPrefix(pattern, "!") {
+		f.exclude = true
+		pattern = pattern[1:]
+	}
+	if len(pattern) == 0 {
+		return f, false
+	}
+
+	f.re = compilePattern(pattern)
+	return f, true
+}
+
+// compilePattern returns the regular expression of pattern, typed in the filter or the search bar.
+// The case is ignored if the pattern has no upper case letter. A pattern which is not a valid regular
+// expression is matched as plain text.
+func compilePattern(pattern string) *regexp.Regexp {
+	flags := ""
+	if strings.ToLower(pattern) == pattern {
+		flags = "(?i)"
+	}
+	re, err := regexp.Compile(flags + pattern)
+	if err != nil {
+		re = regexp.MustCompile(flags + regexp.QuoteMeta(pattern))
+	}
+	return re
+}
+
+func (f lineFilter) match(line []byte) bool {
+	return f.re.Match(line) != f.exclude
+}
+
+// filtered returns true if the lines are filtered. The mutex must be held.
+func (l *LogView) filtered() bool {
+	return len(l.filters) > 0 || l.editing != nil || l.minLevel > log.LevelUnknown
+}
+
+// matches returns true if r has the minimum level and passes the filters and the filter being typed.
+// A line without level is not hidden by the minimum level. The mutex must be held.
+func (l *LogView) matches(r log.Record) bool {
+	if r.Level != log.LevelUnknown && r.Level < l.minLevel {
+		return false
+	}
+	for _, f := range l.filters {
+		if !f.match(r.Line) {
+			return false
+		}
+	}
+	return l.editing == nil || l.editing.match(r.Line)
+}
+
+// renderFrom renders the records from the index from which pass the filters, with their context lines.
+// Two groups of lines which are not contiguous are separated by --. The mutex must be held.
+func (l *LogView) renderFrom(from int) string {
+	if !l.filtered() {
+		text := l.render(l.records[from:])
+		l.shown += strings.Count(text, "\n")
+		return text
+	}
+
+	var b strings.Builder
+	for i := from; i < len(l.records); i++ {
+		if !l.matches(l.records[i]) {
+			if l.afterLeft > 0 {
+				b.WriteString(l.render(l.records[i : i+1]))
+				l.lastShown = i
+				l.afterLeft--
+			}
+			continue
+		}
+
+		start := i - l.before
+		if start <= l.lastShown {
+			start = l.lastShown + 1
+		}
+		if start < 0 {
+			start = 0
+		}
+		if l.lastShown >= 0 && start > l.lastShown+1 && l.before+l.after > 0 {
+			b.WriteString("[gray]--[-]\n")
+		}
+		b.WriteString(l.render(l.records[start : i+1]))
+		l.lastShown = i
+		l.afterLeft = l.after
+	}
+
+	text := b.String()
+	l.shown += strings.Count(text, "\n")
+	return text
+}
+
+// rerender renders all the records again. The mutex must be held.
+func (l *LogView) rerender() {
+	l.lastShown = -1
+	l.afterLeft = 0
+	l.shown = 0
+	l.matchCount = 0
+	l.textView.SetText(l.renderFrom(0))
+}
+
+// refresh renders all the records again. The view follows the new lines, or shows the last match of the search.
+// The mutex must be held.
+func (l *LogView) refresh() {
+	l.rerender()
+	l.textView.ScrollToEnd()
+
+	l.currentMatch = l.matchCount - 1
+	l.showMatch(true)
+}
+
+// OpenFilterBar shows the filter bar. The lines are filtered as the filter is typed. Enter stacks the filter
+// on the filters already applied and calls applied, Esc drops it.
+func (l *LogView) OpenFilterBar(applied func()) {
+	if l.showMenu {
+		return
+	}
+
+	l.bar = tview.NewInputField().
+		SetLabel("Filter (!: exclude): ").
+		SetFieldBackgroundColor(tcell.ColorBlack)
+	l.bar.SetChangedFunc(func(text string) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		l.editing = nil
+		if f, ok := newLineFilter(text); ok {
+			l.editing = &f
+		}
+		l.refresh()
+	})
+	l.bar.SetDoneFunc(func(key tcell.Key) {
+		l.mutex.Lock()
+		f := l.editing
+		l.editing = nil
+		if key == tcell.KeyEnter && f != nil {
+			l.filters = append(l.filters, *f)
+		}
+		l.refresh()
+		l.mutex.Unlock()
+
+		l.bar = nil
+		l.app.SetFocus(l.textView)
+		if key == tcell.KeyEnter && f != nil {
+			applied()
+		}
+	})
+	l.app.SetFocus(l.bar)
+}
+
+// RemoveFilter removes the last filter applied.
+func (l *LogView) RemoveFilter() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.filters) == 0 {
+		return
+	}
+	l.filters = l.filters[:len(l.filters)-1]
+	l.refresh()
+}
+
+// SetContext adds before and after (which can be negative) to the number of lines shown before and after
+// the lines matching the filters.
+func (l *LogView) SetContext(before, after int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.before = clampContext(l.before + before)
+	l.after = clampContext(l.after + after)
+	if l.filtered() {
+		l.refresh()
+	}
+}
+
+func clampContext(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > maxContextLines {
+		return maxContextLines
+	}
+	return n
+}
+
+// filterLine returns the line describing the filters and the minimum level applied. It is empty if there is none.
+func (l *LogView) filterLine() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var parts []string
+	if l.minLevel > log.LevelUnknown {
+		parts = append(parts, fmt.Sprintf("[yellow]Level:[white] %s and above", l.minLevel))
+	}
+	if len(l.filters) > 0 {
+		texts := make([]string, len(l.filters))
+		for i, f := range l.filters {
+			texts[i] = tview.Escape(f.text)
+		}
+		parts = append(parts, fmt.Sprintf("[yellow]Filters:[white] %s  [yellow]Context:[white] %d before, %d after  [gray]%s",
+			strings.Join(texts, " [yellow]|[white] "), l.before, l.after, tview.Escape("(f: add, F: remove, [/]: before, {/}: after)")))
+	}
+	return strings.Join(parts, "  ")
+}
@@ -1,12 +1,18 @@
 package gui
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gdamore/tcell"
+	"github.com/golang/glog"
 	"github.com/tupyy/tview"
 	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/lazylogger/internal/ssh"
 )
 
 const keyOne = rune('1')
@@ -38,8 +44,40 @@ type Gui struct {
 
 	// close the start method
 	done chan interface{}
+
+	// modals displayed, the last one on top. Key events are not handled while a modal is shown.
+	modals []modalPage
+
+	// modalCounter is incremented on showModal. It makes the name of each modal page unique.
+	modalCounter int
+
+	// connections being established for each view. Only the last connection of a view is kept.
+	pending map[*LogView]*pendingConnect
 }
 
+// modalPage is a modal displayed on top of the current page.
+type modalPage struct {
+	name string
+	p    tview.Primitive
+}
+
+// pendingConnect is a connection being established for a view.
+type pendingConnect struct {
+	logID int
+
+	// aborts the connection
+	cancel context.CancelFunc
+}
+
+// backfillSize is the maximum number of bytes read when the user scrolls past the first line of a view.
+const backfillSize = 64 * 1024
+
+// cacheBackfillSize is the maximum number of bytes read from the cache when a filter is applied to a view.
+const cacheBackfillSize = 4 * 1024 * 1024
+
+// errConnectCanceled is shown in the view when the user cancels a pending connection.
+var errConnectCanceled = errors.New("connection canceled")
+
 func NewGui(app *tview.Application, lm *log.LoggerManager) *Gui {
 
 	gui := Gui{
@@ -50,6 +88,7 @@ func NewGui(app *tview.Application, lm *log.LoggerManager) *Gui {
 		pages:         tview.NewPages(),
 		pageCounter:   -1,
 		done:          make(chan interface{}),
+		pending:       make(map[*LogView]*pendingConnect),
 	}
 
 	return &gui
@@ -57,7 +96,12 @@ func NewGui(app *tview.Application, lm *log.LoggerManager) *Gui {
 
 // Start starts a go routin which draws app every 0.5s.
 // In this way, we avoid to pass app pointer to every primitive which needs to be redrawn
+// If services can resume from the previous run, the user is asked whether to resume.
 func (gui *Gui) Start() {
+	if names := gui.loggerManager.ResumableServices(); len(names) > 0 {
+		gui.askResume(names)
+	}
+
 	go func(done chan interface{}) {
 		for {
 			select {
@@ -77,6 +121,8 @@ func (gui *Gui) Stop() {
 // Layout returns the root flex
 func (gui *Gui) Layout() tview.Primitive {
 	gui.pages.AddPage("help", newHelpView(), true, true)
+	gui.pages.AddPage("stats", NewStatsView(gui.loggerManager.Stats), true, false)
+	gui.pages.AddPage("hosts", NewHostsView(gui.loggerManager.Hosts), true, false)
 
 	gui.rootFlex = tview.NewFlex().SetDirection(tview.FlexRow).AddItem(gui.pages, 0, 1, true)
 	gui.rootFlex.AddItem(gui.navBar, 1, 1, true)
@@ -86,6 +132,10 @@ func (gui *Gui) Layout() tview.Primitive {
 // HandleEventKey handles key events. If the key is not mapped
 // to an gui actions then it is passed to the current logMainView.
 func (gui *Gui) HandleEventKey(key *tcell.EventKey) {
+	if len(gui.modals) > 0 || gui.IsTyping() {
+		return
+	}
+
 	switch key.Key() {
 	case tcell.KeyLeft:
 		gui.previousPage()
@@ -104,6 +154,10 @@ func (gui *Gui) HandleEventKey(key *tcell.EventKey) {
 		} else {
 			gui.showHelp()
 		}
+	case tcell.KeyCtrlT:
+		gui.toggleInfoPage("stats")
+	case tcell.KeyCtrlO:
+		gui.toggleInfoPage("hosts")
 	default:
 		// if the key is a page number then show the page otherwise pass the key event to the currentLogMainView.
 		idx := int(key.Rune() - keyOne)
@@ -117,18 +171,271 @@ func (gui *Gui) HandleEventKey(key *tcell.EventKey) {
 	}
 }
 
+// IsTyping returns true while the user types in an input field (e.g. the search box of the menu).
+// The keys are not handled by the gui meanwhile.
+func (gui *Gui) IsTyping() bool {
+	_, ok := gui.app.GetFocus().(*tview.InputField)
+	return ok
+}
+
 // When a new logger is selected using the menu, the current view
 // must be unregistred from the logger currently attached to it and
 // registered to the new logger
 func (gui *Gui) handleLogChange(logID int, view *LogView) {
 	gui.loggerManager.UnregisterWriter(view)
-	gui.loggerManager.RegisterWriter(logID, view)
 	gui.app.SetFocus(view)
+
+	// the connection of the logger previously selected is not waited for anymore
+	if previous, ok := gui.pending[view]; ok {
+		previous.cancel()
+	}
+
+	// connecting can take a while and ask the user for credentials so it must not block the event loop.
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pendingConnect{logID: logID, cancel: cancel}
+	gui.pending[view] = p
+	view.SetConnecting(time.Now())
+
+	go func() {
+		err := gui.loggerManager.Connect(ctx, logID)
+		cancel()
+		gui.app.QueueUpdateDraw(func() {
+			gui.handleConnectResult(p, view, err)
+		})
+	}()
+}
+
+// handleConnectResult registers the view to the logger once connected. The result is dropped if the connection
+// has been canceled or another logger has been selected in the meantime. If the host key is unknown,
+// the user is asked to trust it and the connection is tried again.
+func (gui *Gui) handleConnectResult(p *pendingConnect, view *LogView, err error) {
+	if gui.pending[view] != p {
+		glog.V(2).Infof("dropping result of canceled connection to logger %d", p.logID)
+		return
+	}
+	delete(gui.pending, view)
+
+	var hostKeyErr *ssh.UnknownHostKeyError
+	if errors.As(err, &hostKeyErr) {
+		gui.askTrustHostKey(hostKeyErr, func() {
+			gui.handleLogChange(p.logID, view)
+		}, func() {
+			view.SetState("failed", err)
+			gui.app.SetFocus(view)
+		})
+		return
+	}
+
+	if err == nil {
+		err = gui.loggerManager.RegisterWriter(p.logID, view)
+	}
+
+	if err != nil {
+		glog.Errorf("cannot connect logger %d: %s", p.logID, err)
+		view.SetState("failed", err)
+		return
+	}
+
+	if expiry, ok := gui.loggerManager.CertificateExpiry(p.logID); ok {
+		view.SetCertificateExpiry(expiry)
+	}
+}
+
+// loggerHealth returns the state of the logger if it is running.
+func (gui *Gui) loggerHealth(logID int) (string, bool) {
+	state, ok := gui.loggerManager.LoggerState(logID)
+	if !ok {
+		return "", false
+	}
+	return state.String(), true
+}
+
+// cancelConnect cancels the pending connection of the view, if any. The dial is aborted unless
+// another view waits for the same logger.
+func (gui *Gui) cancelConnect(view *LogView) {
+	p, ok := gui.pending[view]
+	if !ok {
+		return
+	}
+	p.cancel()
+	delete(gui.pending, view)
+	view.SetState("failed", errConnectCanceled)
+}
+
+// backfill shows the lines older than the first line of the view. The lines can be read from the remote file
+// so they are read outside the event loop.
+func (gui *Gui) backfill(view *LogView) {
+	if !view.StartBackfill() {
+		return
+	}
+	gui.keepOldest(view)
+
+	go func() {
+		records, err := gui.loggerManager.Backfill(view, backfillSize)
+		if err != nil && err != log.ErrNoOlderData {
+			glog.Warningf("cannot read older lines: %s", err)
+		}
+
+		gui.app.QueueUpdateDraw(func() {
+			view.EndBackfill(records, err == log.ErrNoOlderData)
+		})
+	}()
+}
+
+// backfillCache shows the lines held in the cache of the logger which are older than the first line of the view,
+// at most cacheBackfillSize bytes. The file is not read.
+func (gui *Gui) backfillCache(view *LogView) {
+	if !view.StartBackfill() {
+		return
+	}
+	gui.keepOldest(view)
+
+	go func() {
+		records, err := gui.loggerManager.BackfillCache(view, cacheBackfillSize)
+		if err != nil && err != log.ErrNoOlderData {
+			glog.Warningf("cannot read cached lines: %s", err)
+		}
+
+		gui.app.QueueUpdateDraw(func() {
+			view.EndBackfill(records, false)
+		})
+	}()
+}
+
+// keepOldest tells the logger manager the oldest line of the view. The view drops its oldest lines to bound its memory:
+// they are read again by the backfills.
+func (gui *Gui) keepOldest(view *LogView) {
+	if offset, ok := view.FirstOffset(); ok {
+		gui.loggerManager.DroppedBefore(view, offset)
+	}
+}
+
+// askTrustHostKey shows the fingerprint of the host key and asks the user to trust it.
+// If the user trusts the key, it is added to the known_hosts file and trusted is called.
+func (gui *Gui) askTrustHostKey(hostKeyErr *ssh.UnknownHostKeyError, trusted, rejected func()) {
+	text := fmt.Sprintf("The authenticity of host %s can't be established.\n\n%s key fingerprint is\n%s\n\nDo you want to trust this host?",
+		hostKeyErr.Hostname, hostKeyErr.Key.Type(), hostKeyErr.Fingerprint())
+
+	var name string
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Trust", "Reject"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			gui.hideModal(name)
+			if buttonLabel != "Trust" {
+				rejected()
+				return
+			}
+
+			if err := hostKeyErr.Trust(); err != nil {
+				glog.Errorf("cannot trust host key of %s: %s", hostKeyErr.Hostname, err)
+				rejected()
+				return
+			}
+			trusted()
+		})
+
+	name = gui.showModal("hostkey", modal)
+}
+
+// askResume asks the user whether the services start from the position reached by the previous run.
+func (gui *Gui) askResume(names []string) {
+	text := fmt.Sprintf("Resume %s from the last position?\n\nThe lines logged since the last run will be shown.", strings.Join(names, ", "))
+
+	var name string
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Resume", "Start fresh"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			gui.hideModal(name)
+			gui.loggerManager.SetResume(buttonLabel == "Resume")
+		})
+
+	name = gui.showModal("resume", modal)
+}
+
+// Prompt implements ssh.PromptFunc. It shows a form with one field for each question and waits for the user.
+// It must not be called from the event loop.
+func (gui *Gui) Prompt(title string, questions []ssh.Question) ([]string, error) {
+	answers := make(chan []string, 1)
+
+	gui.app.QueueUpdateDraw(func() {
+		var name string
+		form := tview.NewForm()
+		for _, q := range questions {
+			if q.Secret {
+				form.AddPasswordField(q.Label, "", 30, '*', nil)
+			} else {
+				form.AddInputField(q.Label, "", 30, nil, nil)
+			}
+		}
+
+		form.AddButton("OK", func() {
+			values := make([]string, len(questions))
+			for i := range questions {
+				values[i] = form.GetFormItem(i).(*tview.InputField).GetText()
+			}
+			gui.hideModal(name)
+			answers <- values
+		})
+		form.AddButton("Cancel", func() {
+			gui.hideModal(name)
+			answers <- nil
+		})
+		form.SetBorder(true).SetTitle(title)
+
+		name = gui.showModal("prompt", center(form, 60, 2*len(questions)+5))
+	})
+
+	values := <-answers
+	if values == nil {
+		return nil, ssh.ErrPromptCanceled
+	}
+	return values, nil
+}
+
+// showModal displays p on top of the current page and the other modals, and gives it the focus.
+// It returns the name of the page of the modal, to be passed to hideModal.
+func (gui *Gui) showModal(kind string, p tview.Primitive) string {
+	gui.modalCounter++
+	name := fmt.Sprintf("%s-%d", kind, gui.modalCounter)
+
+	gui.modals = append(gui.modals, modalPage{name: name, p: p})
+	gui.pages.AddPage(name, p, true, true)
+	gui.app.SetFocus(p)
+	return name
+}
+
+// hideModal removes the modal name. The focus goes back to the modal below it, or to the current page
+// if no modal is left.
+func (gui *Gui) hideModal(name string) {
+	idx := -1
+	for i, m := range gui.modals {
+		if m.name == name {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return
+	}
+	gui.pages.RemovePage(name)
+	gui.modals = append(gui.modals[:idx], gui.modals[idx+1:]...)
+
+	if len(gui.modals) > 0 {
+		top := gui.modals[len(gui.modals)-1]
+		gui.pages.ShowPage(top.name)
+		gui.app.SetFocus(top.p)
+		return
+	}
+
+	if gui.currentLogMainView != nil {
+		gui.currentLogMainView.Select()
+	}
 }
 
 func (gui *Gui) addPage() {
 	gui.pageCounter++
-	newLogMainView := NewLogMainView(gui.pageCounter, gui.app, gui.loggerManager.GetConfigurations(), gui.handleLogChange)
+	newLogMainView := NewLogMainView(gui.pageCounter, gui.app, gui.loggerManager.GetConfigurations(), gui.handleLogChange, gui.cancelConnect, gui.backfill, gui.loggerHealth, gui.backfillCache)
 	newLogMainView.Select()
 
 	gui.views = append(gui.views, newLogMainView)
@@ -179,10 +486,10 @@ func (gui *Gui) removeCurrentPage() {
 }
 
 // Show the next page. If the current page is the last page than show the first page.
-// When cycling through pages, the help page is not taken into account.
+// When cycling through pages, the help, stats and hosts pages are not taken into account.
 func (gui *Gui) nextPage() {
 	currentPageName, _ := gui.pages.GetFrontPage()
-	if currentPageName == "help" {
+	if currentPageName == "help" || currentPageName == "stats" || currentPageName == "hosts" {
 		return
 	}
 
@@ -195,10 +502,10 @@ func (gui *Gui) nextPage() {
 }
 
 // Show the previous page. If the current page is the first one than show the last page.
-// When cycling through pages, the help page is not taken into account.
+// When cycling through pages, the help, stats and hosts pages are not taken into account.
 func (gui *Gui) previousPage() {
 	currentPageName, _ := gui.pages.GetFrontPage()
-	if currentPageName == "help" {
+	if currentPageName == "help" || currentPageName == "stats" || currentPageName == "hosts" {
 		return
 	}
 
@@ -221,3 +528,23 @@ func (gui *Gui) showPage(idx int) {
 func (gui *Gui) showHelp() {
 	gui.navBar.SelectPage("help")
 }
+
+// toggleInfoPage shows the page name (stats or hosts), or shows the current page again if name is shown.
+func (gui *Gui) toggleInfoPage(name string) {
+	currentPageName, _ := gui.pages.GetFrontPage()
+	if currentPageName != name {
+		gui.pages.SwitchToPage(name)
+		gui.navBar.SelectPage(name)
+		return
+	}
+
+	if gui.currentLogMainView == nil {
+		gui.pages.SwitchToPage("help")
+		gui.navBar.SelectPage("help")
+		return
+	}
+
+	n := strconv.Itoa(gui.currentLogMainView.id)
+	gui.pages.SwitchToPage(n)
+	gui.navBar.SelectPage(n)
+}
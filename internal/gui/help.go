@@ -13,8 +13,10 @@ var helpTextView = tview.NewTextView()
 const (
 	subtitle   = `lazylogger v1.1 - Visualize logs from different hosts`
 	navigation = `Right arrow: Next Page    Left arrow: Previous Page   P: Show Help     Ctrl-C: Exit`
-	pages      = `Ctrl+A: Add page     Ctrl+X: Delete Page`
-	window     = `v: Vertical Split     h: Hortizontal Split   m: Show Menu   x: Remove selected view`
+	pages      = `Ctrl+A: Add page     Ctrl+X: Delete Page     Ctrl+T: Show Stats     Ctrl+O: Show Hosts`
+	window     = `v: Vertical Split     h: Hortizontal Split   m: Show Menu   x: Remove selected view   c: Cancel connection`
+	filters    = `f: Add filter (!: exclude)   F: Remove last filter   [ ]: Less/more lines before   { }: Less/more lines after`
+	search     = `/: Search   n: Next match   N: Previous match   L: Minimum level`
 )
 
 func newHelpView() (content tview.Primitive) {
@@ -38,7 +40,9 @@ func newHelpView() (content tview.Primitive) {
 		AddText("", true, tview.AlignCenter, tcell.ColorWhite).
 		AddText(navigation, true, tview.AlignCenter, tcell.ColorDarkMagenta).
 		AddText(pages, true, tview.AlignCenter, tcell.ColorDarkMagenta).
-		AddText(window, true, tview.AlignCenter, tcell.ColorDarkMagenta)
+		AddText(window, true, tview.AlignCenter, tcell.ColorDarkMagenta).
+		AddText(filters, true, tview.AlignCenter, tcell.ColorDarkMagenta).
+		AddText(search, true, tview.AlignCenter, tcell.ColorDarkMagenta)
 
 	// Create a Flex layout that centers the logo and subtitle.
 	flex := tview.NewFlex().
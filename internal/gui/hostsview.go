@@ -0,0 +1,69 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell"
+	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/tview"
+)
+
+// clockWarning is the clock offset from which the offset of a host is highlighted.
+const clockWarning = time.Second
+
+// HostsView shows the connections of the running loggers and the clock offset of their hosts.
+// It is refreshed each time it is drawn.
+type HostsView struct {
+	*tview.Table
+
+	// returns the connections of the running loggers
+	hosts func() []log.HostInfo
+}
+
+var hostsHeaders = []string{"Host", "User", "Clock offset", "Round trip", "Services"}
+
+func NewHostsView(hosts func() []log.HostInfo) *HostsView {
+	table := tview.NewTable().SetFixed(1, 0).SetSelectable(false, false)
+	table.SetBorder(true).SetTitle("Hosts")
+
+	return &HostsView{Table: table, hosts: hosts}
+}
+
+// Draw refreshes the table and draws it.
+func (h *HostsView) Draw(screen tcell.Screen) {
+	h.Clear()
+
+	for col, header := range hostsHeaders {
+		h.SetCell(0, col, tview.NewTableCell(header).SetTextColor(tcell.ColorYellow).SetSelectable(false).SetExpansion(1))
+	}
+
+	for i, host := range h.hosts() {
+		offset, rtt := "unknown", "-"
+		color := tcell.ColorWhite
+		if host.ClockMeasured {
+			offset = formatOffset(host.ClockOffset)
+			rtt = host.RoundTrip.Round(time.Millisecond).String()
+			if host.ClockOffset >= clockWarning || host.ClockOffset <= -clockWarning {
+				color = tcell.ColorOrange
+			}
+		}
+
+		row := []string{host.Address, host.User, offset, rtt, strings.Join(host.Services, ", ")}
+		for col, text := range row {
+			cell := tview.NewTableCell(text).SetExpansion(1)
+			if col == 2 {
+				cell.SetTextColor(color)
+			}
+			h.SetCell(i+1, col, cell)
+		}
+	}
+
+	h.Table.Draw(screen)
+}
+
+// formatOffset returns the offset in milliseconds with its sign: a positive offset means the clock of the host is ahead.
+func formatOffset(offset time.Duration) string {
+	return fmt.Sprintf("%+.0f ms", float64(offset)/float64(time.Millisecond))
+}
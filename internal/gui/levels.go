@@ -0,0 +1,121 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tupyy/lazylogger/internal/log"
+)
+
+// levelStyle is the color and the attributes of the lines of a level.
+type levelStyle struct {
+	color string
+	bold  bool
+}
+
+// levelStyles are the styles of the levels. The lines of the levels not found are not colored.
+var levelStyles = map[log.Level]levelStyle{
+	log.LevelTrace: {color: "gray"},
+	log.LevelDebug: {color: "skyblue"},
+	log.LevelWarn:  {color: "yellow"},
+	log.LevelError: {color: "red"},
+	log.LevelFatal: {color: "red", bold: true},
+}
+
+// open returns the color tag beginning a line.
+func (s levelStyle) open() string {
+	switch {
+	case s.color == "":
+		return ""
+	case s.bold:
+		return "[" + s.color + "::b]"
+	default:
+		return "[" + s.color + "]"
+	}
+}
+
+// restore returns the color tag written after a match of the search to color the rest of the line again.
+func (s levelStyle) restore() string {
+	if s.color == "" {
+		return "[-:-]"
+	}
+	return "[" + s.color + ":-]"
+}
+
+// close returns the color tag ending a line.
+func (s levelStyle) close() string {
+	switch {
+	case s.color == "":
+		return ""
+	case s.bold:
+		return "[-::-]"
+	default:
+		return "[-]"
+	}
+}
+
+// minLevels are the minimum levels selected in turn. LevelUnknown shows all the lines.
+var minLevels = []log.Level{log.LevelUnknown, log.LevelDebug, log.LevelInfo, log.LevelWarn, log.LevelError, log.LevelFatal}
+
+// classify counts the records from the index from to the index to by level. A record without level
+// (e.g. a line of a stack trace) gets the level of the record before it. The mutex must be held.
+func (l *LogView) classify(from, to int) {
+	for i := from; i < to; i++ {
+		r := &l.records[i]
+		if r.Level == log.LevelUnknown && i > 0 {
+			r.Level = l.records[i-1].Level
+		}
+		l.levelCounts[r.Level]++
+	}
+}
+
+// inheritLevel gives the level of the record before the index from to the records without level which follow it.
+// They were the first lines of the view before older lines were added. The mutex must be held.
+func (l *LogView) inheritLevel(from int) {
+	if from == 0 {
+		return
+	}
+
+	level := l.records[from-1].Level
+	if level == log.LevelUnknown {
+		return
+	}
+	for i := from; i < len(l.records) && l.records[i].Level == log.LevelUnknown; i++ {
+		l.records[i].Level = level
+		l.levelCounts[log.LevelUnknown]--
+		l.levelCounts[level]++
+	}
+}
+
+// CycleMinLevel hides the lines with a level lower than the next minimum level. After the highest level,
+// all the lines are shown again.
+func (l *LogView) CycleMinLevel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	next := 0
+	for i, level := range minLevels {
+		if level == l.minLevel {
+			next = (i + 1) % len(minLevels)
+		}
+	}
+	l.minLevel = minLevels[next]
+	l.refresh()
+}
+
+// levelCounters returns the number of lines of the view for each level found, from the highest level.
+func (l *LogView) levelCounters() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var counters []string
+	for level := log.LevelFatal; level > log.LevelUnknown; level-- {
+		if n := l.levelCounts[level]; n > 0 {
+			counters = append(counters, fmt.Sprintf("%s %d", level, n))
+		}
+	}
+	if len(counters) == 0 {
+		return ""
+	}
+	return strings.Join(counters, ", ") + "."
+}
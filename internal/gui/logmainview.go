@@ -27,16 +27,36 @@ type LogMainView struct {
 	// handler called when a logger is selected in the menu.
 	// the handler is passed by Gui
 	selectLoggerHandler func(int, *LogView)
+
+	// handler called to cancel the pending connection of a view.
+	// the handler is passed by Gui
+	cancelConnectHandler func(*LogView)
+
+	// handler called when a view is scrolled up past its first line.
+	// the handler is passed by Gui
+	backfillHandler func(*LogView)
+
+	// returns the state of a running logger to be shown in the menu.
+	// the handler is passed by Gui
+	healthHandler func(int) (string, bool)
+
+	// handler called when the lines held in the cache of the logger and not shown yet are needed (e.g. a filter is applied).
+	// the handler is passed by Gui
+	cacheHandler func(*LogView)
 }
 
-func NewLogMainView(id int, app *tview.Application, conf map[int]conf.LoggerConfiguration, selectLoggerHandler func(int, *LogView)) *LogMainView {
+func NewLogMainView(id int, app *tview.Application, conf map[int]conf.LoggerConfiguration, selectLoggerHandler func(int, *LogView), cancelConnectHandler func(*LogView), backfillHandler func(*LogView), healthHandler func(int) (string, bool), cacheHandler func(*LogView)) *LogMainView {
 	logMainView := &LogMainView{
-		id:                  id,
-		app:                 app,
-		conf:                conf,
-		selectLoggerHandler: selectLoggerHandler,
-		currentIdx:          0,
-		rootFlex:            tview.NewFlex(),
+		id:                   id,
+		app:                  app,
+		conf:                 conf,
+		selectLoggerHandler:  selectLoggerHandler,
+		cancelConnectHandler: cancelConnectHandler,
+		backfillHandler:      backfillHandler,
+		healthHandler:        healthHandler,
+		cacheHandler:         cacheHandler,
+		currentIdx:           0,
+		rootFlex:             tview.NewFlex(),
 	}
 
 	v := logMainView.addView()
@@ -117,6 +137,10 @@ func (logMainView *LogMainView) RemoveCurrentView() *LogView {
 }
 
 func (logMainView *LogMainView) HandleEventKey(key *tcell.EventKey) {
+	if v := logMainView.getSelectedView(); v != nil && v.ScrollsPastTop(key) {
+		logMainView.backfillHandler(v)
+	}
+
 	if key.Key() == tcell.KeyTAB {
 		logMainView.NextView()
 	} else {
@@ -127,9 +151,37 @@ func (logMainView *LogMainView) HandleEventKey(key *tcell.EventKey) {
 			logMainView.HSplit()
 		case rune('m'):
 			logMainView.ShowMenu()
+		case rune('c'):
+			if v := logMainView.getSelectedView(); v != nil {
+				logMainView.cancelConnectHandler(v)
+			}
 		case rune('x'):
 			logMainView.RemoveCurrentView()
 			logMainView.NextView()
+		case rune('f'):
+			if v := logMainView.getSelectedView(); v != nil {
+				v.OpenFilterBar(func() { logMainView.cacheHandler(v) })
+			}
+		case rune('/'):
+			if v := logMainView.getSelectedView(); v != nil {
+				v.OpenSearchBar(func() { logMainView.cacheHandler(v) })
+			}
+		case rune('n'):
+			logMainView.withSelectedView(func(v *LogView) { v.NextMatch(1) })
+		case rune('N'):
+			logMainView.withSelectedView(func(v *LogView) { v.NextMatch(-1) })
+		case rune('L'):
+			logMainView.withSelectedView(func(v *LogView) { v.CycleMinLevel() })
+		case rune('F'):
+			logMainView.withSelectedView(func(v *LogView) { v.RemoveFilter() })
+		case rune('['):
+			logMainView.withSelectedView(func(v *LogView) { v.SetContext(-1, 0) })
+		case rune(']'):
+			logMainView.withSelectedView(func(v *LogView) { v.SetContext(1, 0) })
+		case rune('{'):
+			logMainView.withSelectedView(func(v *LogView) { v.SetContext(0, -1) })
+		case rune('}'):
+			logMainView.withSelectedView(func(v *LogView) { v.SetContext(0, 1) })
 		}
 	}
 }
@@ -144,8 +196,15 @@ func (logMainView *LogMainView) getSelectedView() *LogView {
 	return nil
 }
 
+// withSelectedView calls f with the selected view if it shows the lines of a logger.
+func (logMainView *LogMainView) withSelectedView(f func(v *LogView)) {
+	if v := logMainView.getSelectedView(); v != nil && !v.showMenu {
+		f(v)
+	}
+}
+
 func (logMainView *LogMainView) addView() *LogView {
-	view := NewLogView(logMainView.conf, logMainView.selectLoggerHandler)
+	view := NewLogView(logMainView.app, logMainView.conf, logMainView.selectLoggerHandler, logMainView.healthHandler)
 	logMainView.rootFlex.AddItem(view, 0, 1, true)
 	return view
 }
@@ -1,19 +1,31 @@
 package gui
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gdamore/tcell"
 	"github.com/tupyy/tview"
 	"github.com/tupyy/lazylogger/internal/conf"
+	"github.com/tupyy/lazylogger/internal/log"
 )
 
+// certExpiryWarning is how long before the end of validity of the certificate a warning is shown.
+const certExpiryWarning = 30 * time.Minute
+
 // LogView display the content of a file. It has a status bar and a menu.
 // The menu is used to select from which logger the content is displayed.
 type LogView struct {
 	*tview.Box
 
+	app *tview.Application
+
 	// TextView display the data
 	textView *tview.TextView
 
@@ -29,25 +41,88 @@ type LogView struct {
 	// LoggerConfiguration is used by the menu.
 	conf map[int]conf.LoggerConfiguration
 
-	// Holds the health of the current selected logger.
+	// Holds the health of the current selected logger. Protected by mutex.
 	state string
 
-	// Error if any of the current selected logger.
+	// Error if any of the current selected logger. Protected by mutex.
 	err error
+
+	// Interval between two polls of the file by the selected logger. Protected by mutex.
+	pollInterval time.Duration
+
+	// Time when the connection to the selected logger started. Used to show the elapsed time while connecting.
+	// Protected by mutex.
+	connectStart time.Time
+
+	// End of validity of the certificate used to connect to the host. Zero if no certificate expires.
+	certExpiry time.Time
+
+	// true while older lines are being read. Protected by mutex.
+	backfilling bool
+
+	// true once the oldest line of the logger is shown. Protected by mutex.
+	oldestShown bool
+
+	// protects records and the state. They are written by the logger manager outside the event loop.
+	mutex *sync.Mutex
+
+	// lines received
+	records []log.Record
+
+	// number of bytes of records. Once they take more than the cache window of the logger, the oldest are dropped.
+	// The lines read by the backfills are kept above the window until the view follows the new lines again.
+	size       int
+	window     int
+	backfilled int
+
+	// filters selecting the lines shown and filter being typed in the filter bar. Protected by mutex.
+	filters []lineFilter
+	editing *lineFilter
+
+	// number of lines shown before and after a line matching the filters
+	before int
+	after  int
+
+	// index of the last record shown and number of lines still shown after the last matching line
+	lastShown int
+	afterLeft int
+
+	// number of lines shown
+	shown int
+
+	// search highlighted in the lines. Nil if there is no search. Protected by mutex.
+	search *regexp.Regexp
+
+	// number of matches of the search shown and index of the match selected. -1 if no match is selected.
+	matchCount   int
+	currentMatch int
+
+	// bar where the filter or the search is typed. Nil if the bar is not shown.
+	bar *tview.InputField
+
+	// lines with a lower level are hidden. LevelUnknown shows all the lines. Protected by mutex.
+	minLevel log.Level
+
+	// number of records by level. The records dropped by trim are not counted anymore.
+	levelCounts [log.LevelFatal + 1]int
 }
 
 // NewLogText creates a new TextView primitive
-func NewLogView(conf map[int]conf.LoggerConfiguration, selectLoggerHandler func(int, *LogView)) *LogView {
+func NewLogView(app *tview.Application, conf map[int]conf.LoggerConfiguration, selectLoggerHandler func(int, *LogView), health func(int) (string, bool)) *LogView {
 
 	l := LogView{
 		Box:                 tview.NewBox().SetBackgroundColor(tcell.ColorBlack),
-		textView:            tview.NewTextView(),
+		app:                 app,
+		textView:            tview.NewTextView().SetDynamicColors(true).SetRegions(true),
 		showMenu:            true,
 		selectLoggerHandler: selectLoggerHandler,
 		conf:                conf,
+		mutex:               &sync.Mutex{},
+		lastShown:           -1,
+		currentMatch:        -1,
 	}
 
-	menu := NewMenu(conf, l.handleMenuSelectItem)
+	menu := NewMenu(app, conf, l.handleMenuSelectItem, health)
 	l.menu = menu
 	return &l
 }
@@ -59,30 +134,53 @@ func (l *LogView) Draw(screen tcell.Screen) {
 	x, y, width, height := l.GetInnerRect()
 
 	if l.showMenu {
-		size := len(l.conf)*2 + 6
-		if size > height {
-			l.menu.SetRect(x+int(width/2)-20, y, 50, height)
-		} else {
-			l.menu.SetRect(x+int(width/2)-20, y, 50, size)
-		}
+		l.menu.SetRect(x+int(width/2)-30, y, 60, height)
 		l.menu.Draw(screen)
 	} else {
+		// the filter or search bar, or the filters applied, are shown above the status bar
+		filterLine := l.filterLine()
+		if l.bar != nil || len(filterLine) > 0 {
+			height--
+			if l.bar != nil {
+				l.bar.SetRect(x, y+height-1, width, 1)
+				l.bar.Draw(screen)
+			} else {
+				tview.Print(screen, filterLine, x, y+height-1, width, tview.AlignLeft, tcell.ColorWhite)
+			}
+		}
+
 		l.textView.SetRect(x, y, width, height-1)
 		l.textView.Draw(screen)
 
 		line := ""
-		switch l.state {
+		warning := l.certificateWarning()
+		search := l.searchStatus()
+		levels := l.levelCounters()
+
+		l.mutex.Lock()
+		state, err, connectStart := l.state, l.err, l.connectStart
+		l.mutex.Unlock()
+
+		switch state {
+		case "connecting":
+			elapsed := time.Since(connectStart).Truncate(time.Second)
+			line = fmt.Sprintf("State: %s (%s). Press c to cancel", ToTitle(state), elapsed)
+			line = fmt.Sprintf("[black:blue:b]%s", WithPadding(line, width))
 		case "healthy":
-			line = fmt.Sprintf("State: %s", ToTitle(l.state))
-			line = WithPadding(line, width)
-			line = fmt.Sprintf("[black:green:b]%s", line)
+			line = fmt.Sprintf("State: %s. %s %s %s %s", ToTitle(state), levels, l.pollRate(), search, warning)
+			line = WithPadding(strings.TrimSpace(line), width)
+			if len(warning) > 0 {
+				line = fmt.Sprintf("[black:yellow:b]%s", line)
+			} else {
+				line = fmt.Sprintf("[black:green:b]%s", line)
+			}
 		case "degraded":
-			line = fmt.Sprintf("State: %s. Error: %s", ToTitle(l.state), l.err.Error())
-			line = WithPadding(line, width)
+			line = fmt.Sprintf("State: %s. Error: %s %s %s %s %s", ToTitle(state), err.Error(), levels, l.pollRate(), search, warning)
+			line = WithPadding(strings.TrimSpace(line), width)
 			line = fmt.Sprintf("[black:yellow:b]%s", line)
 		case "failed":
-			line = fmt.Sprintf("State: %s. Error: %s", ToTitle(l.state), l.err.Error())
-			line = WithPadding(line, width)
+			line = fmt.Sprintf("State: %s. Error: %s %s %s %s", ToTitle(state), err.Error(), levels, search, warning)
+			line = WithPadding(strings.TrimSpace(line), width)
 			line = fmt.Sprintf("[black:red:b]%s", line)
 		}
 
@@ -105,9 +203,9 @@ func (l *LogView) Focus(delegate func(p tview.Primitive)) {
 	}
 }
 
-// Return true if either menu of textView has the focus.
+// Return true if either menu, textView or the filter or search bar has the focus.
 func (logView *LogView) HasFocus() bool {
-	return logView.textView.HasFocus() || logView.menu.HasFocus()
+	return logView.textView.HasFocus() || logView.menu.HasFocus() || (logView.bar != nil && logView.bar.HasFocus())
 }
 
 // ShowMenu shows the logger menu
@@ -120,37 +218,313 @@ func (logView *LogView) HideMenu() {
 	logView.showMenu = false
 }
 
-// Set the title of the box.
-func (l *LogView) SetTitle(host, file string) {
-	l.Box.SetTitle(fmt.Sprintf(" Logging [yellow]%s [white]from host [yellow]%s ", file, host))
+// Set the title of the box. If filtered is true, the title shows that the host sends only the lines selected by a filter.
+func (l *LogView) SetTitle(host, file string, filtered bool) {
+	title := fmt.Sprintf(" Logging [yellow]%s [white]from host [yellow]%s ", file, host)
+	if filtered {
+		title += "[white]([red]remote filter[white]) "
+	}
+	l.Box.SetTitle(title)
+}
+
+// SetMergedTitle sets the title of the box showing the lines of the merged services.
+func (l *LogView) SetMergedTitle(services []string) {
+	l.Box.SetTitle(fmt.Sprintf(" Merging [yellow]%s ", strings.Join(services, "[white], [yellow]")))
 }
 
 func (l *LogView) ClearTitle() {
 	l.Box.SetTitle("")
 }
 
-// Clear clears the textView.
+// Clear clears the textView. The textView follows the new lines until the user scrolls up.
 func (l *LogView) Clear() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.records = nil
+	l.size = 0
+	l.backfilled = 0
+	l.lastShown = -1
+	l.afterLeft = 0
+	l.shown = 0
+	l.matchCount = 0
+	l.currentMatch = -1
+	l.levelCounts = [log.LevelFatal + 1]int{}
 	l.textView.Clear()
+	l.textView.Highlight()
+	l.textView.ScrollToEnd()
+	l.backfilling = false
+	l.oldestShown = false
 }
 
-// Write writes new data to the textView.
-func (l *LogView) Write(data []byte) (int, error) {
-	n, err := l.textView.Write(data)
-	l.textView.ScrollToEnd()
-	return n, err
+// WriteRecords writes the new lines to the textView. The view scrolls with the new lines if the last line is shown.
+func (l *LogView) WriteRecords(records []log.Record) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	following := l.following()
+
+	from := len(l.records)
+	l.records = append(l.records, records...)
+	l.size += recordsSize(records)
+	l.classify(from, len(l.records))
+	l.textView.Write([]byte(l.renderFrom(from)))
+	l.trim(following)
+}
+
+// following returns true if the last line is shown. The mutex must be held.
+func (l *LogView) following() bool {
+	row, _ := l.textView.GetScrollOffset()
+	_, _, _, height := l.textView.GetInnerRect()
+	return row+height >= l.shown
+}
+
+// trim drops the oldest records and their lines once the records take a quarter more than the window.
+// If the view doesn't follow the new lines, the lines shown stay at the same place. The mutex must be held.
+func (l *LogView) trim(following bool) {
+	if following {
+		l.backfilled = 0
+	}
+	limit := l.window + l.backfilled
+	if l.window <= 0 || l.size <= limit+limit/4 {
+		return
+	}
+
+	n := 0
+	for ; n < len(l.records)-1 && l.size > limit; n++ {
+		l.size -= len(l.records[n].Line)
+		l.levelCounts[l.records[n].Level]--
+	}
+	// the dropped lines are released
+	l.records = append([]log.Record(nil), l.records[n:]...)
+	l.oldestShown = false
+
+	row, column := l.textView.GetScrollOffset()
+	shown, matchCount := l.shown, l.matchCount
+	l.rerender()
+	if following {
+		l.textView.ScrollToEnd()
+	} else {
+		row -= shown - l.shown
+		if row < 0 {
+			row = 0
+		}
+		l.textView.ScrollTo(row, column)
+	}
+
+	// the same match stays selected if it has not been dropped
+	if l.currentMatch >= 0 {
+		l.currentMatch -= matchCount - l.matchCount
+		l.showMatch(false)
+	}
+}
+
+// recordsSize returns the number of bytes of the lines of records.
+func recordsSize(records []log.Record) int {
+	n := 0
+	for _, r := range records {
+		n += len(r.Line)
+	}
+	return n
+}
+
+// FirstOffset returns the offset of the oldest line of the view. It returns false if the view has no line.
+func (l *LogView) FirstOffset() (int64, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.records) == 0 {
+		return 0, false
+	}
+	return l.records[0].Offset, true
+}
+
+// render returns the lines of records escaped from the color tags. The tags of the sources are colored,
+// the lines are colored by level and the matches of the search are highlighted. The mutex must be held.
+func (l *LogView) render(records []log.Record) string {
+	var b strings.Builder
+	for _, r := range records {
+		if r.Tag > 0 {
+			fmt.Fprintf(&b, "[%s]%s[-]", sourceColor(r.Source.Name), tview.Escape(string(r.Line[:r.Tag])))
+		}
+
+		// the tags must not span two lines
+		text := r.Line[r.Tag:]
+		newline := bytes.HasSuffix(text, []byte("\n"))
+		text = bytes.TrimSuffix(text, []byte("\n"))
+
+		style := levelStyles[r.Level]
+		b.WriteString(style.open())
+		l.highlight(&b, text, style.restore())
+		b.WriteString(style.close())
+
+		if newline {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// sourceColors are the colors of the tags of the merged services.
+var sourceColors = []string{"aqua", "fuchsia", "lime", "orange", "skyblue", "violet", "gold", "tomato"}
+
+// sourceColor returns the color of the tag of the service name. A service has always the same color.
+func sourceColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return sourceColors[h.Sum32()%uint32(len(sourceColors))]
+}
+
+// ScrollsPastTop returns true if key scrolls up while the first line is shown.
+func (l *LogView) ScrollsPastTop(key *tcell.EventKey) bool {
+	if l.showMenu {
+		return false
+	}
+	if row, _ := l.textView.GetScrollOffset(); row > 0 {
+		return false
+	}
+
+	switch key.Key() {
+	case tcell.KeyUp, tcell.KeyPgUp, tcell.KeyCtrlB, tcell.KeyHome:
+		return true
+	case tcell.KeyRune:
+		return key.Rune() == 'k' || key.Rune() == 'g'
+	}
+	return false
+}
+
+// StartBackfill returns true if older lines can be asked. No other lines are asked until EndBackfill is called.
+func (l *LogView) StartBackfill() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.backfilling || l.oldestShown {
+		return false
+	}
+	l.backfilling = true
+	return true
+}
+
+// EndBackfill shows the older lines before the lines already shown. The lines shown stay at the same place.
+// If oldest is true, no older lines are asked anymore.
+func (l *LogView) EndBackfill(records []log.Record, oldest bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// another logger has been selected meanwhile
+	if !l.backfilling {
+		return
+	}
+	l.backfilling = false
+	l.oldestShown = oldest
+	if len(records) == 0 {
+		return
+	}
+
+	// the oldest lines have been dropped meanwhile: the older lines are asked again from the first line
+	last := records[len(records)-1]
+	if len(l.records) > 0 && last.Offset+int64(len(last.Line)) != l.records[0].Offset {
+		l.oldestShown = false
+		return
+	}
+
+	l.records = append(records, l.records...)
+	l.size += recordsSize(records)
+	l.backfilled += recordsSize(records)
+	l.classify(0, len(records))
+	l.inheritLevel(len(records))
+	row, column := l.textView.GetScrollOffset()
+	shown, matchCount := l.shown, l.matchCount
+	l.rerender()
+	l.textView.ScrollTo(row+l.shown-shown, column)
+
+	// the same match stays selected
+	if l.currentMatch >= 0 {
+		l.currentMatch += l.matchCount - matchCount
+		l.showMatch(false)
+	}
 }
 
 // SetState shows the state of the logger.
 func (l *LogView) SetState(state string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.state = state
 	l.err = err
 }
 
+// SetPollInterval shows the interval between two polls of the file.
+func (l *LogView) SetPollInterval(interval time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pollInterval = interval
+}
+
+// pollRate returns the poll interval to be shown in the status bar.
+func (l *LogView) pollRate() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.pollInterval == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Polling every %s.", l.pollInterval)
+}
+
+// SetConnecting shows the connecting state with the time elapsed since start.
+func (l *LogView) SetConnecting(start time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.connectStart = start
+	l.state = "connecting"
+	l.err = nil
+}
+
+// SetCertificateExpiry sets the end of validity of the certificate used to connect to the host.
+// A warning is shown in the status bar when the certificate is about to expire.
+func (l *LogView) SetCertificateExpiry(expiry time.Time) {
+	l.certExpiry = expiry
+}
+
+// certificateWarning returns a warning if the certificate expires in less than certExpiryWarning.
+func (l *LogView) certificateWarning() string {
+	if l.certExpiry.IsZero() {
+		return ""
+	}
+
+	left := time.Until(l.certExpiry)
+	switch {
+	case left <= 0:
+		return "Certificate expired."
+	case left < certExpiryWarning:
+		return fmt.Sprintf("Certificate expires in %s.", left.Round(time.Second))
+	default:
+		return ""
+	}
+}
+
+// setWindow sets the number of bytes of lines kept by the view to the size of the cache of the logger.
+func (l *LogView) setWindow(logger conf.LoggerConfiguration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.window = int(logger.CacheSize)
+	if l.window == 0 {
+		l.window = log.MaxCacheSize
+	}
+}
+
 func (l *LogView) handleMenuSelectItem(logID int) {
 	l.HideMenu()
+	l.SetCertificateExpiry(time.Time{})
+	l.SetPollInterval(0)
 	logger := l.conf[logID]
-	l.SetTitle(logger.Host.Address, path.Base(logger.File))
+	l.setWindow(logger)
+	if logger.IsMerged() {
+		l.SetMergedTitle(logger.Merge)
+	} else {
+		l.SetTitle(logger.Host.Address, path.Base(logger.File), !logger.Filter.IsEmpty())
+	}
 	l.Clear()
 	l.selectLoggerHandler(logID, l)
 }
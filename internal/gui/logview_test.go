@@ -0,0 +1,63 @@
+package gui
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/tview"
+)
+
+// testRecords returns n records of 10 bytes of level from offset.
+func testRecords(level log.Level, offset int64, n int) []log.Record {
+	records := make([]log.Record, n)
+	for i := range records {
+		records[i] = log.Record{
+			Offset: offset + int64(10*i),
+			Level:  level,
+			Line:   []byte(fmt.Sprintf("%-6s %02d\n", level, i)),
+		}
+	}
+	return records
+}
+
+// checkLevelCounts fails if the level counters of l don't match its records.
+func checkLevelCounts(t *testing.T, l *LogView, step string) {
+	var expected [log.LevelFatal + 1]int
+	for _, r := range l.records {
+		expected[r.Level]++
+	}
+	if l.levelCounts != expected {
+		t.Errorf("%s: Expected: %v. Actual: %v", step, expected, l.levelCounts)
+	}
+}
+
+func TestLogViewBackfillLevelCounts(t *testing.T) {
+	l := NewLogView(tview.NewApplication(), map[int]conf.LoggerConfiguration{}, func(int, *LogView) {}, func(int) (string, bool) { return "", false })
+	l.window = 100
+	// the view follows the new lines
+	l.textView.SetRect(0, 0, 80, 1000)
+
+	l.WriteRecords(testRecords(log.LevelError, 50, 5))
+	l.StartBackfill()
+	l.EndBackfill(testRecords(log.LevelInfo, 0, 5), false)
+	checkLevelCounts(t, l, "backfill")
+
+	// the new lines drop the backfilled lines and the oldest new lines
+	l.WriteRecords(testRecords(log.LevelError, 100, 10))
+	if first := l.records[0].Offset; first != 100 {
+		t.Fatalf("Expected: first line at 100. Actual: %d", first)
+	}
+	checkLevelCounts(t, l, "trim")
+
+	// the dropped lines are backfilled again
+	l.StartBackfill()
+	l.EndBackfill(testRecords(log.LevelError, 50, 5), false)
+	l.StartBackfill()
+	l.EndBackfill(testRecords(log.LevelInfo, 0, 5), false)
+	checkLevelCounts(t, l, "second backfill")
+	if l.levelCounts[log.LevelInfo] != 5 || l.levelCounts[log.LevelError] != 15 {
+		t.Errorf("Expected: 5 info and 15 error lines. Actual: %v", l.levelCounts)
+	}
+}
@@ -3,78 +3,281 @@ package gui
 import (
 	"fmt"
 	"path"
+	"sort"
+	"strings"
+	"unicode"
 
 	"github.com/gdamore/tcell"
 	"github.com/tupyy/tview"
 	"github.com/tupyy/lazylogger/internal/conf"
 )
 
-// Menu displays a list with all the loggers available?
+// grouping is how the services are grouped in the menu.
+type grouping int
+
+const (
+	groupByGroup grouping = iota
+	groupByTag
+	groupByHost
+)
+
+var groupingNames = []string{"group", "tag", "host"}
+
+// Menu displays the loggers available in a tree grouped by group, tag or host.
+// The tree can be filtered with a fuzzy search on the name, the host and the file of the services.
 type Menu struct {
 	*tview.Box
 
-	// list primitive
-	list *tview.List
+	app *tview.Application
+
+	// tree of the services
+	tree *tview.TreeView
+
+	// search box filtering the tree
+	search *tview.InputField
+
+	conf map[int]conf.LoggerConfiguration
 
 	// Handler to be called when a new item is selected.
 	handler func(logID int)
+
+	// returns the state of the logger if it is running
+	health func(logID int) (string, bool)
+
+	grouping grouping
+
+	// groups collapsed by the user
+	collapsed map[string]bool
 }
 
 // NewMenu returns a new menu
-func NewMenu(conf map[int]conf.LoggerConfiguration, handler func(int)) *Menu {
-	l := tview.NewList()
-
-	for k := 0; k < len(conf); k++ {
-		v := conf[k]
-		l.AddItem(fmt.Sprintf("%d - %s", k, v.Name), fmt.Sprintf("%s@%s: %s", v.Host.Username, v.Host.Address, path.Base(v.File)), rune('a'+k), nil)
+func NewMenu(app *tview.Application, conf map[int]conf.LoggerConfiguration, handler func(int), health func(int) (string, bool)) *Menu {
+	m := Menu{
+		Box:       tview.NewBox().SetBackgroundColor(tcell.ColorBlack),
+		app:       app,
+		tree:      tview.NewTreeView().SetTopLevel(1).SetGraphicsColor(tcell.ColorGray),
+		search:    tview.NewInputField().SetLabel("/ ").SetPlaceholder("search name, host or file"),
+		conf:      conf,
+		handler:   handler,
+		health:    health,
+		collapsed: make(map[string]bool),
 	}
 
-	m := Menu{
-		Box:     tview.NewBox().SetBackgroundColor(tcell.ColorBlack),
-		list:    l,
-		handler: handler,
+	// group by host if no service has a group
+	m.grouping = groupByHost
+	for _, c := range conf {
+		if len(c.Group) > 0 {
+			m.grouping = groupByGroup
+			break
+		}
 	}
-	m.list.SetSelectedFunc(m.setSelectedItem)
+
+	m.tree.SetSelectedFunc(m.setSelectedNode)
+	m.tree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() != tcell.KeyRune {
+			return event
+		}
+		switch event.Rune() {
+		case '/':
+			m.app.SetFocus(m.search)
+			return nil
+		case 't':
+			m.grouping = (m.grouping + 1) % grouping(len(groupingNames))
+			m.rebuild()
+			return nil
+		}
+		return event
+	})
+
+	m.search.SetFieldBackgroundColor(tcell.ColorBlack).SetPlaceholderTextColor(tcell.ColorGray)
+	m.search.SetChangedFunc(func(text string) {
+		m.rebuild()
+	})
+	m.search.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			m.search.SetText("")
+		}
+		m.app.SetFocus(m.tree)
+	})
+
+	m.rebuild()
 	return &m
 }
 
+// rebuild fills the tree with the services matching the search. The first service is selected.
+func (menu *Menu) rebuild() {
+	pattern := menu.search.GetText()
+
+	groups := make(map[string][]int)
+	for id, c := range menu.conf {
+		if !fuzzyMatch(pattern, c.Name+" "+c.Host.Address+" "+c.File) {
+			continue
+		}
+		for _, key := range menu.groupKeys(c) {
+			groups[key] = append(groups[key], id)
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	// the services without group come last
+	sort.Slice(names, func(i, j int) bool {
+		if strings.HasPrefix(names[i], "(") != strings.HasPrefix(names[j], "(") {
+			return !strings.HasPrefix(names[i], "(")
+		}
+		return names[i] < names[j]
+	})
+
+	root := tview.NewTreeNode("")
+	var first *tview.TreeNode
+	for _, name := range names {
+		ids := groups[name]
+		sort.Ints(ids)
+
+		group := tview.NewTreeNode(fmt.Sprintf("%s (%d)", tview.Escape(name), len(ids))).
+			SetReference(name).
+			SetColor(tcell.ColorYellow).
+			// the groups are expanded while searching
+			SetExpanded(len(pattern) > 0 || !menu.collapsed[name])
+		for _, id := range ids {
+			node := tview.NewTreeNode(menu.nodeText(id)).SetReference(id)
+			group.AddChild(node)
+			if first == nil {
+				first = node
+			}
+		}
+		root.AddChild(group)
+	}
+
+	menu.tree.SetRoot(root)
+	if first != nil {
+		menu.tree.SetCurrentNode(first)
+	}
+}
+
+// groupKeys returns the groups of the service c. A service has several groups if it has several tags.
+func (menu *Menu) groupKeys(c conf.LoggerConfiguration) []string {
+	switch menu.grouping {
+	case groupByGroup:
+		if len(c.Group) > 0 {
+			return []string{c.Group}
+		}
+		return []string{"(no group)"}
+	case groupByTag:
+		if len(c.Tags) > 0 {
+			return c.Tags
+		}
+		return []string{"(no tag)"}
+	default:
+		if c.IsMerged() {
+			return []string{"(merged)"}
+		}
+		return []string{c.Host.Address}
+	}
+}
+
+// nodeText returns the text of the service id with its health indicator.
+func (menu *Menu) nodeText(id int) string {
+	c := menu.conf[id]
+	secondary := fmt.Sprintf("%s@%s: %s", c.Host.Username, c.Host.Address, path.Base(c.File))
+	if c.IsMerged() {
+		secondary = "merged: " + strings.Join(c.Merge, ", ")
+	}
+	// the names are not color tags
+	return fmt.Sprintf("%s %d - %s  %s", menu.healthIndicator(id), id, tview.Escape(c.Name), tview.Escape(secondary))
+}
+
+// healthIndicator returns a dot colored by the state of the logger. The dot is empty if the logger is not running.
+func (menu *Menu) healthIndicator(id int) string {
+	state, ok := menu.health(id)
+	if !ok {
+		return "○"
+	}
+	switch state {
+	case "healthy":
+		return "[green]●[-]"
+	case "degraded":
+		return "[yellow]●[-]"
+	case "failed":
+		return "[red]●[-]"
+	default:
+		return "[gray]●[-]"
+	}
+}
+
+// fuzzyMatch returns true if the characters of pattern appear in text in the same order. The case is ignored.
+func fuzzyMatch(pattern, text string) bool {
+	text = strings.ToLower(text)
+	for _, r := range strings.ToLower(pattern) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		i := strings.IndexRune(text, r)
+		if i < 0 {
+			return false
+		}
+		text = text[i+len(string(r)):]
+	}
+	return true
+}
+
 // Draw to screen
 func (menu *Menu) Draw(screen tcell.Screen) {
 	menu.Box.Draw(screen)
 	x, y, width, height := menu.GetInnerRect()
 
-	if menu.list.GetItemCount() == 0 {
+	if len(menu.conf) == 0 {
 		tview.Print(screen, "[red::b]No logger found.", x, y, 60, tview.AlignCenter, tcell.ColorYellow)
 		tview.Print(screen, "[red::b]Please add loggers into configuration file and restart.", x, y+2, 60, tview.AlignLeft, tcell.ColorYellow)
 		return
 	}
 
-	listHeight := 2 * menu.list.GetItemCount()
-	if height-2 < 2*menu.list.GetItemCount() {
-		menu.list.ShowSecondaryText(false)
-		listHeight = menu.list.GetItemCount()
+	if menu.HasFocus() {
+		tview.Print(screen, "[:b]Please select a logger:", x, y, width, tview.AlignLeft, tcell.ColorYellow)
+	} else {
+		tview.Print(screen, "Please select a logger:", x, y, width, tview.AlignLeft, tcell.ColorGreen)
+		menu.Box.SetBorder(false)
 	}
+	hint := fmt.Sprintf("by %s (t)", groupingNames[menu.grouping])
+	tview.Print(screen, hint, x, y, width, tview.AlignRight, tcell.ColorGray)
 
-	menu.list.SetRect(x, y+2, width, listHeight)
+	menu.search.SetRect(x, y+1, width, 1)
+	menu.search.Draw(screen)
 
-	if menu.list.HasFocus() {
-		tview.Print(screen, "[:b]Please select a logger:", x, y, 50, tview.AlignLeft, tcell.ColorYellow)
-	} else {
-		tview.Print(screen, "Please select a logger:", x, y, 50, tview.AlignLeft, tcell.ColorGreen)
-		menu.Box.SetBorder(false)
+	// refresh the health of the services
+	menu.tree.GetRoot().Walk(func(node, parent *tview.TreeNode) bool {
+		if id, ok := node.GetReference().(int); ok {
+			node.SetText(menu.nodeText(id))
+		}
+		return true
+	})
+
+	if menu.tree.GetRoot().GetChildren() == nil {
+		tview.Print(screen, "No service found.", x, y+3, width, tview.AlignLeft, tcell.ColorGray)
+		return
 	}
-	menu.list.Draw(screen)
+	menu.tree.SetRect(x, y+3, width, height-3)
+	menu.tree.Draw(screen)
 }
 
-// Focus delegate the focus to the list
+// Focus delegate the focus to the tree
 func (menu *Menu) Focus(delegate func(p tview.Primitive)) {
-	delegate(menu.list)
+	delegate(menu.tree)
 }
 
 func (menu *Menu) HasFocus() bool {
-	return menu.list.HasFocus()
+	return menu.tree.HasFocus() || menu.search.HasFocus()
 }
 
-func (menu *Menu) setSelectedItem(item int, main, secondary string, key rune) {
-	menu.handler(item)
+// setSelectedNode calls the handler for a service and collapses or expands a group.
+func (menu *Menu) setSelectedNode(node *tview.TreeNode) {
+	switch ref := node.GetReference().(type) {
+	case int:
+		menu.handler(ref)
+	case string:
+		node.SetExpanded(!node.IsExpanded())
+		menu.collapsed[ref] = !node.IsExpanded()
+	}
 }
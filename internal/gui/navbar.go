@@ -38,4 +38,6 @@ func (navBar *NavBar) createPages(names []string) {
 	}
 
 	fmt.Fprintf(navBar, `Ctrl-H ["%s"][darkcyan]%s[white][""]  `, "help", "Help")
+	fmt.Fprintf(navBar, `Ctrl-T ["%s"][darkcyan]%s[white][""]  `, "stats", "Stats")
+	fmt.Fprintf(navBar, `Ctrl-O ["%s"][darkcyan]%s[white][""]  `, "hosts", "Hosts")
 }
@@ -0,0 +1,115 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell"
+	"github.com/tupyy/tview"
+)
+
+// highlight writes the line text escaped from the color tags. Each match of the search is colored and put in a region
+// named after its index so it can be selected. restore is the color tag written after a match. The mutex must be held.
+func (l *LogView) highlight(b *strings.Builder, text []byte, restore string) {
+	if l.search == nil {
+		b.WriteString(tview.Escape(string(text)))
+		return
+	}
+
+	last := 0
+	for _, m := range l.search.FindAllIndex(text, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		b.WriteString(tview.Escape(string(text[last:m[0]])))
+		fmt.Fprintf(b, `["%s"][black:yellow]%s%s[""]`, matchRegion(l.matchCount), tview.Escape(string(text[m[0]:m[1]])), restore)
+		l.matchCount++
+		last = m[1]
+	}
+	b.WriteString(tview.Escape(string(text[last:])))
+}
+
+// matchRegion returns the id of the region of the match i.
+func matchRegion(i int) string {
+	return fmt.Sprintf("m%d", i)
+}
+
+// showMatch highlights the current match. The view scrolls to the match if scroll is true. The mutex must be held.
+func (l *LogView) showMatch(scroll bool) {
+	if l.search == nil || l.currentMatch < 0 || l.currentMatch >= l.matchCount {
+		l.currentMatch = -1
+		l.textView.Highlight()
+		return
+	}
+
+	l.textView.Highlight(matchRegion(l.currentMatch))
+	if scroll {
+		l.textView.ScrollToHighlight()
+	}
+}
+
+// OpenSearchBar shows the search bar. The matches are highlighted as the search is typed and the last match is
+// selected. Enter keeps the search and calls applied, Esc or an empty search removes it.
+func (l *LogView) OpenSearchBar(applied func()) {
+	if l.showMenu {
+		return
+	}
+
+	l.bar = tview.NewInputField().
+		SetLabel("Search: ").
+		SetFieldBackgroundColor(tcell.ColorBlack)
+	l.bar.SetChangedFunc(func(text string) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		l.search = nil
+		if len(text) > 0 {
+			l.search = compilePattern(text)
+		}
+		l.refresh()
+	})
+	l.bar.SetDoneFunc(func(key tcell.Key) {
+		l.mutex.Lock()
+		if key != tcell.KeyEnter && l.search != nil {
+			l.search = nil
+			l.refresh()
+		}
+		searching := l.search != nil
+		l.mutex.Unlock()
+
+		l.bar = nil
+		l.app.SetFocus(l.textView)
+		if searching {
+			applied()
+		}
+	})
+	l.app.SetFocus(l.bar)
+}
+
+// NextMatch selects the match step matches after the current one (before it if step is negative).
+// The first match follows the last one.
+func (l *LogView) NextMatch(step int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.search == nil || l.matchCount == 0 {
+		return
+	}
+	l.currentMatch = ((l.currentMatch+step)%l.matchCount + l.matchCount) % l.matchCount
+	l.showMatch(true)
+}
+
+// searchStatus returns the position of the current match to be shown in the status bar.
+func (l *LogView) searchStatus() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case l.search == nil:
+		return ""
+	case l.matchCount == 0:
+		return "No match."
+	default:
+		return fmt.Sprintf("Match %d of %d.", l.currentMatch+1, l.matchCount)
+	}
+}
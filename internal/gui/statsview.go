@@ -0,0 +1,78 @@
+package gui
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell"
+	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/tview"
+)
+
+// StatsView shows the bytes transferred by the running loggers. It is refreshed each time it is drawn.
+type StatsView struct {
+	*tview.Table
+
+	// returns the stats of the running loggers
+	stats func() []log.LoggerStats
+}
+
+var statsHeaders = []string{"Name", "Host", "File", "Compression", "Read", "Wire", "Delivered", "Saved"}
+
+func NewStatsView(stats func() []log.LoggerStats) *StatsView {
+	table := tview.NewTable().SetFixed(1, 0).SetSelectable(false, false)
+	table.SetBorder(true).SetTitle("Stats")
+
+	return &StatsView{Table: table, stats: stats}
+}
+
+// Draw refreshes the table and draws it.
+func (s *StatsView) Draw(screen tcell.Screen) {
+	s.Clear()
+
+	for col, header := range statsHeaders {
+		s.SetCell(0, col, tview.NewTableCell(header).SetTextColor(tcell.ColorYellow).SetSelectable(false).SetExpansion(1))
+	}
+
+	for i, stats := range s.stats() {
+		compression := "off"
+		if stats.Compressed {
+			compression = "gzip"
+		}
+
+		row := []string{
+			stats.Name,
+			stats.Host,
+			stats.File,
+			compression,
+			formatBytes(stats.FileBytes),
+			formatBytes(stats.WireBytes),
+			formatBytes(stats.DeliveredBytes),
+			savedRatio(stats.Stats),
+		}
+		for col, text := range row {
+			s.SetCell(i+1, col, tview.NewTableCell(text).SetExpansion(1))
+		}
+	}
+
+	s.Table.Draw(screen)
+}
+
+// formatBytes returns n in B, KiB or MiB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// savedRatio returns the part of the data read from the file which has not been sent on the wire.
+func savedRatio(stats log.Stats) string {
+	if stats.FileBytes == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*(1-float64(stats.WireBytes)/float64(stats.FileBytes)))
+}
@@ -3,6 +3,8 @@ package gui
 import (
 	"regexp"
 	"strings"
+
+	"github.com/tupyy/tview"
 )
 
 func Decolorise(str string) string {
@@ -31,3 +33,14 @@ func getIndex(arr []*LogMainView, item *LogMainView) int {
 
 	return -1
 }
+
+// center returns a flex showing p at the center of the screen with the given size.
+func center(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
@@ -1,10 +1,16 @@
 package log
 
+import (
+	"context"
+	"sync"
+)
+
 // Docker represents a docker client.
 type Docker interface {
 
 	// ContainerLogs returns the log of the container as []byte, the size of log.
-	ContainerLogs(containerId string) ([]byte, int32, error, error)
+	// It returns as soon as ctx is done.
+	ContainerLogs(ctx context.Context, containerId string) ([]byte, int32, error, error)
 }
 
 // BytesReader provides an implementation of FileReader interface.
@@ -12,9 +18,12 @@ type Docker interface {
 // Due to the fact that we don't know the size of the log before we read it, the behaviour is different then
 // RemoteReader. The data is fetched in the FetchSize method and the size of the log is returned.
 // Also, we have to keep the difference between the last received data and the actual data. This differece will be return when
-// ReadNextChunk is called.
+// ReadNextChunk is called. It is safe for concurrent use.
 type BytesReader struct {
 
+	// protects data, offset and size
+	mutex *sync.Mutex
+
 	// container id
 	id string
 
@@ -33,11 +42,13 @@ type BytesReader struct {
 
 // NewBytesReader creates a new BytesReader.
 func NewBytesReader(id string, client Docker) *BytesReader {
-	return &BytesReader{id, client, []byte(nil), 0, 0}
+	return &BytesReader{&sync.Mutex{}, id, client, []byte(nil), 0, 0}
 }
 
 // GetSize return the number of bytes read.
 func (b *BytesReader) GetSize() int32 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.offset
 }
 
@@ -49,17 +60,24 @@ func (b *BytesReader) SetSize(size int32) {
 
 // HasNextChunk returns true if the size of data is greater than the offset.
 func (b *BytesReader) HasNextChunk() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.offset < b.size
 }
 
 // Rewind set the offset to 0.
 func (b *BytesReader) Rewind() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	b.offset = 0
 }
 
 // ReadNextChunk return the part of data from offset to the end of bytes array.
 // It return always nil errors because the data was already fetched from container.
-func (b *BytesReader) ReadNextChunk() ([]byte, error, error) {
+func (b *BytesReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	if b.size == b.offset {
 		return []byte{}, nil, nil
 	}
@@ -70,14 +88,17 @@ func (b *BytesReader) ReadNextChunk() ([]byte, error, error) {
 
 // FetchSize read the log from the container and save the any data beyond offset to data field.
 // Returns the size of fetched data and container error or connection error.
-func (b *BytesReader) FetchSize() (int32, error, error) {
-	data, n, containerErr, connErr := b.client.ContainerLogs(b.id)
+func (b *BytesReader) FetchSize(ctx context.Context) (int32, error, error) {
+	data, n, containerErr, connErr := b.client.ContainerLogs(ctx, b.id)
 	if containerErr != nil || connErr != nil {
 		return 0, containerErr, connErr
 	}
 
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	if n < b.offset {
-		b.Rewind()
+		b.offset = 0
 	}
 	if n > b.offset {
 		//remove the previous data and keep only the difference between the last received data and the present data.
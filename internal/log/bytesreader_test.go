@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"testing"
@@ -14,7 +15,7 @@ type dockerMock struct {
 	hasError          bool
 }
 
-func (d *dockerMock) ContainerLogs(containerId string) ([]byte, int32, error, error) {
+func (d *dockerMock) ContainerLogs(ctx context.Context, containerId string) ([]byte, int32, error, error) {
 	d.step++
 
 	if d.step > 1 {
@@ -50,7 +51,7 @@ func TestBytesReader(t *testing.T) {
 	var e1, e2 error
 	var data []byte
 	for i := 1; i < 5; i++ {
-		n, e1, e2 = bReader.FetchSize()
+		n, e1, e2 = bReader.FetchSize(context.Background())
 		if n != int32(i*3) {
 			t.Errorf("Expected: 2. Actual: %d", n)
 		}
@@ -61,7 +62,7 @@ func TestBytesReader(t *testing.T) {
 			t.Errorf("Expected: has next chunk. Actual: no next chunk")
 		}
 
-		data, e1, e2 = bReader.ReadNextChunk()
+		data, e1, e2 = bReader.ReadNextChunk(context.Background())
 		// We are expencting chunks of 3 bytes length
 		if len(data) != 3 {
 			t.Errorf("Expected: len(data) == %d. Actual: %d", 3, len(data))
@@ -83,7 +84,7 @@ func TestBytesReader2(t *testing.T) {
 	var n int32
 	var e1, e2 error
 	var data []byte
-	n, e1, e2 = bReader.FetchSize()
+	n, e1, e2 = bReader.FetchSize(context.Background())
 	if n != 3 {
 		t.Errorf("Expected: 2. Actual: %d", n)
 	}
@@ -94,13 +95,13 @@ func TestBytesReader2(t *testing.T) {
 		t.Errorf("Expected: has next chunk. Actual: no next chunk")
 	}
 
-	data, e1, e2 = bReader.ReadNextChunk()
+	data, e1, e2 = bReader.ReadNextChunk(context.Background())
 	// We are expencting chunks of 3 bytes length
 	if len(data) != 3 {
 		t.Errorf("Expected: len(data) == %d. Actual: %d", 3, len(data))
 	}
 
-	_, e1, e2 = bReader.FetchSize()
+	_, e1, e2 = bReader.FetchSize(context.Background())
 	if e1 == nil {
 		t.Errorf("Expected error. Got nil")
 	}
@@ -123,7 +124,7 @@ func TestBytesReader3(t *testing.T) {
 	var n int32
 	var e1, e2 error
 	var data []byte
-	n, e1, e2 = bReader.FetchSize()
+	n, e1, e2 = bReader.FetchSize(context.Background())
 	if n != 3 {
 		t.Errorf("Expected: 2. Actual: %d", n)
 	}
@@ -134,13 +135,13 @@ func TestBytesReader3(t *testing.T) {
 		t.Errorf("Expected: has next chunk. Actual: no next chunk")
 	}
 
-	data, e1, e2 = bReader.ReadNextChunk()
+	data, e1, e2 = bReader.ReadNextChunk(context.Background())
 	// We are expencting chunks of 3 bytes length
 	if len(data) != 3 {
 		t.Errorf("Expected: len(data) == %d. Actual: %d", 3, len(data))
 	}
 
-	_, e1, e2 = bReader.FetchSize()
+	_, e1, e2 = bReader.FetchSize(context.Background())
 	if e1 != nil {
 		t.Errorf("Expected nil. Got error:%s", e1)
 	}
@@ -1,36 +1,143 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
 )
 
 const (
 
-	// MaxCacheSize how much data we keep from a logger. Set to 300kb
+	// MaxCacheSize how much data we keep from a logger if its configuration doesn't set the size. Set to 300kb
 	MaxCacheSize = 3 * 1024 * 100
+
+	// minCacheAllocation is the size of the first allocation of a cache.
+	minCacheAllocation = 4 * 1024
 )
 
-// Cache holds the data from a fetcher.
+// Cache holds the data from a fetcher in a ring buffer.
+// The buffer is allocated on the first write and doubles until it reaches the capacity of the cache.
+// Once full, the oldest lines are overwritten without allocating or moving the data.
+// If a spill store is set, the data removed from the buffer is moved to the store.
 type cache struct {
 	mutex *sync.Mutex
-	data  []byte
+
+	// maximum number of bytes kept
+	capacity int
+
+	// ring buffer. The data starts at start and wraps around the end of buf.
+	buf   []byte
+	start int
 	size  int64
+
+	// time of the last write
+	lastWrite time.Time
+
+	// number of bytes removed from the buffer: offset of the first byte of buf since the first write
+	offset int64
+
+	// receives the data removed from the buffer. Nil if the data is dropped.
+	spill *segmentStore
 }
 
-func newCache() *cache {
+func newCache(capacity int) *cache {
+	if capacity <= 0 {
+		capacity = MaxCacheSize
+	}
+
 	c := &cache{
-		mutex: &sync.Mutex{},
-		data:  []byte{},
-		size:  0,
+		mutex:    &sync.Mutex{},
+		capacity: capacity,
 	}
 
 	return c
 }
 
 func (c *cache) clear() {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
 	c.size = 0
-	c.data = []byte{}
+	c.start = 0
+	c.buf = nil
+	c.offset = 0
+
+	if c.spill != nil {
+		if err := c.spill.Close(); err != nil {
+			glog.Warningf("cannot remove spill directory: %s", err)
+		}
+		c.spill = nil
+	}
+}
+
+// Size returns the number of bytes in cache.
+func (c *cache) Size() int64 {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	return c.size
+}
+
+// Memory returns the number of bytes allocated by the cache.
+func (c *cache) Memory() int64 {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	return int64(len(c.buf))
+}
+
+// LastWrite returns the time of the last write. It is zero if nothing has been written.
+func (c *cache) LastWrite() time.Time {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	return c.lastWrite
+}
+
+// bounds returns the offset of the oldest byte kept (in the spill store or in the buffer),
+// the offset of the first byte of the buffer and the offset after the last byte written.
+func (c *cache) bounds() (first, offset, end int64) {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	first = c.offset
+	if c.spill != nil {
+		first = c.spill.First()
+	}
+	return first, c.offset, c.offset + c.size
+}
+
+// readStream reads the data at offset off counted from the first write. The data removed from the buffer
+// is read from the spill store. It returns the number of bytes read.
+func (c *cache) readStream(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("offset invalid: %d", off)
+	}
+
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	if off < c.offset {
+		if c.spill == nil {
+			return 0, nil
+		}
+
+		// read up to the buffer
+		end := len(p)
+		if int64(end) > c.offset-off {
+			end = int(c.offset - off)
+		}
+		n, err = c.spill.ReadAt(p[:end], off)
+		if err != nil || n < end {
+			return n, err
+		}
+	}
+
+	return n + c.readAt(p[n:], off+int64(n)-c.offset), nil
 }
 
 // Implement the ReadAt interface
@@ -42,38 +149,205 @@ func (c *cache) ReadAt(p []byte, off int64) (n int, err error) {
 	defer c.mutex.Unlock()
 	c.mutex.Lock()
 
-	lp := int64(len(p))
+	return c.readAt(p, off), nil
+}
 
+// readAt reads the buffer at offset off. The mutex must be held.
+func (c *cache) readAt(p []byte, off int64) (n int) {
 	if off >= c.size {
+		return 0
+	}
+
+	for _, s := range c.segments(nil) {
+		if off >= int64(len(s)) {
+			off -= int64(len(s))
+			continue
+		}
+		k := copy(p[n:], s[off:])
+		n += k
+		off = 0
+		if n == len(p) {
+			break
+		}
+	}
+
+	return n
+}
+
+// Write always writes len(p) because is removing data from
+// the beginning of the buffer to make place for the new data.
+// Only whole lines are removed so the cache never starts in the middle of a line.
+func (c *cache) Write(p []byte) (n int, err error) {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	n = len(p)
+	if n == 0 {
 		return 0, nil
 	}
+	c.lastWrite = time.Now()
+
+	needed := int(c.size) + len(p)
+	if needed > len(c.buf) && len(c.buf) < c.capacity {
+		c.resize(allocationSize(len(c.buf), needed, c.capacity))
+	}
 
-	if off+lp > c.size {
-		n = int(c.size - off)
-		copy(p, c.data[off:])
-		return n, nil
+	if needed > c.capacity {
+		var s [3][]byte
+		segments := append(c.segments(s[:0]), p)
+		drop := lineStart(segments, needed-c.capacity)
+		if drop <= int(c.size) {
+			c.discard(drop)
+		} else {
+			dropped := p[:drop-int(c.size)]
+			p = p[len(dropped):]
+			c.discard(int(c.size))
+			c.spillData(dropped)
+			c.offset += int64(len(dropped))
+		}
 	}
 
-	copy(p, c.data[off:off+lp])
+	// copy p after the data, wrapping around the end of the buffer
+	end := (c.start + int(c.size)) % len(c.buf)
+	k := copy(c.buf[end:], p)
+	copy(c.buf, p[k:])
+	c.size += int64(len(p))
 
-	n = int(lp)
 	return n, nil
 }
 
-// Write always writes len(p) because is removing data from
-// the beginning of slice to make place for the new data
-func (c *cache) Write(p []byte) (n int, err error) {
+// shrink frees at least n bytes of memory by removing the oldest lines. The buffer is reallocated to fit the remaining data.
+// The cache grows back on the next writes. It returns the number of bytes freed.
+func (c *cache) shrink(n int64) int64 {
 	defer c.mutex.Unlock()
 	c.mutex.Lock()
 
-	if len(c.data)+len(p) > MaxCacheSize {
-		c.data = append(c.data, p...)
-		bytesToRemove := len(c.data) - MaxCacheSize
-		c.data = c.data[bytesToRemove:]
-	} else {
-		c.data = append(c.data, p...)
+	allocated := int64(len(c.buf))
+	if n <= 0 || allocated == 0 {
+		return 0
+	}
+
+	target := allocated - n
+	if target <= 0 || c.size == 0 {
+		c.discard(int(c.size))
+		c.buf = nil
+		return allocated
+	}
+
+	if c.size > target {
+		c.discard(lineStart(c.segments(nil), int(c.size-target)))
+	}
+	c.resize(int(target))
+
+	return allocated - target
+}
+
+// segments appends the data to dst in two slices: from start to the end of buf, and from the beginning of buf.
+func (c *cache) segments(dst [][]byte) [][]byte {
+	if c.size == 0 {
+		return dst
+	}
+
+	end := c.start + int(c.size)
+	if end <= len(c.buf) {
+		return append(dst, c.buf[c.start:end])
+	}
+	return append(dst, c.buf[c.start:], c.buf[:end-len(c.buf)])
+}
+
+// discard removes the first n bytes. They are moved to the spill store.
+func (c *cache) discard(n int) {
+	if c.spill != nil {
+		rest := n
+		for _, s := range c.segments(nil) {
+			if rest <= len(s) {
+				c.spillData(s[:rest])
+				break
+			}
+			c.spillData(s)
+			rest -= len(s)
+		}
+	}
+
+	c.offset += int64(n)
+	c.size -= int64(n)
+	if c.size == 0 {
+		c.start = 0
+		return
+	}
+	c.start = (c.start + n) % len(c.buf)
+}
+
+// spillData moves p to the spill store if any.
+func (c *cache) spillData(p []byte) {
+	if c.spill != nil && len(p) > 0 {
+		c.spill.Write(p)
+	}
+}
+
+// resize moves the data at the beginning of a new buffer of size bytes. The data must fit in the new buffer.
+func (c *cache) resize(size int) {
+	buf := make([]byte, size)
+	n := 0
+	for _, s := range c.segments(nil) {
+		n += copy(buf[n:], s)
 	}
 
-	c.size = int64(len(c.data))
-	return len(p), nil
+	c.buf = buf
+	c.start = 0
+}
+
+// allocationSize returns the size of the buffer holding needed bytes: the buffer doubles until it reaches capacity.
+func allocationSize(allocated, needed, capacity int) int {
+	size := allocated
+	if size < minCacheAllocation {
+		size = minCacheAllocation
+	}
+	for size < needed {
+		size *= 2
+	}
+	if size > capacity {
+		size = capacity
+	}
+	return size
+}
+
+// lineStart returns the offset of the first line of the data in segments beginning at or after min.
+// If no line begins after min, the data is cut at the first rune starting at or after min.
+func lineStart(segments [][]byte, min int) int {
+	if min == 0 {
+		return 0
+	}
+
+	offset := 0
+	for _, s := range segments {
+		from := min - 1 - offset
+		if from >= len(s) {
+			offset += len(s)
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if i := bytes.IndexByte(s[from:], '\n'); i >= 0 {
+			return offset + from + i + 1
+		}
+		offset += len(s)
+	}
+
+	// a line longer than the cache
+	offset = 0
+	for _, s := range segments {
+		i := min - offset
+		if i < 0 {
+			i = 0
+		}
+		for ; i < len(s); i++ {
+			if utf8.RuneStart(s[i]) {
+				return offset + i
+			}
+		}
+		offset += len(s)
+	}
+	return offset
 }
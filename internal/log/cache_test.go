@@ -1,9 +1,14 @@
 package log
 
-import "testing"
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
 
 func TestRead(t *testing.T) {
-	c := newCache()
+	c := newCache(0)
 
 	data := []byte{'l', 'o', 'g', 'g', 'e', 'r'}
 	n, err := c.Write(data)
@@ -24,7 +29,7 @@ func TestRead(t *testing.T) {
 }
 
 func TestReadOffset(t *testing.T) {
-	c := newCache()
+	c := newCache(0)
 
 	data := []byte{'l', 'o', 'g', 'g', 'e', 'r'}
 	n, err := c.Write(data)
@@ -44,7 +49,7 @@ func TestReadOffset(t *testing.T) {
 }
 
 func TestWrite(t *testing.T) {
-	c := newCache()
+	c := newCache(0)
 
 	data := make([]byte, MaxCacheSize)
 	for i, _ := range data {
@@ -79,3 +84,147 @@ func TestWrite(t *testing.T) {
 	}
 
 }
+
+func TestWriteEvictsWholeLines(t *testing.T) {
+	c := newCache(0)
+
+	line := []byte("0123456789\n")
+	for i := 0; i < MaxCacheSize/len(line); i++ {
+		c.Write(line)
+	}
+
+	// the first line is partially out of the cache: it is removed completely
+	c.Write([]byte("last\n"))
+
+	first := make([]byte, len(line))
+	c.ReadAt(first, 0)
+	if string(first) != string(line) {
+		t.Errorf("Expected: cache starts with %q. Actual: %q", line, first)
+	}
+	if c.Size() > MaxCacheSize || c.Size()%int64(len(line)) != int64(len("last\n")) {
+		t.Errorf("Expected: whole lines in cache. Actual size: %d", c.Size())
+	}
+}
+
+func TestLineStart(t *testing.T) {
+	segments := [][]byte{[]byte("ab\nc"), []byte("d\nef")}
+	if off := lineStart(segments, 3); off != 3 {
+		t.Errorf("Expected: 3. Actual: %d", off)
+	}
+	if off := lineStart(segments, 1); off != 3 {
+		t.Errorf("Expected: 3. Actual: %d", off)
+	}
+
+	// the newline is in the second segment
+	if off := lineStart(segments, 4); off != 6 {
+		t.Errorf("Expected: 6. Actual: %d", off)
+	}
+	if off := lineStart(segments, 7); off != 7 {
+		t.Errorf("Expected: 7. Actual: %d", off)
+	}
+
+	// a line longer than the cache is cut on a rune
+	segments = [][]byte{[]byte("a\xc3"), []byte("\xa9b")}
+	if off := lineStart(segments, 2); off != 3 {
+		t.Errorf("Expected: 3. Actual: %d", off)
+	}
+}
+
+func TestWriteWrapsAround(t *testing.T) {
+	c := newCache(16)
+
+	c.Write([]byte("line1\nline2\n"))
+	c.Write([]byte("line3\n"))
+
+	// line1 is evicted, line3 wraps around the end of the buffer
+	data := make([]byte, c.Size())
+	n, _ := c.ReadAt(data, 0)
+	if string(data[:n]) != "line2\nline3\n" {
+		t.Errorf("Expected: %q. Actual: %q", "line2\nline3\n", data[:n])
+	}
+	if c.start == 0 {
+		t.Error("Expected: data wrapped around. Actual: data at the beginning of the buffer")
+	}
+
+	// read across the end of the buffer
+	data = make([]byte, 4)
+	n, _ = c.ReadAt(data, 4)
+	if string(data[:n]) != "2\nli" {
+		t.Errorf("Expected: %q. Actual: %q", "2\nli", data[:n])
+	}
+
+	// a write bigger than the cache keeps its last lines
+	c.Write([]byte("a very long line\nend\n"))
+	data = make([]byte, c.Size())
+	n, _ = c.ReadAt(data, 0)
+	if string(data[:n]) != "end\n" {
+		t.Errorf("Expected: %q. Actual: %q", "end\n", data[:n])
+	}
+}
+
+func TestCacheGrowAndShrink(t *testing.T) {
+	c := newCache(64 * 1024)
+	if c.Memory() != 0 {
+		t.Errorf("Expected: nothing allocated. Actual: %d", c.Memory())
+	}
+
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	for i := 0; i < 50; i++ {
+		c.Write(line)
+	}
+	if c.Memory() != 8*1024 {
+		t.Errorf("Expected: %d bytes allocated. Actual: %d", 8*1024, c.Memory())
+	}
+
+	// the oldest lines are removed to fit in 2 KB
+	freed := c.shrink(6 * 1024)
+	if freed != 6*1024 || c.Memory() != 2*1024 {
+		t.Errorf("Expected: 6 KB freed. Actual: %d freed, %d allocated", freed, c.Memory())
+	}
+	if c.Size() != 20*100 {
+		t.Errorf("Expected: 20 lines. Actual: %d bytes", c.Size())
+	}
+
+	first := make([]byte, len(line))
+	c.ReadAt(first, 0)
+	if string(first) != string(line) {
+		t.Errorf("Expected: cache starts with a line. Actual: %q", first)
+	}
+
+	if freed := c.shrink(1 << 20); freed != 2*1024 || c.Memory() != 0 || c.Size() != 0 {
+		t.Errorf("Expected: cache released. Actual: %d freed, %d allocated", freed, c.Memory())
+	}
+}
+
+// sliceCache is the cache before the ring buffer: it appends and reslices. It is kept to compare the benchmarks.
+type sliceCache struct {
+	data []byte
+}
+
+func (c *sliceCache) Write(p []byte) (int, error) {
+	c.data = append(c.data, p...)
+	if len(c.data) > MaxCacheSize {
+		c.data = c.data[len(c.data)-MaxCacheSize:]
+	}
+	return len(p), nil
+}
+
+func benchmarkCacheWrite(b *testing.B, w io.Writer, lineSize int) {
+	line := []byte(strings.Repeat("x", lineSize-1) + "\n")
+	b.SetBytes(int64(len(line)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Write(line)
+	}
+}
+
+func BenchmarkCacheWrite(b *testing.B) {
+	for _, size := range []int{100, 4096} {
+		b.Run(fmt.Sprintf("ring/%d", size), func(b *testing.B) {
+			benchmarkCacheWrite(b, newCache(MaxCacheSize), size)
+		})
+		b.Run(fmt.Sprintf("slice/%d", size), func(b *testing.B) {
+			benchmarkCacheWrite(b, &sliceCache{}, size)
+		})
+	}
+}
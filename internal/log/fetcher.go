@@ -1,15 +1,24 @@
 package log
 
 import (
-	"github.com/golang/glog"
+	"context"
 	"sync"
 	"time"
+
+	"github.com/golang/glog"
 )
 
 // DataWriter is an interface that writes data fetched.
 type DataWriter interface {
 	WriteData(data []byte)
 	Error(stderr, err error)
+
+	// SetPollInterval is called when the poll interval changes.
+	SetPollInterval(interval time.Duration)
+
+	// Rewind is called when the file is read again from the beginning (e.g. the file has been truncated or rotated).
+	// The data written next starts at offset zero of the file.
+	Rewind()
 }
 
 // FileReader reads data from file in small chuncks. If the size of the file has increased
@@ -25,7 +34,8 @@ type FileReader interface {
 	SetSize(int32)
 
 	// ReadNextChunk reads chunks until HasNextChunk returns false.
-	ReadNextChunk() ([]byte, error, error)
+	// It returns as soon as ctx is done.
+	ReadNextChunk(ctx context.Context) ([]byte, error, error)
 
 	// HasNextChunk return true if the size fetched is bigger than the current size set by SetSize.
 	HasNextChunk() bool
@@ -35,20 +45,36 @@ type FileReader interface {
 
 	// FetchSize fetch the size of the file. It returns size of the file, stderr if the, for some reason
 	// (e.g file doesn't exists anymore) size cannot be read, err if there are problems with the connection.
-	FetchSize() (int32, error, error)
+	// It returns as soon as ctx is done.
+	FetchSize(ctx context.Context) (int32, error, error)
 
 	// Rewind resets the size to zero. It is called if the fetched size is smaller than the current size.
 	Rewind()
 }
 
+// ChunkReader reads the file at any offset. It is implemented by the FileReaders which can read the data
+// older than the cache again.
+type ChunkReader interface {
+	// ReadChunk reads size bytes at offset. It returns less than size bytes if the file is shorter.
+	ReadChunk(ctx context.Context, offset int64, size int) ([]byte, error)
+}
+
 // Fetcher take care of fetching the size and data from remote host.
 // It uses a non-blocking loop to fetch both size and data.
-// The size of the file is fetched every 1 seconds. If the fetched size is greated than the
+// The size of the file is fetched at the interval given by poll. If the fetched size is greated than the
 // last size return by the LogFile struct then fetchData is running.
 // fetchData will fetch the data between fetchedSize - remotelogger.GetSize().
+// Only complete lines are written: the trailing partial line is held until its end is read or PartialLineTimeout expires.
 type fetcher struct {
 	id int
 
+	// ctx is canceled when the fetcher is closed. It aborts the commands in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// interval between two fetches of the size
+	poll *pollInterval
+
 	// channel to close the fetcher. It returns a channel to wait for the fetcher to close.
 	closing chan chan struct{}
 
@@ -58,6 +84,9 @@ type fetcher struct {
 	// data is sent through this channel
 	data chan []byte
 
+	// trailing partial line of the data fetched. It is only used by the fetch loop.
+	lines lineBuffer
+
 	// stderr
 	stderr error
 
@@ -65,9 +94,13 @@ type fetcher struct {
 	sshConnectionErr error
 }
 
-func newFetcher(id int) *fetcher {
+func newFetcher(id int, poll *pollInterval) *fetcher {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &fetcher{
 		id:      id,
+		ctx:     ctx,
+		cancel:  cancel,
+		poll:    poll,
 		closing: make(chan chan struct{}),
 		errorCh: make(chan struct{}),
 		data:    make(chan []byte),
@@ -89,30 +122,35 @@ type fetchedDataResult struct {
 	sshConnectionErr error
 }
 
-// Asks the fetchData loop to exits and waits for a response
+// Aborts the commands in flight, asks the fetchData loop to exits and waits for a response
 func (f *fetcher) close() {
 	glog.Infof("Close the fetcher: %d", f.id)
+	f.cancel()
+
 	doneCh := make(chan struct{}, 1)
 	f.closing <- doneCh
+	<-doneCh
 }
 
 // fetch the data from the log
 func (f *fetcher) fetch(fr FileReader, dataWriter DataWriter) {
 	var fetchSizeDone chan fetchedSizeResult // if non-nil fetchSize is running
 	var fetchDataDone chan fetchedDataResult // if non-nil fetchData is running
-	var startFetchSize <-chan time.Time
+	var startFetchSize <-chan time.Time      // if non-nil the next poll is armed
+	var flushPartialLine <-chan time.Time    // if non-nil a partial line is held
 	var wg sync.WaitGroup
 
 	for {
-		if fetchSizeDone == nil {
-			startFetchSize = time.After(1 * time.Second)
+		// the next poll starts once the size and the data have been fetched: two reads must never run together.
+		if fetchSizeDone == nil && fetchDataDone == nil && startFetchSize == nil {
+			startFetchSize = time.After(f.poll.current())
 		}
 
 		select {
 		case doneCh := <-f.closing:
 			glog.V(3).Infof("Fetcher %d closed.", f.id)
 
-			// wait for fetch size or fetch data go routine to exit
+			// wait for fetch size or fetch data go routine to exit. They return as soon as ctx is canceled.
 			wg.Wait()
 
 			doneCh <- struct{}{}
@@ -120,12 +158,13 @@ func (f *fetcher) fetch(fr FileReader, dataWriter DataWriter) {
 
 		case <-startFetchSize:
 			glog.V(3).Infof("Fetcher: %d. Fetching size.", f.id)
+			startFetchSize = nil
 			fetchSizeDone = make(chan fetchedSizeResult, 1)
 
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				size, stderr, err := fr.FetchSize()
+				size, stderr, err := fr.FetchSize(f.ctx)
 				fetchSizeDone <- fetchedSizeResult{size, stderr, err}
 			}()
 
@@ -139,13 +178,23 @@ func (f *fetcher) fetch(fr FileReader, dataWriter DataWriter) {
 				// clean up any previous errors
 				dataWriter.Error(nil, nil)
 
+				if interval, changed := f.poll.update(fetchedSize.size != fr.GetSize()); changed {
+					glog.V(3).Infof("Fetcher %d. Poll interval set to %s", f.id, interval)
+					dataWriter.SetPollInterval(interval)
+				}
+
 				if fetchedSize.size != fr.GetSize() {
 					if fetchedSize.size < fr.GetSize() {
 						// something happen to the file. instead of append
 						// the file either has been rewrited or some parts have been deleted.
 						// In this case, just rewind the file and start all over
 						glog.V(2).Infof("Fetched size smaller than actual size.Rewind the file")
+						if data := f.lines.drain(); len(data) > 0 {
+							dataWriter.WriteData(data)
+						}
+						flushPartialLine = nil
 						fr.Rewind()
+						dataWriter.Rewind()
 					}
 					glog.V(3).Infof("Fetcher %d. Fetching new data of %d bytes.", f.id, fetchedSize.size-fr.GetSize())
 					fr.SetSize(fetchedSize.size)
@@ -165,9 +214,24 @@ func (f *fetcher) fetch(fr FileReader, dataWriter DataWriter) {
 			if fetchedData.sshConnectionErr != nil || fetchedData.stderr != nil {
 				dataWriter.Error(fetchedData.stderr, fetchedData.sshConnectionErr)
 			} else {
-				dataWriter.WriteData(fetchedData.stdout)
+				if lines := f.lines.write(fetchedData.stdout); len(lines) > 0 {
+					dataWriter.WriteData(lines)
+				}
+
+				// the timeout starts when the line starts to be held
+				if !f.lines.pending() {
+					flushPartialLine = nil
+				} else if flushPartialLine == nil {
+					flushPartialLine = time.After(PartialLineTimeout)
+				}
+			}
+			fetchDataDone = nil
+		case <-flushPartialLine:
+			glog.V(3).Infof("Fetcher %d. End of line not received. Flushing the partial line.", f.id)
+			flushPartialLine = nil
+			if data := f.lines.flush(); len(data) > 0 {
+				dataWriter.WriteData(data)
 			}
-			fetchSizeDone = nil
 		}
 	}
 }
@@ -179,7 +243,7 @@ func (f *fetcher) fetchData(fr FileReader) ([]byte, error, error) {
 		if ok := fr.HasNextChunk(); ok {
 			glog.V(4).Infof("Fetcher %d. Reading next chunk..", f.id)
 
-			stdout, stderr, err := fr.ReadNextChunk()
+			stdout, stderr, err := fr.ReadNextChunk(f.ctx)
 			glog.V(4).Infof("Data read %s", string(stdout))
 
 			if stderr != nil || err != nil {
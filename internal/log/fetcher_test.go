@@ -1,9 +1,13 @@
 package log
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
 )
 
 // Mock file reader
@@ -24,7 +28,7 @@ type MockFileReader struct {
 	maxChunkSize int
 }
 
-func (m *MockFileReader) FetchSize() (int32, error, error) {
+func (m *MockFileReader) FetchSize(ctx context.Context) (int32, error, error) {
 	if m.isSizeInvalid {
 		return 0, errors.New("size error"), nil
 	}
@@ -66,7 +70,7 @@ func (m *MockFileReader) HasNextChunk() bool {
 	return m.byteRead < m.size
 }
 
-func (m *MockFileReader) ReadNextChunk() ([]byte, error, error) {
+func (m *MockFileReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
 	if m.isSizeInvalid {
 		return []byte{}, errors.New("size error"), nil
 	}
@@ -81,19 +85,28 @@ func (m *MockFileReader) ReadNextChunk() ([]byte, error, error) {
 	for i, _ := range data {
 		data[i] = 'a'
 	}
+	// the file is made of lines
+	data[len(data)-1] = '\n'
 	return data, nil, nil
 }
 
 type MockDataWriter struct {
-	data   []byte
-	err    error
-	stderr error
+	data      []byte
+	err       error
+	stderr    error
+	intervals []time.Duration
 }
 
 func (m *MockDataWriter) WriteData(data []byte) {
 	m.data = append(m.data, data...)
 }
 
+func (m *MockDataWriter) SetPollInterval(interval time.Duration) {
+	m.intervals = append(m.intervals, interval)
+}
+
+func (m *MockDataWriter) Rewind() {}
+
 func (m *MockDataWriter) Error(stderr, err error) {
 	m.stderr = stderr
 	m.err = err
@@ -112,7 +125,7 @@ func TestFetcherNominal(t *testing.T) {
 	mockDataWrite := MockDataWriter{
 		data: []byte{}}
 
-	fetcher := newFetcher(0)
+	fetcher := newFetcher(0, &pollInterval{interval: time.Second})
 	go fetcher.fetch(&mock, &mockDataWrite)
 
 	<-time.After(3 * time.Second)
@@ -137,7 +150,7 @@ func TestFetcherError(t *testing.T) {
 	mockDataWrite := MockDataWriter{
 		data: []byte{}}
 
-	fetcher := newFetcher(0)
+	fetcher := newFetcher(0, &pollInterval{interval: time.Second})
 	go fetcher.fetch(&mock, &mockDataWrite)
 
 	<-time.After(2 * time.Second)
@@ -161,7 +174,7 @@ func TestFetcherError2(t *testing.T) {
 	mockDataWrite := MockDataWriter{
 		data: []byte{}}
 
-	fetcher := newFetcher(0)
+	fetcher := newFetcher(0, &pollInterval{interval: time.Second})
 	go fetcher.fetch(&mock, &mockDataWrite)
 
 	<-time.After(2 * time.Second)
@@ -171,3 +184,227 @@ func TestFetcherError2(t *testing.T) {
 		t.Error("Expected err != nil. Actual is nil")
 	}
 }
+
+// hangingFileReader never returns the size until ctx is done, like a hung remote stat.
+type hangingFileReader struct {
+	MockFileReader
+	aborted chan struct{}
+}
+
+func (h *hangingFileReader) FetchSize(ctx context.Context) (int32, error, error) {
+	<-ctx.Done()
+	close(h.aborted)
+	return 0, nil, ctx.Err()
+}
+
+func TestFetcherCloseAbortsCommands(t *testing.T) {
+	mock := &hangingFileReader{aborted: make(chan struct{})}
+	mockDataWrite := MockDataWriter{}
+
+	fetcher := newFetcher(0, &pollInterval{interval: time.Second})
+	go fetcher.fetch(mock, &mockDataWrite)
+
+	// let the fetcher start fetching the size
+	<-time.After(1500 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		fetcher.close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected: fetcher closed. Actual: close blocked by the command in flight")
+	}
+
+	select {
+	case <-mock.aborted:
+	default:
+		t.Error("Expected: command aborted. Actual: command still running")
+	}
+}
+
+func TestFetcherAdaptivePoll(t *testing.T) {
+	// the file never grows
+	mock := MockFileReader{maxChunkSize: 2}
+	mockDataWrite := MockDataWriter{}
+
+	poll, err := newPollInterval(conf.Poll{Mode: conf.PollAdaptive, Interval: 100 * time.Millisecond, Max: 400 * time.Millisecond, Min: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := newFetcher(0, poll)
+	go fetcher.fetch(&mock, &mockDataWrite)
+
+	<-time.After(1500 * time.Millisecond)
+	fetcher.close()
+
+	expected := []time.Duration{200 * time.Millisecond, 400 * time.Millisecond}
+	if len(mockDataWrite.intervals) != len(expected) {
+		t.Fatalf("Expected: intervals %v. Actual: %v", expected, mockDataWrite.intervals)
+	}
+	for i := range expected {
+		if mockDataWrite.intervals[i] != expected[i] {
+			t.Errorf("Expected: intervals %v. Actual: %v", expected, mockDataWrite.intervals)
+		}
+	}
+}
+
+// chunksFileReader is a file made of chunks. The file grows by one chunk at each fetch.
+type chunksFileReader struct {
+	MockFileReader
+	chunks [][]byte
+}
+
+func (c *chunksFileReader) FetchSize(ctx context.Context) (int32, error, error) {
+	if c.byteRead < c.size || len(c.chunks) == 0 {
+		return int32(c.size), nil, nil
+	}
+	return int32(c.size + len(c.chunks[0])), nil, nil
+}
+
+func (c *chunksFileReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
+	chunk := c.chunks[0]
+	c.chunks = c.chunks[1:]
+	c.byteRead += len(chunk)
+	return chunk, nil, nil
+}
+
+// lockedDataWriter is a DataWriter which data can be read while the fetcher runs.
+type lockedDataWriter struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (l *lockedDataWriter) WriteData(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.data = append(l.data, data...)
+}
+
+func (l *lockedDataWriter) Data() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return string(l.data)
+}
+
+func (l *lockedDataWriter) Error(stderr, err error) {}
+
+func (l *lockedDataWriter) SetPollInterval(interval time.Duration) {}
+
+func (l *lockedDataWriter) Rewind() {}
+
+func TestFetcherPartialLine(t *testing.T) {
+	defer func(timeout time.Duration) { PartialLineTimeout = timeout }(PartialLineTimeout)
+	PartialLineTimeout = 500 * time.Millisecond
+
+	mock := &chunksFileReader{chunks: [][]byte{[]byte("first\nsec"), []byte("ond\nthird")}}
+	writer := &lockedDataWriter{}
+
+	fetcher := newFetcher(0, &pollInterval{interval: 200 * time.Millisecond})
+	go fetcher.fetch(mock, writer)
+
+	// the partial line is held until its end is read
+	<-time.After(300 * time.Millisecond)
+	if data := writer.Data(); data != "first\n" {
+		fetcher.close()
+		t.Fatalf("Expected: %q. Actual: %q", "first\n", data)
+	}
+
+	// the last line never ends: it is written after PartialLineTimeout
+	<-time.After(2 * time.Second)
+	fetcher.close()
+
+	if data := writer.Data(); data != "first\nsecond\nthird" {
+		t.Errorf("Expected: %q. Actual: %q", "first\nsecond\nthird", data)
+	}
+}
+
+// slowFileReader is a file growing by one line at each fetch of the size. Reading it takes a while.
+// It records whether two reads have run at the same time.
+type slowFileReader struct {
+	mutex   sync.Mutex
+	size    int32
+	read    int32
+	lines   int
+	reading bool
+	overlap bool
+}
+
+func (s *slowFileReader) FetchSize(ctx context.Context) (int32, error, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lines++
+	return int32(s.lines * 2), nil, nil
+}
+
+func (s *slowFileReader) GetSize() int32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+func (s *slowFileReader) SetSize(size int32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.size = size
+}
+
+func (s *slowFileReader) HasNextChunk() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read < s.size
+}
+
+func (s *slowFileReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
+	s.mutex.Lock()
+	if s.reading {
+		s.overlap = true
+	}
+	s.reading = true
+	s.mutex.Unlock()
+
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case <-ctx.Done():
+		return []byte{}, nil, ctx.Err()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reading = false
+	var data []byte
+	for ; s.read < s.size; s.read += 2 {
+		data = append(data, 'a', '\n')
+	}
+	return data, nil, nil
+}
+
+func (s *slowFileReader) Close() {}
+
+func (s *slowFileReader) Rewind() {}
+
+func TestFetcherSlowRead(t *testing.T) {
+	reader := &slowFileReader{}
+	writer := &lockedDataWriter{}
+
+	// the poll interval is shorter than a read
+	fetcher := newFetcher(0, &pollInterval{interval: 20 * time.Millisecond})
+	go fetcher.fetch(reader, writer)
+
+	<-time.After(time.Second)
+	fetcher.close()
+
+	reader.mutex.Lock()
+	defer reader.mutex.Unlock()
+	if reader.overlap {
+		t.Error("Expected: one read at a time. Actual: reads overlapping")
+	}
+	// each line is written once. The last read can be dropped by close.
+	if data := writer.Data(); len(data) == 0 || len(data) > int(reader.read) {
+		t.Errorf("Expected: at most %d bytes written. Actual: %d", reader.read, len(data))
+	}
+}
@@ -0,0 +1,368 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/ssh"
+)
+
+// DefaultBatchWindow is how long a host poller waits for other files before fetching the sizes.
+var DefaultBatchWindow = 100 * time.Millisecond
+
+// DefaultReadBatchWindow is how long a host poller waits for the reads of other files before running them.
+// It is short because the fetchers sharing a size batch ask for their reads at the same time.
+var DefaultReadBatchWindow = 10 * time.Millisecond
+
+// commandRunner runs a shell command on a host.
+type commandRunner interface {
+	Run(ctx context.Context, cmd string, stdout, stderr io.Writer) error
+}
+
+// sshRunner runs the commands over a ssh connection.
+type sshRunner struct {
+	client *ssh.Client
+}
+
+func (s sshRunner) Run(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	return s.client.Cmd(cmd).SetStdio(stdout, stderr).RunContext(ctx)
+}
+
+// hostPoller fetches the sizes of all the files watched on a host with one command.
+// The sizes asked within the batch window are fetched together. Because the fetchers sharing a batch
+// get their size at the same time, they stay in the same batch while they poll at the same interval.
+// The reads of the new data asked within the read window run as one command too: the output of each read
+// is preceded by its length.
+type hostPoller struct {
+	runner commandRunner
+
+	// time to wait for other files before running the command
+	window time.Duration
+
+	// time to wait for the reads of other files before running the command
+	readWindow time.Duration
+
+	// protects batch and reads
+	mutex *sync.Mutex
+
+	// batch waiting for the command to run. Nil if no size has been asked since the last command.
+	batch *sizeBatch
+
+	// reads waiting for the command to run. Nil if no read has been asked since the last command.
+	reads *readBatch
+}
+
+// sizeBatch is a set of files which sizes are fetched by the same command.
+type sizeBatch struct {
+	paths []string
+
+	// longest command timeout of the fetchers in the batch
+	timeout time.Duration
+
+	// closed when results is set
+	done    chan struct{}
+	results map[string]sizeResult
+}
+
+// sizeResult is the result of the stat of one file.
+type sizeResult struct {
+	size   int32
+	inode  uint64
+	stderr error
+	err    error
+}
+
+// readBatch is a set of commands reading files which run as one command.
+type readBatch struct {
+	cmds []string
+
+	// longest command timeout of the fetchers in the batch
+	timeout time.Duration
+
+	// closed when results is set
+	done    chan struct{}
+	results []readResult
+}
+
+// readResult is the output of one command of a read batch.
+type readResult struct {
+	stdout []byte
+	stderr []byte
+	err    error
+}
+
+func newHostPoller(runner commandRunner) *hostPoller {
+	return &hostPoller{
+		runner:     runner,
+		window:     DefaultBatchWindow,
+		readWindow: DefaultReadBatchWindow,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// fetchStat returns the size and the inode of the file like RemoteReader.FetchSize. The command runs for at most timeout.
+// It returns as soon as ctx is done but the command keeps running for the other files of the batch.
+func (p *hostPoller) fetchStat(ctx context.Context, path string, timeout time.Duration) sizeResult {
+	p.mutex.Lock()
+	b := p.batch
+	if b == nil {
+		b = &sizeBatch{done: make(chan struct{})}
+		p.batch = b
+		time.AfterFunc(p.window, func() {
+			p.run(b)
+		})
+	}
+	b.add(path, timeout)
+	p.mutex.Unlock()
+
+	select {
+	case <-b.done:
+		return b.results[path]
+	case <-ctx.Done():
+		return sizeResult{err: ctx.Err()}
+	}
+}
+
+// run fetches the sizes of the batch and wakes up the fetchers waiting for them.
+func (p *hostPoller) run(b *sizeBatch) {
+	// no path can be added to the batch from now on.
+	p.mutex.Lock()
+	if p.batch == b {
+		p.batch = nil
+	}
+	p.mutex.Unlock()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	glog.V(4).Infof("Fetching size of %d files", len(b.paths))
+	err := p.runner.Run(ctx, batchStatCommand(b.paths), &stdout, &stderr)
+	switch {
+	case err == context.DeadlineExceeded:
+		glog.Warningf("stat of %d files timed out after %s", len(b.paths), b.timeout)
+		b.results = batchError(b.paths, ErrTimeout)
+	case err != nil:
+		glog.V(2).Infof("stat of %d files failed: %s %s", len(b.paths), err, stderr.String())
+		b.results = batchError(b.paths, ErrClient)
+	default:
+		b.results = parseBatchSizes(b.paths, stdout.Bytes())
+	}
+
+	close(b.done)
+}
+
+// read runs cmd like RemoteReader.run, together with the reads of the other files. The command runs for at most timeout.
+// It returns as soon as ctx is done but the command keeps running for the other files of the batch.
+func (p *hostPoller) read(ctx context.Context, cmd string, timeout time.Duration, stdout, stderr io.Writer) error {
+	p.mutex.Lock()
+	b := p.reads
+	if b == nil {
+		b = &readBatch{done: make(chan struct{})}
+		p.reads = b
+		time.AfterFunc(p.readWindow, func() {
+			p.runReads(b)
+		})
+	}
+	i := len(b.cmds)
+	b.cmds = append(b.cmds, cmd)
+	if timeout > b.timeout {
+		b.timeout = timeout
+	}
+	p.mutex.Unlock()
+
+	select {
+	case <-b.done:
+		r := b.results[i]
+		stdout.Write(r.stdout)
+		stderr.Write(r.stderr)
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runReads runs the commands of the batch and wakes up the fetchers waiting for their output.
+// A single command runs as it is.
+func (p *hostPoller) runReads(b *readBatch) {
+	// no command can be added to the batch from now on.
+	p.mutex.Lock()
+	if p.reads == b {
+		p.reads = nil
+	}
+	p.mutex.Unlock()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	if len(b.cmds) == 1 {
+		err := p.runner.Run(ctx, b.cmds[0], &stdout, &stderr)
+		if err == context.DeadlineExceeded {
+			glog.Warningf("command timed out after %s: %s", b.timeout, b.cmds[0])
+			err = ErrTimeout
+		}
+		b.results = []readResult{{stdout: stdout.Bytes(), stderr: stderr.Bytes(), err: err}}
+		close(b.done)
+		return
+	}
+
+	glog.V(4).Infof("Reading %d files", len(b.cmds))
+	err := p.runner.Run(ctx, batchReadCommand(b.cmds), &stdout, &stderr)
+	switch {
+	case err == context.DeadlineExceeded:
+		glog.Warningf("read of %d files timed out after %s", len(b.cmds), b.timeout)
+		b.results = readBatchError(len(b.cmds), nil, ErrTimeout)
+	case err != nil:
+		glog.V(2).Infof("read of %d files failed: %s %s", len(b.cmds), err, stderr.String())
+		b.results = readBatchError(len(b.cmds), stderr.Bytes(), err)
+	default:
+		b.results = parseReadBatch(len(b.cmds), stdout.Bytes())
+	}
+
+	close(b.done)
+}
+
+// add adds path to the batch if it is not already in it.
+func (b *sizeBatch) add(path string, timeout time.Duration) {
+	if timeout > b.timeout {
+		b.timeout = timeout
+	}
+	for _, p := range b.paths {
+		if p == path {
+			return
+		}
+	}
+	b.paths = append(b.paths, path)
+}
+
+// batchStatCommand returns the command printing one line for each path: "ok <size> <inode>" or "err <message>".
+func batchStatCommand(paths []string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellPath(p)
+	}
+
+	return fmt.Sprintf(`for f in %s; do if s=$(stat --format '%%s %%i' -- "$f" 2>&1); then echo "ok $s"; else echo "err $s" | head -n1; fi; done`,
+		strings.Join(quoted, " "))
+}
+
+// parseBatchSizes splits the output of batchStatCommand. A file without a line gets ErrInvalidSize.
+func parseBatchSizes(paths []string, output []byte) map[string]sizeResult {
+	results := make(map[string]sizeResult, len(paths))
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for _, path := range paths {
+		if !scanner.Scan() {
+			results[path] = sizeResult{stderr: ErrInvalidSize}
+			continue
+		}
+
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "ok "):
+			size, inode, err := parseStat(strings.TrimPrefix(line, "ok "))
+			if err != nil {
+				results[path] = sizeResult{stderr: err}
+			} else {
+				results[path] = sizeResult{size: size, inode: inode}
+			}
+		case strings.HasPrefix(line, "err "):
+			results[path] = sizeResult{stderr: errors.New(strings.TrimPrefix(line, "err "))}
+		default:
+			results[path] = sizeResult{stderr: ErrInvalidSize}
+		}
+	}
+
+	return results
+}
+
+// batchReadCommand returns the command running cmds one after the other. The output of each command is preceded
+// by a line "<exit status> <length of the output> <length of the error output>" and followed by its error output.
+// The commands run in subshells: one exiting doesn't stop the others.
+func batchReadCommand(cmds []string) string {
+	var script strings.Builder
+	script.WriteString(`o=$(mktemp) && e=$(mktemp) || exit 1; trap 'rm -f "$o" "$e"' EXIT` + "\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(&script, "(\n%s\n) >\"$o\" 2>\"$e\"; s=$?; echo \"$s $(wc -c <\"$o\") $(wc -c <\"$e\")\"; cat \"$o\" \"$e\"\n", cmd)
+	}
+	script.WriteString("exit 0")
+	return script.String()
+}
+
+// parseReadBatch splits the output of batchReadCommand. The commands without output get ErrClient.
+func parseReadBatch(n int, output []byte) []readResult {
+	results := make([]readResult, n)
+	for i := range results {
+		var status, outLen, errLen int
+		end := bytes.IndexByte(output, '\n')
+		if end < 0 {
+			return failReads(results, i)
+		}
+		if _, err := fmt.Sscan(string(output[:end]), &status, &outLen, &errLen); err != nil {
+			return failReads(results, i)
+		}
+		output = output[end+1:]
+		if outLen < 0 || errLen < 0 || outLen+errLen > len(output) {
+			return failReads(results, i)
+		}
+
+		results[i] = readResult{stdout: output[:outLen], stderr: output[outLen : outLen+errLen]}
+		if status != 0 {
+			results[i].err = fmt.Errorf("exit status %d", status)
+		}
+		output = output[outLen+errLen:]
+	}
+	return results
+}
+
+// failReads sets ErrClient as error of the results from the first one without output.
+func failReads(results []readResult, first int) []readResult {
+	for i := first; i < len(results); i++ {
+		results[i].err = ErrClient
+	}
+	return results
+}
+
+// readBatchError returns err and the error output of the batch for all the commands.
+func readBatchError(n int, stderr []byte, err error) []readResult {
+	results := make([]readResult, n)
+	for i := range results {
+		results[i] = readResult{stderr: stderr, err: err}
+	}
+	return results
+}
+
+// batchError returns err as connection error for all the paths.
+func batchError(paths []string, err error) map[string]sizeResult {
+	results := make(map[string]sizeResult, len(paths))
+	for _, path := range paths {
+		results[path] = sizeResult{err: err}
+	}
+	return results
+}
+
+// shellPath quotes path for sh. A leading ~/ is left out of the quotes to be expanded to the home directory.
+func shellPath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return "~/" + shellQuote(path[2:])
+	}
+	return shellQuote(path)
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,269 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shellRunner runs the commands with the local shell and counts them.
+type shellRunner struct {
+	mutex *sync.Mutex
+	count int
+}
+
+func newShellRunner() *shellRunner {
+	return &shellRunner{mutex: &sync.Mutex{}}
+}
+
+func (s *shellRunner) Run(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	s.mutex.Lock()
+	s.count++
+	s.mutex.Unlock()
+
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *shellRunner) Count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// hangingRunner never returns before ctx is done.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]int) {
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHostPollerBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpoller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]int{"a.log": 10, "b.log": 0, "it's a log": 42}
+	writeTestFiles(t, dir, files)
+
+	runner := newShellRunner()
+	poller := newHostPoller(runner)
+
+	paths := []string{"a.log", "b.log", "it's a log", "missing.log"}
+	results := make([]sizeResult, len(paths))
+
+	var wg sync.WaitGroup
+	for i, p := range paths {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			results[i] = poller.fetchStat(context.Background(), filepath.Join(dir, p), time.Second)
+		}(i, p)
+	}
+	wg.Wait()
+
+	if runner.Count() != 1 {
+		t.Errorf("Expected: 1 command. Actual: %d", runner.Count())
+	}
+
+	for i, p := range paths[:3] {
+		r := results[i]
+		if r.stderr != nil || r.err != nil {
+			t.Errorf("Expected: no error for %s. Actual: %v %v", p, r.stderr, r.err)
+		}
+		if r.size != int32(files[p]) {
+			t.Errorf("Expected: size of %s %d. Actual: %d", p, files[p], r.size)
+		}
+	}
+
+	// the missing file doesn't fail the others and the connection is fine
+	if missing := results[3]; missing.stderr == nil || missing.err != nil {
+		t.Errorf("Expected: stderr for missing file. Actual: %v %v", missing.stderr, missing.err)
+	}
+}
+
+func TestHostPollerContext(t *testing.T) {
+	poller := newHostPoller(hangingRunner{})
+
+	// the command times out
+	err := poller.fetchStat(context.Background(), "/var/log/messages", 200*time.Millisecond).err
+	if err != ErrTimeout {
+		t.Errorf("Expected: %s. Actual: %v", ErrTimeout, err)
+	}
+
+	// the fetcher is closed while waiting for the batch
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err = poller.fetchStat(ctx, "/var/log/messages", time.Minute).err
+	if err != context.Canceled {
+		t.Errorf("Expected: %s. Actual: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected: returns when canceled. Actual: returned after %s", elapsed)
+	}
+}
+
+func TestHostPollerRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpoller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("line 1\n\x00\xff binary\n\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.log"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := newShellRunner()
+	poller := newHostPoller(runner)
+
+	type result struct {
+		stdout, stderr string
+		err            error
+	}
+	cmds := []string{
+		chunkCommand(filepath.Join(dir, "a.log"), 0, 100),
+		"echo failed >&2; exit 3",
+		"printf partial; exit 0",
+		chunkCommand(filepath.Join(dir, "missing.log"), 0, 100),
+	}
+	results := make([]result, len(cmds))
+
+	var wg sync.WaitGroup
+	for i, cmd := range cmds {
+		wg.Add(1)
+		go func(i int, cmd string) {
+			defer wg.Done()
+			var stdout, stderr bytes.Buffer
+			err := poller.read(context.Background(), cmd, time.Second, &stdout, &stderr)
+			results[i] = result{stdout.String(), stderr.String(), err}
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	if runner.Count() != 1 {
+		t.Errorf("Expected: 1 command. Actual: %d", runner.Count())
+	}
+
+	if r := results[0]; r.stdout != string(data) || r.stderr != "" || r.err != nil {
+		t.Errorf("Expected: %q. Actual: %+v", data, r)
+	}
+	if r := results[1]; r.stdout != "" || r.stderr != "failed\n" || r.err == nil {
+		t.Errorf("Expected: error output and exit status. Actual: %+v", r)
+	}
+	// the exit of a command doesn't stop the others
+	if r := results[2]; r.stdout != "partial" || r.stderr != "" || r.err != nil {
+		t.Errorf("Expected: %q. Actual: %+v", "partial", r)
+	}
+	if r := results[3]; r.stdout != "" || r.stderr == "" || r.err != nil {
+		t.Errorf("Expected: error output for missing file. Actual: %+v", r)
+	}
+
+	// a read alone runs as it is
+	var stdout, stderr bytes.Buffer
+	if err := poller.read(context.Background(), cmds[0], time.Second, &stdout, &stderr); err != nil || stdout.String() != string(data) {
+		t.Errorf("Expected: %q. Actual: %q %v", data, stdout.String(), err)
+	}
+}
+
+func TestParseReadBatch(t *testing.T) {
+	results := parseReadBatch(3, []byte("0 3 0\nabc1 0      4\nerr\n"))
+
+	if r := results[0]; string(r.stdout) != "abc" || len(r.stderr) != 0 || r.err != nil {
+		t.Errorf("Expected: abc. Actual: %+v", r)
+	}
+	if r := results[1]; len(r.stdout) != 0 || string(r.stderr) != "err\n" || r.err == nil {
+		t.Errorf("Expected: error output and exit status. Actual: %+v", r)
+	}
+	if r := results[2]; r.err != ErrClient {
+		t.Errorf("Expected: %s. Actual: %v", ErrClient, r.err)
+	}
+
+	// the output is cut
+	results = parseReadBatch(2, []byte("0 10 0\nabc"))
+	for i, r := range results {
+		if r.err != ErrClient {
+			t.Errorf("Expected: %s for %d. Actual: %v", ErrClient, i, r.err)
+		}
+	}
+}
+
+func TestParseBatchSizes(t *testing.T) {
+	paths := []string{"a", "b", "c", "d"}
+	results := parseBatchSizes(paths, []byte("ok 12 345\nerr stat: cannot stat 'b'\nok abc\n"))
+
+	if r := results["a"]; r.size != 12 || r.inode != 345 || r.stderr != nil {
+		t.Errorf("Expected: 12 345. Actual: %d %d %v", r.size, r.inode, r.stderr)
+	}
+	if r := results["b"]; r.stderr == nil || r.stderr.Error() != "stat: cannot stat 'b'" {
+		t.Errorf("Expected: stat error. Actual: %v", r.stderr)
+	}
+	if r := results["c"]; r.stderr != ErrInvalidSize {
+		t.Errorf("Expected: %s. Actual: %v", ErrInvalidSize, r.stderr)
+	}
+	if r := results["d"]; r.stderr != ErrInvalidSize {
+		t.Errorf("Expected: %s. Actual: %v", ErrInvalidSize, r.stderr)
+	}
+}
+
+func TestShellPath(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/var/log/app.log", "/var/log/app.log"},
+		{"/var/log/it's a *.log", "/var/log/it's a *.log"},
+		{"~/app $1.log", filepath.Join(home, "app $1.log")},
+		{"/var/~/app.log", "/var/~/app.log"},
+	}
+
+	for _, test := range tests {
+		cmd := exec.Command("/bin/sh", "-c", "printf %s "+shellPath(test.path))
+		cmd.Env = []string{"HOME=" + home}
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != test.expected {
+			t.Errorf("Expected: %q. Actual: %q", test.expected, output)
+		}
+	}
+}
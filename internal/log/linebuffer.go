@@ -0,0 +1,71 @@
+package log
+
+import (
+	"bytes"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// PartialLineTimeout is how long the end of a line is waited for before the partial line is written anyway.
+	PartialLineTimeout = 2 * time.Second
+
+	// MaxLineLength is the length above which a partial line is written without waiting for its end.
+	MaxLineLength = 64 * 1024
+)
+
+// lineBuffer holds the trailing partial line of the data read so only complete lines are written.
+// It is not safe for concurrent use.
+type lineBuffer struct {
+	partial []byte
+}
+
+// write returns the complete lines of the partial line followed by p and holds the rest.
+// If the partial line is longer than MaxLineLength, it is returned too except an incomplete UTF-8 rune.
+func (b *lineBuffer) write(p []byte) []byte {
+	data := append(b.partial, p...)
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if len(data)-end > MaxLineLength {
+		end = runeBoundary(data)
+	}
+
+	b.partial = append([]byte{}, data[end:]...)
+	return data[:end]
+}
+
+// flush returns the partial line except an incomplete UTF-8 rune which stays held.
+func (b *lineBuffer) flush() []byte {
+	end := runeBoundary(b.partial)
+
+	data := b.partial[:end]
+	b.partial = append([]byte{}, b.partial[end:]...)
+	return data
+}
+
+// drain returns all the data held.
+func (b *lineBuffer) drain() []byte {
+	data := b.partial
+	b.partial = nil
+	return data
+}
+
+// pending returns true if data is held.
+func (b *lineBuffer) pending() bool {
+	return len(b.partial) > 0
+}
+
+// runeBoundary returns the length of data without its incomplete trailing UTF-8 rune.
+func runeBoundary(data []byte) int {
+	// a rune is at most utf8.UTFMax bytes long
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if utf8.FullRune(data[i:]) {
+			return len(data)
+		}
+		return i
+	}
+	return len(data)
+}
@@ -0,0 +1,58 @@
+package log
+
+import "testing"
+
+func TestLineBufferWrite(t *testing.T) {
+	var b lineBuffer
+
+	if out := b.write([]byte("first line\nsecond")); string(out) != "first line\n" {
+		t.Errorf("Expected: %q. Actual: %q", "first line\n", out)
+	}
+	if !b.pending() {
+		t.Error("Expected: partial line held. Actual: nothing held")
+	}
+
+	if out := b.write([]byte(" line")); len(out) != 0 {
+		t.Errorf("Expected: nothing written. Actual: %q", out)
+	}
+
+	if out := b.write([]byte(" end\nthird\n")); string(out) != "second line end\nthird\n" {
+		t.Errorf("Expected: %q. Actual: %q", "second line end\nthird\n", out)
+	}
+	if b.pending() {
+		t.Errorf("Expected: nothing held. Actual: %q", b.partial)
+	}
+}
+
+func TestLineBufferFlush(t *testing.T) {
+	var b lineBuffer
+
+	// "é" is split between two reads
+	e := []byte("é")
+	b.write(append([]byte("caf"), e[0]))
+
+	if out := b.flush(); string(out) != "caf" {
+		t.Errorf("Expected: %q. Actual: %q", "caf", out)
+	}
+	if out := b.write(append(e[1:], '\n')); string(out) != "é\n" {
+		t.Errorf("Expected: %q. Actual: %q", "é\n", out)
+	}
+
+	b.write([]byte("partial"))
+	if out := b.drain(); string(out) != "partial" || b.pending() {
+		t.Errorf("Expected: %q drained. Actual: %q", "partial", out)
+	}
+}
+
+func TestLineBufferMaxLineLength(t *testing.T) {
+	defer func(l int) { MaxLineLength = l }(MaxLineLength)
+	MaxLineLength = 4
+
+	var b lineBuffer
+	if out := b.write([]byte("abc")); len(out) != 0 {
+		t.Errorf("Expected: nothing written. Actual: %q", out)
+	}
+	if out := b.write([]byte("d\xc3")); string(out) != "abcd" {
+		t.Errorf("Expected: %q. Actual: %q", "abcd", out)
+	}
+}
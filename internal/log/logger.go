@@ -1,65 +1,159 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
 )
 
+// ErrNoOlderData means that there is no data before the offset requested: it is the beginning of the file,
+// the file has been rotated or the reader cannot read the file again.
+var ErrNoOlderData = errors.New("no older data")
+
 // Logger reads data from file and send data notification to clients.
+// It is safe for concurrent use.
 type Logger struct {
 	ID int
 
+	// protects fetcher, reader, State, interval and fileBase
+	mutex *sync.Mutex
+
 	// Outbound channel. Clients reading from this channel can read DataNotification and state messages.
 	out chan interface{}
 
 	//fetches the data from file
 	fetcher *fetcher
 
+	// reader used by the fetcher
+	reader FileReader
+
 	// cache
 	cache *cache
 
+	// host and file of the lines
+	source Source
+
+	// sources of the lines of a merged logger, the oldest first. The runs before the cache are removed.
+	sources []sourceRun
+
+	// sorts the lines of the loggers merged by the logger. Nil if the logger reads a file.
+	merger *merger
+
 	// state
 	State *State
 
+	// interval between two polls used by the fetcher
+	poll *pollInterval
+
+	// last interval set by the fetcher
+	interval time.Duration
+
+	// offset of the data received when the file was read from its beginning the last time.
+	// The offset of the data in the file is the offset of the data received minus fileBase.
+	fileBase int64
+
 	done chan struct{}
 }
 
-// New creates a new logger
-func NewLogger(id int, out chan interface{}) *Logger {
+// New creates a new logger keeping at most cacheSize bytes. If cacheSize is zero, MaxCacheSize is used.
+// It returns an error if the poll settings are not valid.
+func NewLogger(id int, out chan interface{}, pollSettings conf.Poll, cacheSize int) (*Logger, error) {
+	poll, err := newPollInterval(pollSettings)
+	if err != nil {
+		return nil, err
+	}
+
 	l := &Logger{
-		ID:      id,
-		out:     out,
-		fetcher: nil,
-		cache:   newCache(),
-		done:    make(chan struct{}),
-		State:   NewState(id),
+		ID:       id,
+		mutex:    &sync.Mutex{},
+		out:      out,
+		fetcher:  nil,
+		cache:    newCache(cacheSize),
+		done:     make(chan struct{}),
+		State:    NewState(id),
+		poll:     poll,
+		interval: poll.current(),
 	}
 
-	return l
+	return l, nil
+}
+
+// spillTo moves the data evicted from the cache to a segment store under the user cache directory.
+func (l *Logger) spillTo(c conf.LoggerConfiguration) error {
+	dir, err := spillDir(l.ID, c.Name)
+	if err != nil {
+		return err
+	}
+
+	store, err := newSegmentStore(dir, c.Spill)
+	if err != nil {
+		return err
+	}
+
+	l.cache.mutex.Lock()
+	l.cache.spill = store
+	l.cache.mutex.Unlock()
+	return nil
 }
 
 // Start the logger. It runs the fetcher in a go routine.
 func (l *Logger) Start(reader FileReader) int {
-	if l.IsRunning() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.fetcher != nil {
 		return l.ID
 	}
 
 	glog.Infof("Starting logging with logger %d", l.ID)
-	l.fetcher = newFetcher(l.ID)
+	l.fetcher = newFetcher(l.ID, l.poll)
+	l.reader = reader
 	go l.fetcher.fetch(reader, l)
 
 	return l.ID
 }
 
+// startMerger starts a merged logger: its lines are written by m.
+func (l *Logger) startMerger(m *merger) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.merger != nil {
+		return
+	}
+
+	glog.Infof("Starting merged logger %d", l.ID)
+	l.merger = m
+	go m.run()
+}
+
 // Stop stop reading the file. It doesn't disconnect the client.
 // it is just stop reading the file.
+// The fetcher can be blocked sending data to the out channel so the channel must be read until Stop returns.
 func (l *Logger) Stop() {
-	if l.IsRunning() {
+	l.mutex.Lock()
+	f, m := l.fetcher, l.merger
+	l.fetcher = nil
+	l.merger = nil
+	l.mutex.Unlock()
+
+	if f != nil || m != nil {
 		glog.Info("Closing logger")
 
-		l.fetcher.close()
+		if f != nil {
+			f.close()
+		}
+		if m != nil {
+			m.close()
+		}
 
-		l.fetcher = nil
-		glog.V(1).Infof("Fetcher closed. Logger state: %+v", l.State)
+		glog.V(1).Infof("Fetcher closed. Logger state: %+v", l.GetState())
 
 		glog.V(1).Infof("Cached closed and cleared")
 		l.cache.clear()
@@ -70,44 +164,265 @@ func (l *Logger) Stop() {
 
 // IsRunning return true if logger is running
 func (l *Logger) IsRunning() bool {
-	return l.fetcher != nil
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.fetcher != nil || l.merger != nil
 }
 
-// RequestData reads `size` bytes from cache at offset `offset`.
+// GetState returns a copy of the state of the logger.
+func (l *Logger) GetState() State {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return *l.State
+}
+
+// Stats returns the number of bytes transferred by the reader of the logger.
+// It returns false if the logger is not started or its reader doesn't count them.
+func (l *Logger) Stats() (Stats, bool) {
+	l.mutex.Lock()
+	reader := l.reader
+	l.mutex.Unlock()
+
+	sr, ok := reader.(statsReader)
+	if !ok {
+		return Stats{}, false
+	}
+	return sr.Stats(), true
+}
+
+// RequestData reads `size` bytes at offset `offset`. The offset is counted from the first byte received by the logger.
+// The data evicted from the cache is read from disk if the logger spills its cache.
 // It returns an array of bytes and the number of bytes actual read.
 func (l *Logger) RequestData(offset int64, size int) ([]byte, int) {
 	data := make([]byte, size)
-	n, _ := l.cache.ReadAt(data, offset)
+	n, err := l.cache.readStream(data, offset)
+	if err != nil {
+		glog.Warningf("cannot read data of logger %d at %d: %s", l.ID, offset, err)
+	}
 
 	return data, n
 }
 
+// RequestRecords returns the lines of `size` bytes at offset `offset` like RequestData.
+// The records have no receive time.
+func (l *Logger) RequestRecords(offset int64, size int) []Record {
+	data, n := l.RequestData(offset, size)
+	return l.records(data[:n], offset, time.Time{})
+}
+
+// records splits data at offset into records. The lines of a merged logger get the source they were written with.
+func (l *Logger) records(data []byte, offset int64, received time.Time) []Record {
+	records := newRecords(l.ID, l.source, data, offset, received)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.sources) == 0 {
+		return records
+	}
+
+	for i := range records {
+		r := &records[i]
+		k := sort.Search(len(l.sources), func(k int) bool { return l.sources[k].start > r.Offset }) - 1
+		if k < 0 {
+			continue
+		}
+		run := l.sources[k]
+		if run.tag > len(r.Line) {
+			continue
+		}
+		r.Source = run.source
+		r.Tag = run.tag
+		r.Timestamp = run.source.correct(parseTimestamp(r.Line[run.tag:], received))
+		r.Level = parseLevel(r.Line[run.tag:])
+	}
+	return records
+}
+
+// sourceRun is a run of lines of a merged logger with the same source and tag, beginning at offset start.
+type sourceRun struct {
+	start  int64
+	source Source
+	tag    int
+}
+
+// addSources records the sources of records written at their offsets. first is the offset of the oldest byte
+// of the cache: the runs before it are removed.
+func (l *Logger) addSources(records []Record, first int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, r := range records {
+		if n := len(l.sources); n > 0 && l.sources[n-1].source == r.Source && l.sources[n-1].tag == r.Tag {
+			continue
+		}
+		l.sources = append(l.sources, sourceRun{start: r.Offset, source: r.Source, tag: r.Tag})
+	}
+
+	n := 0
+	for n+1 < len(l.sources) && l.sources[n+1].start <= first {
+		n++
+	}
+	l.sources = l.sources[n:]
+}
+
+// ReadOlder returns the lines received before the offset before, at most size bytes, and the offset of the first line returned.
+// The data is read from the cache if it is still there, otherwise it is read again from the file.
+// It returns ErrNoOlderData if no line is found before the offset.
+func (l *Logger) ReadOlder(ctx context.Context, before int64, size int) ([]byte, int64, error) {
+	if first, _, _ := l.cache.bounds(); before > first {
+		return l.ReadCached(before, size)
+	}
+
+	l.mutex.Lock()
+	reader, fileBase := l.reader, l.fileBase
+	l.mutex.Unlock()
+
+	cr, ok := reader.(ChunkReader)
+	if !ok || before <= fileBase {
+		// the data before fileBase was in a file which has been rotated
+		return nil, before, ErrNoOlderData
+	}
+
+	end := before - fileBase
+	start := end - int64(size)
+	if start < 0 {
+		start = 0
+	}
+
+	data, err := cr.ReadChunk(ctx, start, int(end-start))
+	if err != nil {
+		return nil, before, err
+	}
+	if int64(len(data)) < end-start {
+		// the file has been truncated since
+		return nil, before, ErrNoOlderData
+	}
+	return alignToLine(data, fileBase+start, start > 0)
+}
+
+// ReadCached returns the lines received before the offset before which are still in the cache, at most size bytes,
+// and the offset of the first line returned. It returns ErrNoOlderData if the cache holds no line before the offset.
+func (l *Logger) ReadCached(before int64, size int) ([]byte, int64, error) {
+	first, _, _ := l.cache.bounds()
+	if before <= first {
+		return nil, before, ErrNoOlderData
+	}
+
+	start := before - int64(size)
+	if start < first {
+		start = first
+	}
+
+	data := make([]byte, before-start)
+	n, err := l.cache.readStream(data, start)
+	if err != nil {
+		return nil, before, err
+	}
+	if n < len(data) {
+		return nil, before, ErrNoOlderData
+	}
+	return alignToLine(data, start, start > first)
+}
+
+// alignToLine removes the first line of data if partial is true. The line is kept if it is the only line.
+// It returns the data and its new offset.
+func alignToLine(data []byte, offset int64, partial bool) ([]byte, int64, error) {
+	if partial {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 && i < len(data)-1 {
+			data = data[i+1:]
+			offset += int64(i + 1)
+		}
+	}
+	if len(data) == 0 {
+		return nil, offset, ErrNoOlderData
+	}
+	return data, offset, nil
+}
+
+// Rewind records that the next data is read from the beginning of the file.
+func (l *Logger) Rewind() {
+	_, _, end := l.cache.bounds()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.fileBase = end
+}
+
+// Offsets returns the offset of the oldest byte which can be requested, the offset of the first byte in memory
+// and the offset after the last byte received.
+func (l *Logger) Offsets() (first, memory, end int64) {
+	return l.cache.bounds()
+}
+
 // CacheSize returns the size of the cache.
 func (l *Logger) CacheSize() int {
-	return len(l.cache.data)
+	return int(l.cache.Size())
 }
 
-// WriteData writes data to cache.
+// WriteData writes data to cache and sends its lines as records.
 func (l *Logger) WriteData(data []byte) {
+	_, _, offset := l.cache.bounds()
+	l.write(data, newRecords(l.ID, l.source, data, offset, time.Now()))
+}
+
+// writeRecords writes the lines of records to cache and sends them. The offsets of the records are set
+// to the offsets in the logger.
+func (l *Logger) writeRecords(records []Record) {
+	first, _, offset := l.cache.bounds()
+	for i := range records {
+		records[i].LoggerID = l.ID
+		records[i].Offset = offset
+		offset += int64(len(records[i].Line))
+	}
+	l.addSources(records, first)
+	l.write(JoinLines(records), records)
+}
+
+// write writes data to cache and sends a notification with the records of data.
+func (l *Logger) write(data []byte, records []Record) {
 	// Handle new data from fetcher.
-	prevSize := l.cache.size
 	n, _ := l.cache.Write(data)
-	if prevSize == MaxCacheSize {
-		prevSize -= int64(n)
+	size := l.cache.Size()
+	prevSize := size - int64(n)
+	if prevSize < 0 {
+		prevSize = 0
 	}
 
 	// Create a new data notification to be sent to clients
 	notification := DataNotification{
 		ID:           l.ID,
-		Size:         l.cache.size,
+		Size:         size,
 		PreviousSize: prevSize,
+		Records:      records,
 	}
 	l.out <- notification
 }
 
+// PollInterval returns the current interval between two polls.
+func (l *Logger) PollInterval() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.interval
+}
+
+// SetPollInterval sends a poll notification.
+func (l *Logger) SetPollInterval(interval time.Duration) {
+	l.mutex.Lock()
+	l.interval = interval
+	l.mutex.Unlock()
+
+	l.out <- PollNotification{ID: l.ID, Interval: interval}
+}
+
 // Error sends a change in state notification.
 func (l *Logger) Error(stderr, err error) {
-	if stateChanged := l.State.HandleStateChange(stderr, err); stateChanged {
-		l.out <- *(l.State)
+	l.mutex.Lock()
+	stateChanged := l.State.HandleStateChange(stderr, err)
+	state := *l.State
+	l.mutex.Unlock()
+
+	if stateChanged {
+		l.out <- state
 	}
 }
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
 )
 
 // Mock file reader
@@ -24,7 +27,7 @@ type mockFileReader struct {
 	maxChunkSize int
 }
 
-func (m *mockFileReader) FetchSize() (int32, error, error) {
+func (m *mockFileReader) FetchSize(ctx context.Context) (int32, error, error) {
 	if m.isSizeInvalid {
 		return 0, errors.New("size error"), nil
 	}
@@ -66,7 +69,7 @@ func (m *mockFileReader) HasNextChunk() bool {
 	return m.byteRead < m.size
 }
 
-func (m *mockFileReader) ReadNextChunk() ([]byte, error, error) {
+func (m *mockFileReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
 	if m.isSizeInvalid {
 		return []byte{}, errors.New("size error"), nil
 	}
@@ -81,6 +84,8 @@ func (m *mockFileReader) ReadNextChunk() ([]byte, error, error) {
 	for i, _ := range data {
 		data[i] = 'a'
 	}
+	// the file is made of lines
+	data[len(data)-1] = '\n'
 	return data, nil, nil
 }
 
@@ -99,7 +104,10 @@ func TestLoggerNominal(t *testing.T) {
 		maxChunkSize:    2,
 	}
 
-	logger := NewLogger(1, out)
+	logger, err := NewLogger(1, out, conf.Poll{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 	go func(done chan interface{}) {
 		for {
 			select {
@@ -148,3 +156,73 @@ func TestLoggerNominal(t *testing.T) {
 		t.Errorf("Expected size: 4 bytes and previous size: 2. Actual size %d. Previous size: %d", dataNotifications[1].Size, dataNotifications[1].PreviousSize)
 	}
 }
+
+// fileChunkReader reads the chunks of a file held in memory.
+type fileChunkReader struct {
+	mockFileReader
+	file []byte
+}
+
+func (f *fileChunkReader) ReadChunk(ctx context.Context, offset int64, size int) ([]byte, error) {
+	if offset >= int64(len(f.file)) {
+		return nil, nil
+	}
+	end := offset + int64(size)
+	if end > int64(len(f.file)) {
+		end = int64(len(f.file))
+	}
+	return f.file[offset:end], nil
+}
+
+// newTestBackfillLogger returns a logger which has received file and kept only the last cacheSize bytes.
+func newTestBackfillLogger(t *testing.T, file string, cacheSize int) *Logger {
+	logger, err := NewLogger(1, make(chan interface{}), conf.Poll{}, cacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.reader = &fileChunkReader{file: []byte(file)}
+	logger.cache.Write([]byte(file))
+	return logger
+}
+
+func TestLoggerReadOlder(t *testing.T) {
+	file := "line1\nline2\nline3\nline4\nline5\n"
+	logger := newTestBackfillLogger(t, file, 12)
+
+	first, memory, end := logger.Offsets()
+	if first != 18 || memory != 18 || end != 30 {
+		t.Fatalf("Expected: offsets 18 18 30. Actual: %d %d %d", first, memory, end)
+	}
+
+	// in the cache: the partial line is removed
+	data, offset, err := logger.ReadOlder(context.Background(), 30, 8)
+	if err != nil || string(data) != "line5\n" || offset != 24 {
+		t.Errorf("Expected: %q at 24. Actual: %q at %d %v", "line5\n", data, offset, err)
+	}
+
+	// read again from the file
+	data, offset, err = logger.ReadOlder(context.Background(), 18, 10)
+	if err != nil || string(data) != "line3\n" || offset != 12 {
+		t.Errorf("Expected: %q at 12. Actual: %q at %d %v", "line3\n", data, offset, err)
+	}
+
+	data, offset, err = logger.ReadOlder(context.Background(), 12, 100)
+	if err != nil || string(data) != "line1\nline2\n" || offset != 0 {
+		t.Errorf("Expected: %q at 0. Actual: %q at %d %v", "line1\nline2\n", data, offset, err)
+	}
+
+	if _, _, err := logger.ReadOlder(context.Background(), 0, 100); err != ErrNoOlderData {
+		t.Errorf("Expected: %s. Actual: %v", ErrNoOlderData, err)
+	}
+
+	// the file is rotated: the lines of the previous file are read from the cache only
+	logger.Rewind()
+	logger.cache.Write([]byte("new1\n"))
+	data, offset, err = logger.ReadOlder(context.Background(), 30, 100)
+	if err != nil || string(data) != "line5\n" || offset != 24 {
+		t.Errorf("Expected: %q at 24. Actual: %q at %d %v", "line5\n", data, offset, err)
+	}
+	if _, _, err := logger.ReadOlder(context.Background(), 24, 100); err != ErrNoOlderData {
+		t.Errorf("Expected: %s. Actual: %v", ErrNoOlderData, err)
+	}
+}
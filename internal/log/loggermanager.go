@@ -1,8 +1,12 @@
 package log
 
 import (
+	"context"
 	"errors"
-	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/tupyy/lazylogger/internal/conf"
@@ -14,39 +18,104 @@ const RequestDataMaxSize = 1024 * 150 // 150 kB
 
 // LoggerManager handles the loggers and write any new data received from loggers to Gui LogWriter implementations.
 // A logger is created (and ssh connection dialed) only when is registered to a view. It will still run after the view unregistered.
+// LoggerManager is safe for concurrent use.
 type LoggerManager struct {
 
+	// protects loggers, clients, connecting, writers and stopped.
+	// It is not held while the writers are called: a writer can call back into the manager or wait for the UI.
+	mutex *sync.Mutex
+
 	// map of loggers
 	loggers map[int]*Logger
 
 	// manage ssh connections
 	sshPool *ssh.SSHPool
 
+	// ssh client used by each logger
+	clients map[int]*ssh.Client
+
+	// fetches the sizes of the files watched through the same ssh client with one command
+	pollers map[*ssh.Client]*hostPoller
+
 	// channel to received data notification from loggers
 	in chan interface{}
 
 	// holds a map with registered writers. A writer can represent a textview or stdout
 	writers map[LogWriter]int
 
+	// offset of the oldest data written to each writer. Older data is written by Backfill.
+	oldest map[LogWriter]int64
+
+	// calls waiting to be made to each writer
+	queues map[LogWriter]*writerQueue
+
+	// connections being dialed for each logger. Concurrent calls to Connect wait for the same connection.
+	connecting map[int]*connectCall
+
+	// true once Stop has been called
+	stopped bool
+
+	// maximum number of bytes allocated by the caches of all the loggers. No limit if zero.
+	cacheBudget int64
+
+	// file where the positions of the loggers are saved. Nothing is saved if empty.
+	statePath string
+
+	// positions saved by service name
+	states map[string]serviceState
+
+	// true if the loggers start from the saved positions
+	resume bool
+
 	done chan interface{}
 
 	configurations map[int]conf.LoggerConfiguration
 }
 
-// LogWriter is an interface that extends Writer interface by adding
-// a method to handle the change in state of the logger.
+// LogWriter receives the lines of a logger as records and the changes in state and poll interval of the logger.
+// The writers written with raw data are registered through a ByteWriterAdapter.
 type LogWriter interface {
-	io.Writer
+	WriteRecords(records []Record)
 	SetState(state string, err error)
+	SetPollInterval(interval time.Duration)
+}
+
+// writerQueue holds the calls to a writer so they are made in order without holding the mutex of the manager.
+// The calls are made by one goroutine at a time: the one which queued a call while no other was making them.
+type writerQueue struct {
+	writer LogWriter
+	calls  []func(w LogWriter)
+
+	// true while a goroutine makes the calls
+	running bool
+}
+
+// connectCall is a connection being dialed for a logger. The dial is canceled once no caller waits for it anymore.
+type connectCall struct {
+	// closed when err is set
+	done chan struct{}
+	err  error
+
+	// number of callers waiting for the dial. It is protected by the mutex of the manager.
+	waiters  int
+	cancel   context.CancelFunc
+	canceled bool
 }
 
 func NewLoggerManager(configurations []conf.LoggerConfiguration) *LoggerManager {
 
 	lm := &LoggerManager{
+		mutex:          &sync.Mutex{},
 		loggers:        make(map[int]*Logger),
 		sshPool:        ssh.NewSSHPool(),
+		clients:        make(map[int]*ssh.Client),
+		pollers:        make(map[*ssh.Client]*hostPoller),
+		connecting:     make(map[int]*connectCall),
 		in:             make(chan interface{}),
 		writers:        make(map[LogWriter]int),
+		oldest:         make(map[LogWriter]int64),
+		queues:         make(map[LogWriter]*writerQueue),
+		states:         make(map[string]serviceState),
 		done:           make(chan interface{}),
 		configurations: mapFromArray(configurations),
 	}
@@ -54,41 +123,396 @@ func NewLoggerManager(configurations []conf.LoggerConfiguration) *LoggerManager
 	return lm
 }
 
-// CreateLoggers returns the number of loggers created.
-func (lm *LoggerManager) CreateLogger(id int, conf conf.LoggerConfiguration) (*Logger, error) {
+// CreateLogger connects the host of the service and starts its logger. The dial is aborted as soon as ctx is done.
+func (lm *LoggerManager) CreateLogger(ctx context.Context, id int, conf conf.LoggerConfiguration) (*Logger, error) {
+	if conf.IsMerged() {
+		return lm.createMerged(ctx, id, conf)
+	}
+
+	client, err := lm.sshPool.Connect(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := NewRemoteReader(client, conf)
+	reader.poller = lm.hostPoller(client)
+
+	return lm.startLogger(id, conf, reader, client)
+}
+
+// createMerged connects the services merged by the service id and starts a logger writing their lines
+// sorted by timestamp. The services which cannot be connected are left out, unless their host key must be trusted.
+func (lm *LoggerManager) createMerged(ctx context.Context, id int, c conf.LoggerConfiguration) (*Logger, error) {
+	names := make(map[int]string)
+	var connectErr error
+	for _, name := range c.Merge {
+		sourceID, ok := lm.serviceID(name)
+		if !ok {
+			return nil, fmt.Errorf("merged service %s not found", name)
+		}
+		if lm.configurations[sourceID].IsMerged() {
+			return nil, fmt.Errorf("merged service %s merges other services", name)
+		}
+
+		if err := lm.Connect(ctx, sourceID); err != nil {
+			var hostKeyErr *ssh.UnknownHostKeyError
+			if errors.As(err, &hostKeyErr) || err == ctx.Err() {
+				return nil, err
+			}
+			glog.Warningf("cannot connect merged service %s: %s", name, err)
+			if connectErr == nil {
+				connectErr = err
+			}
+			continue
+		}
+		names[sourceID] = name
+	}
+	if len(names) == 0 {
+		if connectErr == nil {
+			connectErr = errors.New("no service to merge")
+		}
+		return nil, connectErr
+	}
+
+	logger, err := NewLogger(id, lm.in, c.Poll, int(c.CacheSize))
+	if err != nil {
+		return nil, err
+	}
+	logger.source = Source{Name: c.Name}
+	// the merged logger doesn't poll
+	logger.interval = 0
+
+	m := newMerger(logger, c, names)
+
+	if c.Spill.IsEnabled() {
+		if err := logger.spillTo(c); err != nil {
+			glog.Errorf("cannot spill cache of logger %d to disk: %s", id, err)
+		}
+	}
+
+	lm.mutex.Lock()
+	if lm.stopped {
+		lm.mutex.Unlock()
+		// removes the spill directory
+		logger.cache.clear()
+		return logger, nil
+	}
+	logger.startMerger(m)
+	lm.loggers[id] = logger
+	lm.mutex.Unlock()
+
+	for sourceID := range names {
+		if err := lm.RegisterWriter(sourceID, &mergeSource{m: m, id: sourceID}); err != nil {
+			glog.Warningf("cannot merge logger %d: %s", sourceID, err)
+		}
+	}
+
+	return logger, nil
+}
+
+// serviceID returns the id of the service name.
+func (lm *LoggerManager) serviceID(name string) (int, bool) {
+	for id, c := range lm.configurations {
+		if c.Name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// hostPoller returns the poller of the client. It is created if it doesn't exist.
+func (lm *LoggerManager) hostPoller(client *ssh.Client) *hostPoller {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	p, ok := lm.pollers[client]
+	if !ok {
+		p = newHostPoller(sshRunner{client})
+		lm.pollers[client] = p
+	}
+	return p
+}
 
-	client, err := lm.sshPool.Connect(conf)
+// startLogger starts a logger reading from reader and adds it to the loggers.
+// The logger is not started if the manager has been stopped while connecting.
+func (lm *LoggerManager) startLogger(id int, c conf.LoggerConfiguration, reader FileReader, client *ssh.Client) (*Logger, error) {
+	logger, err := NewLogger(id, lm.in, c.Poll, int(c.CacheSize))
 	if err != nil {
 		return nil, err
 	}
+	logger.source = Source{Name: c.Name, Host: c.Host.Address, File: c.File}
+	if client != nil {
+		logger.source.ClockOffset, _, _ = client.ClockOffset()
+	}
+
+	if c.Spill.IsEnabled() {
+		if err := logger.spillTo(c); err != nil {
+			glog.Errorf("cannot spill cache of logger %d to disk: %s", id, err)
+		}
+	}
+
+	if s, ok := lm.savedState(c); ok {
+		if r, ok := reader.(resumableReader); ok {
+			if err := logger.resume(context.Background(), r, s, maxCatchUp(c.Resume)); err != nil {
+				glog.Warningf("cannot resume logger %d: %s", id, err)
+			}
+		}
+	}
 
-	remoteReader := NewRemoteReader(client, conf.File)
-	logger := NewLogger(id, lm.in)
-	logger.Start(remoteReader)
+	lm.mutex.Lock()
+	if lm.stopped {
+		lm.removeUnusedPoller(client)
+		lm.mutex.Unlock()
+		// removes the spill directory
+		logger.cache.clear()
+		return logger, nil
+	}
+
+	logger.Start(reader)
+	previous, reconnected := lm.loggers[id]
+	previousClient := lm.clients[id]
 	lm.loggers[id] = logger
+	lm.clients[id] = client
+	// the poller of the previous connection is dropped with it
+	if previousClient != client {
+		lm.removeUnusedPoller(previousClient)
+	}
+	lm.mutex.Unlock()
+
+	if reconnected {
+		previous.Stop()
+	}
 
 	return logger, nil
 }
 
+// CertificateExpiry returns the end of validity of the certificate used by the connection of the logger.
+// It returns false if the logger is not found or its connection doesn't use an expiring certificate.
+func (lm *LoggerManager) CertificateExpiry(id int) (time.Time, bool) {
+	lm.mutex.Lock()
+	client, ok := lm.clients[id]
+	lm.mutex.Unlock()
+
+	if !ok || client == nil {
+		return time.Time{}, false
+	}
+	return client.CertificateExpiry()
+}
+
+// LoggerState returns the state of the logger id. It returns false if the logger is not running.
+func (lm *LoggerManager) LoggerState(id int) (State, bool) {
+	lm.mutex.Lock()
+	logger, ok := lm.loggers[id]
+	lm.mutex.Unlock()
+
+	if !ok {
+		return State{}, false
+	}
+	return logger.GetState(), true
+}
+
+// HostInfo describes a connection shared by running loggers.
+type HostInfo struct {
+	Address string
+	User    string
+
+	// clock of the host minus the local clock and round trip of its measure. ClockMeasured is false if unknown.
+	ClockOffset   time.Duration
+	RoundTrip     time.Duration
+	ClockMeasured bool
+
+	// names of the services reading through the connection, sorted
+	Services []string
+}
+
+// Hosts returns the connections of the running loggers sorted by address.
+func (lm *LoggerManager) Hosts() []HostInfo {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	byClient := make(map[*ssh.Client]*HostInfo)
+	for id, client := range lm.clients {
+		if client == nil {
+			continue
+		}
+		c := lm.configurations[id]
+
+		h, ok := byClient[client]
+		if !ok {
+			h = &HostInfo{Address: c.Host.String(), User: c.Host.Username}
+			h.ClockOffset, h.RoundTrip, h.ClockMeasured = client.ClockOffset()
+			byClient[client] = h
+		}
+		h.Services = append(h.Services, c.Name)
+	}
+
+	hosts := make([]HostInfo, 0, len(byClient))
+	for _, h := range byClient {
+		sort.Strings(h.Services)
+		hosts = append(hosts, *h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Address != hosts[j].Address {
+			return hosts[i].Address < hosts[j].Address
+		}
+		return hosts[i].User < hosts[j].User
+	})
+	return hosts
+}
+
+// SetPromptFunc sets the function used to ask the user for the secrets missing from the configuration.
+// While the user is asked, the connection of the logger is suspended.
+func (lm *LoggerManager) SetPromptFunc(prompt ssh.PromptFunc) {
+	lm.sshPool.SetPromptFunc(prompt)
+}
+
+// SetCacheBudget sets the maximum number of bytes allocated by the caches of all the loggers.
+// Above the budget, the oldest lines of the idle loggers are evicted first. No limit if zero.
+func (lm *LoggerManager) SetCacheBudget(budget int64) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.cacheBudget = budget
+}
+
+// SetStateFile reads the positions saved in path by the previous run. The positions of the loggers are saved in it
+// periodically and when the manager stops. If the file cannot be read, it is overwritten by the next save.
+func (lm *LoggerManager) SetStateFile(path string) error {
+	states, err := readStateFile(path)
+	if err != nil {
+		states = make(map[string]serviceState)
+	}
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.statePath = path
+	lm.states = states
+	return err
+}
+
+// ResumableServices returns the names of the services which can resume from the position saved by the previous run.
+func (lm *LoggerManager) ResumableServices() []string {
+	var names []string
+	for _, c := range lm.configurations {
+		if _, ok := lm.lookupState(c); ok {
+			names = append(names, c.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetResume sets whether the loggers start from the positions saved by the previous run or from the beginning of the files.
+func (lm *LoggerManager) SetResume(resume bool) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.resume = resume
+}
+
+// savedState returns the position to resume the service from. It returns false if the loggers don't resume.
+func (lm *LoggerManager) savedState(c conf.LoggerConfiguration) (serviceState, bool) {
+	lm.mutex.Lock()
+	resume := lm.resume
+	lm.mutex.Unlock()
+
+	if !resume {
+		return serviceState{}, false
+	}
+	return lm.lookupState(c)
+}
+
+// lookupState returns the position saved for the service if it resumes and the position is for the same file.
+func (lm *LoggerManager) lookupState(c conf.LoggerConfiguration) (serviceState, bool) {
+	if !c.Resume.IsEnabled() {
+		return serviceState{}, false
+	}
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	s, ok := lm.states[c.Name]
+	if !ok || s.Host != c.Host.Address || s.File != c.File {
+		return serviceState{}, false
+	}
+	return s, true
+}
+
+// SaveState writes the positions of the loggers in the state file. The positions of the services
+// not running are kept.
+func (lm *LoggerManager) SaveState() error {
+	lm.mutex.Lock()
+	path := lm.statePath
+	states := lm.updateStates(lm.loggers)
+	lm.mutex.Unlock()
+
+	if len(path) == 0 {
+		return nil
+	}
+	return writeStateFile(path, states)
+}
+
+// updateStates records the positions of loggers and returns a copy of all the positions. The mutex must be held.
+func (lm *LoggerManager) updateStates(loggers map[int]*Logger) map[string]serviceState {
+	for id, l := range loggers {
+		c := lm.configurations[id]
+		if !c.Resume.IsEnabled() || len(c.Name) == 0 {
+			continue
+		}
+		s, ok := l.resumeState(c.Resume.Window)
+		if !ok {
+			continue
+		}
+		s.Host = c.Host.Address
+		s.File = c.File
+		lm.states[c.Name] = s
+	}
+
+	states := make(map[string]serviceState, len(lm.states))
+	for name, s := range lm.states {
+		states[name] = s
+	}
+	return states
+}
+
 func (lm *LoggerManager) GetConfigurations() map[int]conf.LoggerConfiguration {
 	return lm.configurations
 }
 
 func (lm *LoggerManager) Run() {
+	save := time.NewTicker(StateSaveInterval)
+	defer save.Stop()
+
 	for {
 		select {
+		case <-save.C:
+			if err := lm.SaveState(); err != nil {
+				glog.Warningf("cannot save state: %s", err)
+			}
 		case n := <-lm.in:
 			switch v := n.(type) {
 			case DataNotification:
 				glog.V(3).Infof("DataNotification received from %d", v.ID)
-				data, _ := lm.RequestData(v.ID, v.PreviousSize, int(v.Size-v.PreviousSize))
-				for l, _ := range lm.writers {
-					l.Write(data)
+				lm.mutex.Lock()
+				_, ok := lm.loggers[v.ID]
+				var queues []*writerQueue
+				if ok {
+					queues = lm.queueCall(v.ID, func(w LogWriter) { w.WriteRecords(v.Records) })
 				}
-			case State:
-				for l, _ := range lm.writers {
-					l.SetState(v.String(), v.Err)
+				lm.mutex.Unlock()
+				lm.makeCalls(queues)
+
+				if ok {
+					lm.enforceCacheBudget(v.ID)
 				}
+			case State:
+				lm.mutex.Lock()
+				queues := lm.queueCall(v.ID, func(w LogWriter) { w.SetState(v.String(), v.Err) })
+				lm.mutex.Unlock()
+				lm.makeCalls(queues)
+			case PollNotification:
+				lm.mutex.Lock()
+				queues := lm.queueCall(v.ID, func(w LogWriter) { w.SetPollInterval(v.Interval) })
+				lm.mutex.Unlock()
+				lm.makeCalls(queues)
 			}
 		case <-lm.done:
 			return
@@ -96,49 +520,241 @@ func (lm *LoggerManager) Run() {
 	}
 }
 
-func (lm *LoggerManager) RegisterWriter(loggerID int, w LogWriter) error {
-	l, ok := lm.loggers[loggerID]
+// Connect creates the logger if it is not running yet. Dialing the host can take a while and can ask the user
+// for credentials so Connect is meant to be called outside the event loop, before RegisterWriter.
+// Connect returns as soon as ctx is done. The dial, shared by the concurrent calls, is aborted once all of them
+// have returned.
+func (lm *LoggerManager) Connect(ctx context.Context, loggerID int) error {
+	conf, ok := lm.configurations[loggerID]
 	if !ok {
-		if conf, ok := lm.configurations[loggerID]; ok {
-			logger, err := lm.CreateLogger(loggerID, conf)
-			if err != nil {
-				return err
+		return errors.New("logger not found")
+	}
+
+	for {
+		lm.mutex.Lock()
+		if lm.stopped {
+			lm.mutex.Unlock()
+			return errors.New("logger manager stopped")
+		}
+		if _, ok := lm.loggers[loggerID]; ok {
+			lm.mutex.Unlock()
+			return nil
+		}
+
+		call, ok := lm.connecting[loggerID]
+		if ok && call.canceled {
+			// wait for the canceled dial to return and dial again
+			lm.mutex.Unlock()
+			select {
+			case <-call.done:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			l = logger
-		} else {
-			return errors.New("logger not found")
+		}
+		if !ok {
+			call = lm.dial(loggerID, conf)
+		}
+		call.waiters++
+		lm.mutex.Unlock()
+
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			lm.mutex.Lock()
+			call.waiters--
+			if call.waiters == 0 {
+				call.canceled = true
+				call.cancel()
+			}
+			lm.mutex.Unlock()
+			return ctx.Err()
 		}
 	}
+}
+
+// dial starts the creation of the logger. The mutex must be held.
+func (lm *LoggerManager) dial(loggerID int, c conf.LoggerConfiguration) *connectCall {
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &connectCall{done: make(chan struct{}), cancel: cancel}
+	lm.connecting[loggerID] = call
+
+	go func() {
+		_, err := lm.CreateLogger(ctx, loggerID, c)
+		cancel()
+
+		lm.mutex.Lock()
+		delete(lm.connecting, loggerID)
+		call.err = err
+		lm.mutex.Unlock()
+		close(call.done)
+	}()
+
+	return call
+}
+
+func (lm *LoggerManager) RegisterWriter(loggerID int, w LogWriter) error {
+	if err := lm.Connect(context.Background(), loggerID); err != nil {
+		return err
+	}
+
+	lm.mutex.Lock()
+	l, ok := lm.loggers[loggerID]
+	if !ok {
+		lm.mutex.Unlock()
+		return errors.New("logger not found")
+	}
 
 	lm.writers[w] = loggerID
 
-	// request min(l.CacheSize, RequestDataMaxSize)
-	cacheSize := l.CacheSize()
-	requestSize := cacheSize
-	offset := 0
-	if cacheSize > RequestDataMaxSize {
-		requestSize = RequestDataMaxSize
-		offset = cacheSize - RequestDataMaxSize
+	// request min(l.CacheSize, RequestDataMaxSize) from the end of the cache
+	_, offset, end := l.Offsets()
+	if end-offset > RequestDataMaxSize {
+		offset = end - RequestDataMaxSize
 	}
 
-	data, _ := lm.RequestData(loggerID, int64(offset), requestSize)
-	w.Write(data)
+	records := l.RequestRecords(offset, int(end-offset))
+	lm.oldest[w] = offset
 
-	w.SetState(l.State.String(), l.State.Err)
+	state := l.GetState()
+	interval := l.PollInterval()
+
+	// the calls queued for the previous logger of w are dropped.
+	// The lines received meanwhile are queued after the lines of the cache.
+	q := &writerQueue{writer: w, running: true}
+	q.calls = append(q.calls,
+		func(w LogWriter) { w.WriteRecords(records) },
+		func(w LogWriter) { w.SetState(state.String(), state.Err) },
+		func(w LogWriter) { w.SetPollInterval(interval) })
+	lm.queues[w] = q
+	lm.mutex.Unlock()
+
+	lm.makeCalls([]*writerQueue{q})
 	return nil
 }
 
+// UnregisterWriter removes lw from its logger. No call to lw starts after UnregisterWriter has returned.
 func (lm *LoggerManager) UnregisterWriter(lw LogWriter) error {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	lm.removeWriter(lw)
+	return nil
+}
+
+// removeWriter removes w and drops the calls queued to it. The mutex must be held.
+func (lm *LoggerManager) removeWriter(w LogWriter) {
+	delete(lm.writers, w)
+	delete(lm.oldest, w)
+	delete(lm.queues, w)
+}
 
-	if _, ok := lm.writers[lw]; ok {
-		delete(lm.writers, lw)
+// queueCall queues call to the writers of the logger id. It returns the queues whose calls must be made by the caller
+// with makeCalls. The mutex must be held.
+func (lm *LoggerManager) queueCall(id int, call func(w LogWriter)) []*writerQueue {
+	var queues []*writerQueue
+	for w, loggerID := range lm.writers {
+		if loggerID != id {
+			continue
+		}
+
+		q, ok := lm.queues[w]
+		if !ok {
+			q = &writerQueue{writer: w}
+			lm.queues[w] = q
+		}
+		q.calls = append(q.calls, call)
+		if !q.running {
+			q.running = true
+			queues = append(queues, q)
+		}
 	}
+	return queues
+}
 
-	return nil
+// makeCalls makes the calls of queues, including the calls queued meanwhile, without holding the mutex.
+// The calls of a queue are dropped once its writer has been unregistered or registered again.
+func (lm *LoggerManager) makeCalls(queues []*writerQueue) {
+	for _, q := range queues {
+		for {
+			lm.mutex.Lock()
+			if lm.queues[q.writer] != q || len(q.calls) == 0 {
+				q.running = false
+				lm.mutex.Unlock()
+				break
+			}
+			call := q.calls[0]
+			q.calls = q.calls[1:]
+			lm.mutex.Unlock()
+
+			call(q.writer)
+		}
+	}
+}
+
+// Backfill returns the records of at most size bytes of the lines received by the logger of w before the oldest line written to w.
+// The lines evicted from the cache are read again from the file. It returns ErrNoOlderData if there is no older line.
+// The file can be read by a remote command so Backfill is meant to be called outside the event loop.
+func (lm *LoggerManager) Backfill(w LogWriter, size int) ([]Record, error) {
+	return lm.backfill(w, func(logger *Logger, before int64) ([]byte, int64, error) {
+		return logger.ReadOlder(context.Background(), before, size)
+	})
+}
+
+// DroppedBefore tells that the oldest line of w begins at offset: w has dropped the lines before it to bound its memory.
+// Backfill returns them again.
+func (lm *LoggerManager) DroppedBefore(w LogWriter, offset int64) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	if _, ok := lm.writers[w]; ok {
+		lm.oldest[w] = offset
+	}
+}
+
+// BackfillCache is Backfill without reading the file: only the lines still held in the cache are returned.
+// It returns ErrNoOlderData once the oldest line of the cache has been written to w.
+func (lm *LoggerManager) BackfillCache(w LogWriter, size int) ([]Record, error) {
+	return lm.backfill(w, func(logger *Logger, before int64) ([]byte, int64, error) {
+		return logger.ReadCached(before, size)
+	})
+}
+
+// backfill returns the records of the lines returned by read before the oldest line written to w.
+func (lm *LoggerManager) backfill(w LogWriter, read func(logger *Logger, before int64) ([]byte, int64, error)) ([]Record, error) {
+	lm.mutex.Lock()
+	id, ok := lm.writers[w]
+	logger := lm.loggers[id]
+	before := lm.oldest[w]
+	lm.mutex.Unlock()
+
+	if !ok || logger == nil {
+		return nil, errors.New("writer not registered")
+	}
+
+	data, offset, err := read(logger, before)
+	if err != nil {
+		return nil, err
+	}
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	// the writer has been registered to another logger or has been backfilled meanwhile
+	if current, ok := lm.writers[w]; !ok || current != id || lm.loggers[id] != logger || lm.oldest[w] != before {
+		return nil, errors.New("writer changed while reading older data")
+	}
+	lm.oldest[w] = offset
+
+	return logger.records(data, offset, time.Time{}), nil
 }
 
 func (lm *LoggerManager) RequestData(id int, offset int64, size int) ([]byte, error) {
+	lm.mutex.Lock()
 	logger, ok := lm.loggers[id]
+	lm.mutex.Unlock()
+
 	if !ok {
 		return []byte{}, errors.New("logger not found")
 	}
@@ -147,24 +763,151 @@ func (lm *LoggerManager) RequestData(id int, offset int64, size int) ([]byte, er
 	return data, nil
 }
 
-// Close all the loggers
+// Stats returns the stats of the running loggers sorted by id.
+func (lm *LoggerManager) Stats() []LoggerStats {
+	lm.mutex.Lock()
+	loggers := make([]*Logger, 0, len(lm.loggers))
+	for _, l := range lm.loggers {
+		loggers = append(loggers, l)
+	}
+	lm.mutex.Unlock()
+
+	stats := make([]LoggerStats, 0, len(loggers))
+	for _, l := range loggers {
+		s, ok := l.Stats()
+		if !ok {
+			continue
+		}
+		c := lm.configurations[l.ID]
+		stats = append(stats, LoggerStats{ID: l.ID, Name: c.Name, Host: c.Host.Address, File: c.File, Stats: s})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// enforceCacheBudget shrinks the caches until they fit in the cache budget.
+// The loggers without writer are shrunk first, then the loggers written the longest time ago.
+// The logger which has just written is shrunk last. The caches are shrunk without holding the mutex:
+// the data evicted may be spilled to disk.
+func (lm *LoggerManager) enforceCacheBudget(lastID int) {
+	loggers, excess := lm.cacheShrinkTargets(lastID)
+
+	for _, l := range loggers {
+		if excess <= 0 {
+			break
+		}
+		freed := l.cache.shrink(excess)
+		glog.V(2).Infof("Cache budget exceeded. %d bytes freed from logger %d", freed, l.ID)
+		excess -= freed
+	}
+}
+
+// cacheShrinkTargets returns the loggers in the order they are shrunk and the number of bytes above the cache budget.
+func (lm *LoggerManager) cacheShrinkTargets(lastID int) ([]*Logger, int64) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	if lm.cacheBudget <= 0 {
+		return nil, 0
+	}
+
+	var total int64
+	loggers := make([]*Logger, 0, len(lm.loggers))
+	for _, l := range lm.loggers {
+		total += l.cache.Memory()
+		loggers = append(loggers, l)
+	}
+	if total <= lm.cacheBudget {
+		return nil, 0
+	}
+
+	watched := make(map[int]bool)
+	for _, id := range lm.writers {
+		watched[id] = true
+	}
+
+	sort.Slice(loggers, func(i, j int) bool {
+		a, b := loggers[i], loggers[j]
+		if (a.ID == lastID) != (b.ID == lastID) {
+			return b.ID == lastID
+		}
+		if watched[a.ID] != watched[b.ID] {
+			return watched[b.ID]
+		}
+		return a.cache.LastWrite().Before(b.cache.LastWrite())
+	})
+
+	return loggers, total - lm.cacheBudget
+}
+
+// Close all the loggers and stop Run. Calling Stop more than once has no effect.
 func (lm *LoggerManager) Stop() {
-	for _, logger := range lm.loggers {
+	lm.mutex.Lock()
+	if lm.stopped {
+		lm.mutex.Unlock()
+		return
+	}
+	lm.stopped = true
+	loggers := lm.loggers
+	path := lm.statePath
+	states := lm.updateStates(loggers)
+	lm.loggers = make(map[int]*Logger)
+	lm.clients = make(map[int]*ssh.Client)
+	lm.pollers = make(map[*ssh.Client]*hostPoller)
+	lm.writers = make(map[LogWriter]int)
+	lm.queues = make(map[LogWriter]*writerQueue)
+	lm.mutex.Unlock()
+
+	if len(path) > 0 {
+		if err := writeStateFile(path, states); err != nil {
+			glog.Warningf("cannot save state: %s", err)
+		}
+	}
+
+	// the loggers are stopped without holding the mutex because Run must keep reading
+	// the notifications the fetchers could be sending.
+	for _, logger := range loggers {
 		logger.Stop()
-		logger = nil
 	}
 
-	lm.loggers = make(map[int]*Logger)
-	lm.done <- struct{}{}
+	close(lm.done)
+}
+
+// removeUnusedPoller removes the poller of client if no logger uses the client anymore.
+// The mutex must be held.
+func (lm *LoggerManager) removeUnusedPoller(client *ssh.Client) {
+	for _, c := range lm.clients {
+		if c == client {
+			return
+		}
+	}
+	delete(lm.pollers, client)
 }
 
 // StopLogger stops a loggers and returns its id if service found.
 func (lm *LoggerManager) stopLogger(id int) int {
+	lm.mutex.Lock()
 	logger, ok := lm.loggers[id]
+	client := lm.clients[id]
+	if ok {
+		lm.updateStates(map[int]*Logger{id: logger})
+	}
+	for w := range lm.writers {
+		if s, isSource := w.(*mergeSource); isSource && s.m.logger == logger {
+			lm.removeWriter(w)
+		}
+	}
+	delete(lm.loggers, id)
+	delete(lm.clients, id)
+	lm.removeUnusedPoller(client)
+	lm.mutex.Unlock()
+
 	if ok {
 		glog.Infof("Stopping logger %d", logger.ID)
 		logger.Stop()
-		delete(lm.loggers, id)
 		return logger.ID
 	}
 
@@ -0,0 +1,508 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"github.com/tupyy/lazylogger/internal/ssh"
+)
+
+// growingReader is a FileReader safe for concurrent use. The file grows by a line of chunkSize bytes of b at each fetch.
+type growingReader struct {
+	mutex     *sync.Mutex
+	b         byte
+	chunkSize int32
+	size      int32
+	bytesRead int32
+}
+
+func newGrowingReader(b byte, chunkSize int32) *growingReader {
+	return &growingReader{mutex: &sync.Mutex{}, b: b, chunkSize: chunkSize}
+}
+
+func (g *growingReader) FetchSize(ctx context.Context) (int32, error, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.bytesRead + g.chunkSize, nil, nil
+}
+
+func (g *growingReader) GetSize() int32 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.size
+}
+
+func (g *growingReader) SetSize(size int32) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.size = size
+}
+
+func (g *growingReader) HasNextChunk() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.bytesRead < g.size
+}
+
+func (g *growingReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	n := g.size - g.bytesRead
+	g.bytesRead = g.size
+	return append(bytes.Repeat([]byte{g.b}, int(n)-1), '\n'), nil, nil
+}
+
+func (g *growingReader) Close() {}
+
+func (g *growingReader) Rewind() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.bytesRead = 0
+	g.size = 0
+}
+
+// recordWriter is a LogWriter recording the records written.
+type recordWriter struct {
+	mutex   *sync.Mutex
+	records []Record
+	state   string
+}
+
+func newRecordWriter() *recordWriter {
+	return &recordWriter{mutex: &sync.Mutex{}}
+}
+
+func (r *recordWriter) WriteRecords(records []Record) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records = append(r.records, records...)
+}
+
+func (r *recordWriter) SetState(state string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state = state
+}
+
+func (r *recordWriter) SetPollInterval(interval time.Duration) {}
+
+func (r *recordWriter) Data() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return JoinLines(r.records)
+}
+
+func (r *recordWriter) Records() []Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Record{}, r.records...)
+}
+
+func newTestLoggerManager(n int) *LoggerManager {
+	lm := NewLoggerManager(make([]conf.LoggerConfiguration, n))
+	for i := 0; i < n; i++ {
+		lm.startLogger(i, conf.LoggerConfiguration{}, newGrowingReader(byte('a'+i), 100), nil)
+	}
+	return lm
+}
+
+func TestLoggerManagerConcurrentWriters(t *testing.T) {
+	const loggers = 4
+
+	lm := newTestLoggerManager(loggers)
+	go lm.Run()
+
+	// one writer stays registered to each logger
+	writers := make([]*recordWriter, loggers)
+	for i := range writers {
+		writers[i] = newRecordWriter()
+		if err := lm.RegisterWriter(i, writers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other writers move from one logger to another while data is received
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := newRecordWriter()
+			for k := 0; ; k++ {
+				select {
+				case <-done:
+					lm.UnregisterWriter(w)
+					return
+				default:
+				}
+
+				id := (i + k) % loggers
+				if err := lm.RegisterWriter(id, w); err != nil {
+					t.Error(err)
+				}
+				lm.RequestData(id, 0, 10)
+				lm.CertificateExpiry(id)
+				lm.UnregisterWriter(w)
+			}
+		}(i)
+	}
+
+	<-time.After(2500 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	lm.Stop()
+
+	for i, w := range writers {
+		data := w.Data()
+		if len(data) == 0 {
+			t.Errorf("Expected: data from logger %d. Actual: no data", i)
+		}
+		if len(bytes.Trim(data, string(rune('a'+i))+"\n")) > 0 {
+			t.Errorf("Expected: only data from logger %d. Actual: %q", i, data)
+		}
+	}
+}
+
+func TestLoggerManagerStop(t *testing.T) {
+	lm := newTestLoggerManager(2)
+	go lm.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lm.Stop()
+		}()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected: Stop returns. Actual: Stop blocked")
+	}
+
+	if err := lm.Connect(context.Background(), 0); err == nil {
+		t.Error("Expected: error connecting a stopped manager. Actual: nil")
+	}
+
+	if _, err := lm.RequestData(0, 0, 10); err == nil {
+		t.Error("Expected: logger not found. Actual: nil")
+	}
+}
+
+func TestLoggerManagerCacheBudget(t *testing.T) {
+	lm := NewLoggerManager(make([]conf.LoggerConfiguration, 3))
+	lm.SetCacheBudget(10 * 1024)
+
+	line := append(bytes.Repeat([]byte{'a'}, 99), '\n')
+	for id := 0; id < 3; id++ {
+		l, err := NewLogger(id, lm.in, conf.Poll{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 40; i++ {
+			l.cache.Write(line)
+		}
+		lm.loggers[id] = l
+	}
+
+	// logger 0 is idle, logger 1 is watched and logger 2 has just written
+	lm.writers[newRecordWriter()] = 1
+
+	lm.enforceCacheBudget(2)
+
+	memory := func(id int) int64 {
+		return lm.loggers[id].cache.Memory()
+	}
+	if total := memory(0) + memory(1) + memory(2); total > 10*1024 {
+		t.Errorf("Expected: at most %d bytes allocated. Actual: %d", 10*1024, total)
+	}
+	if memory(0) != 2*1024 {
+		t.Errorf("Expected: idle logger shrunk to 2 KB. Actual: %d", memory(0))
+	}
+	if memory(1) != 4*1024 || memory(2) != 4*1024 {
+		t.Errorf("Expected: other loggers untouched. Actual: %d %d", memory(1), memory(2))
+	}
+
+	// the idle logger doesn't free enough: the watched logger is shrunk next
+	lm.SetCacheBudget(5 * 1024)
+	lm.enforceCacheBudget(2)
+
+	if memory(0) != 0 || memory(1) != 1024 || memory(2) != 4*1024 {
+		t.Errorf("Expected: 0, 1024 and 4096 bytes allocated. Actual: %d %d %d", memory(0), memory(1), memory(2))
+	}
+}
+
+func TestLoggerManagerPollerReconnect(t *testing.T) {
+	c := conf.LoggerConfiguration{Name: "app"}
+	lm := NewLoggerManager([]conf.LoggerConfiguration{c})
+	go lm.Run()
+	defer lm.Stop()
+
+	first, second := &ssh.Client{}, &ssh.Client{}
+	lm.hostPoller(first)
+	lm.startLogger(0, c, newGrowingReader('a', 10), first)
+
+	// the logger is started again on a new connection
+	lm.hostPoller(second)
+	lm.startLogger(0, c, newGrowingReader('b', 10), second)
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	if _, ok := lm.pollers[first]; ok || len(lm.pollers) != 1 {
+		t.Errorf("Expected: only the poller of the new connection. Actual: %d pollers", len(lm.pollers))
+	}
+}
+
+// callbackWriter is a recordWriter calling back into the manager when it is written.
+type callbackWriter struct {
+	*recordWriter
+	lm *LoggerManager
+}
+
+func (c *callbackWriter) WriteRecords(records []Record) {
+	c.lm.Stats()
+	c.recordWriter.WriteRecords(records)
+}
+
+func TestLoggerManagerWriterCallback(t *testing.T) {
+	lm := newTestLoggerManager(1)
+	go lm.Run()
+	defer lm.Stop()
+
+	w := &callbackWriter{recordWriter: newRecordWriter(), lm: lm}
+	if err := lm.RegisterWriter(0, w); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.Records()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected: records written. Actual: the manager is blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lm.UnregisterWriter(w)
+
+	// the records are written in order
+	records := w.Records()
+	var offset int64
+	for _, r := range records {
+		if r.Offset != offset {
+			t.Errorf("Expected: offset %d. Actual: %d", offset, r.Offset)
+		}
+		offset += int64(len(r.Line))
+	}
+
+	// nothing is written after the writer is unregistered
+	time.Sleep(300 * time.Millisecond)
+	if n := len(w.Records()); n != len(records) {
+		t.Errorf("Expected: %d records. Actual: %d", len(records), n)
+	}
+}
+
+func TestLoggerManagerBackfill(t *testing.T) {
+	lm := NewLoggerManager(make([]conf.LoggerConfiguration, 2))
+	lm.loggers[1] = newTestBackfillLogger(t, "line1\nline2\nline3\n", 6)
+
+	w := newRecordWriter()
+	if err := lm.RegisterWriter(1, w); err != nil {
+		t.Fatal(err)
+	}
+	if string(w.Data()) != "line3\n" {
+		t.Errorf("Expected: %q. Actual: %q", "line3\n", w.Data())
+	}
+
+	for _, expected := range []string{"line2\n", "line1\n"} {
+		records, err := lm.Backfill(w, 6)
+		if err != nil || string(JoinLines(records)) != expected {
+			t.Errorf("Expected: %q. Actual: %q %v", expected, JoinLines(records), err)
+		}
+	}
+
+	if _, err := lm.Backfill(w, 6); err != ErrNoOlderData {
+		t.Errorf("Expected: %s. Actual: %v", ErrNoOlderData, err)
+	}
+
+	// another writer starts from the end of the cache
+	other := newRecordWriter()
+	lm.RegisterWriter(1, other)
+	records, err := lm.Backfill(other, 100)
+	if err != nil || string(JoinLines(records)) != "line1\nline2\n" {
+		t.Errorf("Expected: %q. Actual: %q %v", "line1\nline2\n", JoinLines(records), err)
+	}
+	if len(records) != 2 || records[1].Offset != 6 {
+		t.Errorf("Expected: 2 records, the second at 6. Actual: %+v", records)
+	}
+
+	// the lines dropped by the writer are returned again
+	lm.DroppedBefore(other, 6)
+	records, err = lm.Backfill(other, 100)
+	if err != nil || string(JoinLines(records)) != "line1\n" {
+		t.Errorf("Expected: %q. Actual: %q %v", "line1\n", JoinLines(records), err)
+	}
+
+	lm.UnregisterWriter(w)
+	if _, err := lm.Backfill(w, 6); err == nil {
+		t.Error("Expected: error for unregistered writer. Actual: nil")
+	}
+}
+
+func TestLoggerManagerBackfillCache(t *testing.T) {
+	lm := NewLoggerManager(make([]conf.LoggerConfiguration, 2))
+	lm.loggers[1] = newTestBackfillLogger(t, "line1\nline2\nline3\nline4\nline5\n", 12)
+
+	w := newRecordWriter()
+	if err := lm.RegisterWriter(1, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole cache has been written: the file is not read
+	if _, err := lm.BackfillCache(w, 100); err != ErrNoOlderData {
+		t.Errorf("Expected: %s. Actual: %v", ErrNoOlderData, err)
+	}
+
+	lm.mutex.Lock()
+	lm.oldest[w] = 30
+	lm.mutex.Unlock()
+	records, err := lm.BackfillCache(w, 100)
+	if err != nil || string(JoinLines(records)) != "line4\nline5\n" || records[0].Offset != 18 {
+		t.Errorf("Expected: %q at 18. Actual: %+v %v", "line4\nline5\n", records, err)
+	}
+}
+
+// waitForEnd waits until the logger has received end bytes.
+func waitForEnd(t *testing.T, l *Logger, end int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, e := l.Offsets(); e == end {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected: %d bytes received", end)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoggerManagerResume(t *testing.T) {
+	path, remove := writeTestLog(t, "line 1\nline 2\n")
+	defer remove()
+
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	enabled := true
+	c := conf.LoggerConfiguration{
+		Name:   "app",
+		File:   path,
+		Poll:   conf.Poll{Interval: 10 * time.Millisecond},
+		Resume: conf.Resume{Enabled: &enabled},
+	}
+	newReader := func() *RemoteReader {
+		return newTestRemoteReader(newShellRunner(), c, 0)
+	}
+
+	lm := NewLoggerManager([]conf.LoggerConfiguration{c})
+	lm.SetStateFile(stateFile)
+	go lm.Run()
+	logger, err := lm.startLogger(0, c, newReader(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEnd(t, logger, 14)
+	lm.Stop()
+
+	// logged while lazylogger was not running
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("line 3\n")
+	f.Close()
+
+	lm = NewLoggerManager([]conf.LoggerConfiguration{c})
+	if err := lm.SetStateFile(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if names := lm.ResumableServices(); len(names) != 1 || names[0] != "app" {
+		t.Fatalf("Expected: app can resume. Actual: %v", names)
+	}
+	lm.SetResume(true)
+	go lm.Run()
+	defer lm.Stop()
+
+	logger, err = lm.startLogger(0, c, newReader(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEnd(t, logger, 7)
+
+	if data, n := logger.RequestData(0, 100); string(data[:n]) != "line 3\n" {
+		t.Errorf("Expected: only the line logged since the last run. Actual: %q", data[:n])
+	}
+}
+
+func TestLoggerManagerConnectCanceled(t *testing.T) {
+	// the proxy command never carries the ssh handshake
+	c := conf.LoggerConfiguration{
+		Name:          "hanging",
+		Host:          conf.Host{Address: "127.0.0.1", Username: "foo", Password: "bar"},
+		HostKeyPolicy: ssh.HostKeyOff,
+		Proxy:         conf.Proxy{Command: "sleep 60"},
+	}
+	lm := NewLoggerManager([]conf.LoggerConfiguration{c})
+	defer lm.Stop()
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() { errs <- lm.Connect(first, 0) }()
+	go func() { errs <- lm.Connect(second, 0) }()
+	<-time.After(100 * time.Millisecond)
+
+	// the other caller still waits for the dial
+	cancelFirst()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected: %s. Actual: %v", context.Canceled, err)
+	}
+	lm.mutex.Lock()
+	call, ok := lm.connecting[0]
+	lm.mutex.Unlock()
+	if !ok || call.canceled {
+		t.Fatal("Expected: dial running. Actual: canceled")
+	}
+
+	cancelSecond()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected: %s. Actual: %v", context.Canceled, err)
+	}
+	select {
+	case <-call.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected: dial aborted. Actual: still dialing")
+	}
+	if _, ok := lm.LoggerState(0); ok {
+		t.Error("Expected: no logger. Actual: logger started")
+	}
+}
@@ -0,0 +1,254 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+// DefaultReorderWindow is how long the lines of a merged logger are held if its configuration doesn't set it.
+var DefaultReorderWindow = 1 * time.Second
+
+// merger sorts the lines of several loggers by timestamp and writes them to a merged logger, each line prefixed
+// with the tag of its logger. The lines are held during the reorder window: a line received more than the window
+// after a line with a later timestamp is written out of order. A line without timestamp (e.g. a stack trace) gets
+// the timestamp of the previous line of its logger. It is safe for concurrent use.
+type merger struct {
+	logger *Logger
+	window time.Duration
+
+	// layouts of the timestamps tried before the common formats
+	formats []string
+
+	// name of each merged logger
+	names map[int]string
+
+	mutex *sync.Mutex
+
+	// lines not written yet
+	pending []pendingRecord
+
+	// sorts the lines with the same timestamp in the order received
+	seq uint64
+
+	// timestamp of the last line of each logger
+	last map[int]time.Time
+
+	// state of each merged logger
+	states       map[int]sourceState
+	stateChanged bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// pendingRecord is a line held until the end of the reorder window.
+type pendingRecord struct {
+	Record
+	timestamp time.Time
+	arrival   time.Time
+	seq       uint64
+}
+
+type sourceState struct {
+	state string
+	err   error
+}
+
+// newMerger returns a merger writing to logger the lines of the loggers in names.
+func newMerger(logger *Logger, c conf.LoggerConfiguration, names map[int]string) *merger {
+	window := c.ReorderWindow
+	if window <= 0 {
+		window = DefaultReorderWindow
+	}
+
+	return &merger{
+		logger:  logger,
+		window:  window,
+		formats: c.TimeFormats,
+		names:   names,
+		mutex:   &sync.Mutex{},
+		last:    make(map[int]time.Time),
+		states:  make(map[int]sourceState),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// tag returns the tag of the lines of the logger id.
+func (m *merger) tag(id int) string {
+	return "[" + m.names[id] + "] "
+}
+
+// add holds the records of the logger id received at arrival.
+func (m *merger) add(id int, records []Record, arrival time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, r := range records {
+		ts := m.timestamp(r)
+		if ts.IsZero() {
+			ts = m.last[id]
+		}
+		if ts.IsZero() {
+			ts = arrival
+		}
+		m.last[id] = ts
+
+		r.LoggerID = id
+		m.pending = append(m.pending, pendingRecord{Record: r, timestamp: ts, arrival: arrival, seq: m.seq})
+		m.seq++
+	}
+}
+
+// timestamp returns the time beginning the line, corrected by the clock offset of its host.
+// The layouts are matched on as many characters as they have.
+func (m *merger) timestamp(r Record) time.Time {
+	line := bytes.TrimPrefix(r.Line, []byte("["))
+	for _, layout := range m.formats {
+		if len(line) < len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, string(line[:len(layout)]), time.Local); err == nil {
+			return r.Source.correct(t)
+		}
+	}
+	return r.Timestamp
+}
+
+// release returns the tagged lines sorted by timestamp which have been held during the whole window at now.
+// A line is released only once all the lines with an earlier timestamp are released.
+func (m *merger) release(now time.Time) []Record {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		a, b := m.pending[i], m.pending[j]
+		if !a.timestamp.Equal(b.timestamp) {
+			return a.timestamp.Before(b.timestamp)
+		}
+		return a.seq < b.seq
+	})
+
+	cutoff := now.Add(-m.window)
+	n := 0
+	for n < len(m.pending) && !m.pending[n].arrival.After(cutoff) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	records := make([]Record, n)
+	for i, p := range m.pending[:n] {
+		tag := m.tag(p.LoggerID)
+		line := append([]byte(tag), p.Line...)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			line = append(line, '\n')
+		}
+
+		records[i] = Record{
+			Source:    p.Source,
+			Received:  p.Received,
+			Timestamp: p.timestamp,
+			Level:     p.Level,
+			Line:      line,
+			Tag:       len(tag),
+		}
+	}
+	m.pending = append([]pendingRecord{}, m.pending[n:]...)
+
+	return records
+}
+
+// setState records the state of the logger id.
+func (m *merger) setState(id int, state string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.states[id] = sourceState{state: state, err: err}
+	m.stateChanged = true
+}
+
+// stateChange returns true and the errors of the merged loggers if their states have changed since the last call.
+func (m *merger) stateChange() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.stateChanged {
+		return false, nil
+	}
+	m.stateChanged = false
+
+	ids := make([]int, 0, len(m.states))
+	for id := range m.states {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var errs []string
+	for _, id := range ids {
+		if s := m.states[id]; s.state != "healthy" && s.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", m.names[id], s.err))
+		}
+	}
+	if len(errs) == 0 {
+		return true, nil
+	}
+	return true, errors.New(strings.Join(errs, "; "))
+}
+
+// run writes the lines released to the merged logger until close is called.
+// The merged logger is degraded while a merged logger is not healthy.
+func (m *merger) run() {
+	defer close(m.stopped)
+
+	tick := m.window / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if records := m.release(now); len(records) > 0 {
+				m.logger.writeRecords(records)
+			}
+			if changed, stderr := m.stateChange(); changed {
+				m.logger.Error(stderr, nil)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// close stops run. The out channel of the logger must be read until close returns.
+func (m *merger) close() {
+	close(m.done)
+	<-m.stopped
+}
+
+// mergeSource is registered to a merged logger and passes its lines and state to the merger.
+// It must not block: it is called while the LoggerManager writes to its writers.
+type mergeSource struct {
+	m  *merger
+	id int
+}
+
+func (s *mergeSource) WriteRecords(records []Record) {
+	s.m.add(s.id, records, time.Now())
+}
+
+func (s *mergeSource) SetState(state string, err error) {
+	s.m.setState(s.id, state, err)
+}
+
+func (s *mergeSource) SetPollInterval(interval time.Duration) {}
@@ -0,0 +1,168 @@
+package log
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func newTestMerger(c conf.LoggerConfiguration) *merger {
+	logger, _ := NewLogger(2, make(chan interface{}, 10), conf.Poll{}, 0)
+	return newMerger(logger, c, map[int]string{0: "api", 1: "worker"})
+}
+
+func linesOf(records []Record) string {
+	return string(JoinLines(records))
+}
+
+func TestMergerRelease(t *testing.T) {
+	m := newTestMerger(conf.LoggerConfiguration{ReorderWindow: time.Second})
+	start := time.Now()
+
+	m.add(0, newRecords(0, Source{Name: "api"}, []byte("2021-03-04 05:06:08 api 1\n  at main.go\n"), 0, start), start)
+	m.add(1, newRecords(1, Source{Name: "worker"}, []byte("2021-03-04 05:06:07 worker 1\n2021-03-04 05:06:09 worker 2\n"), 0, start), start.Add(500*time.Millisecond))
+
+	if records := m.release(start.Add(900 * time.Millisecond)); len(records) != 0 {
+		t.Errorf("Expected: lines held during the window. Actual: %q", linesOf(records))
+	}
+
+	// the line of worker received later is written first. The stack trace follows its line.
+	records := m.release(start.Add(1500 * time.Millisecond))
+	expected := "[worker] 2021-03-04 05:06:07 worker 1\n[api] 2021-03-04 05:06:08 api 1\n[api]   at main.go\n[worker] 2021-03-04 05:06:09 worker 2\n"
+	if linesOf(records) != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, linesOf(records))
+	}
+	if records[0].Tag != len("[worker] ") || records[0].Source.Name != "worker" || records[1].Source.Name != "api" {
+		t.Errorf("Expected: tagged records. Actual: %+v", records[:2])
+	}
+}
+
+func TestMergerHoldsLaterLines(t *testing.T) {
+	m := newTestMerger(conf.LoggerConfiguration{ReorderWindow: time.Second})
+	start := time.Now()
+
+	m.add(0, newRecords(0, Source{}, []byte("2021-03-04 05:06:08 api\n"), 0, start), start)
+	m.add(1, newRecords(1, Source{}, []byte("2021-03-04 05:06:07 worker\n"), 0, start), start.Add(800*time.Millisecond))
+
+	// the line of api waits for the earlier line of worker
+	if records := m.release(start.Add(1200 * time.Millisecond)); len(records) != 0 {
+		t.Errorf("Expected: no line. Actual: %q", linesOf(records))
+	}
+	expected := "[worker] 2021-03-04 05:06:07 worker\n[api] 2021-03-04 05:06:08 api\n"
+	if records := m.release(start.Add(1800 * time.Millisecond)); linesOf(records) != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, linesOf(records))
+	}
+}
+
+func TestMergerTimeFormats(t *testing.T) {
+	m := newTestMerger(conf.LoggerConfiguration{TimeFormats: []string{"02/01/2006 15:04:05"}})
+	start := time.Now()
+
+	m.add(0, newRecords(0, Source{}, []byte("[04/03/2021 05:06:08] api\n"), 0, start), start)
+	m.add(1, newRecords(1, Source{}, []byte("04/03/2021 05:06:07 worker\n"), 0, start), start)
+
+	expected := "[worker] 04/03/2021 05:06:07 worker\n[api] [04/03/2021 05:06:08] api\n"
+	if records := m.release(start.Add(time.Minute)); linesOf(records) != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, linesOf(records))
+	}
+}
+
+func TestMergerClockOffset(t *testing.T) {
+	m := newTestMerger(conf.LoggerConfiguration{TimeFormats: []string{"02/01/2006 15:04:05"}})
+	start := time.Now()
+
+	// the clock of the host of api is 5s ahead: its line has been written before the line of worker
+	api := Source{Name: "api", ClockOffset: 5 * time.Second}
+	m.add(0, newRecords(0, api, []byte("2021-03-04 05:06:10 api\n04/03/2021 05:06:11 api\n"), 0, start), start)
+	m.add(1, newRecords(1, Source{Name: "worker"}, []byte("2021-03-04 05:06:07 worker\n"), 0, start), start)
+
+	records := m.release(start.Add(time.Minute))
+	expected := "[api] 2021-03-04 05:06:10 api\n[api] 04/03/2021 05:06:11 api\n[worker] 2021-03-04 05:06:07 worker\n"
+	if linesOf(records) != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, linesOf(records))
+	}
+	if ts := time.Date(2021, 3, 4, 5, 6, 5, 0, time.Local); !records[0].Timestamp.Equal(ts) {
+		t.Errorf("Expected: corrected timestamp %s. Actual: %s", ts, records[0].Timestamp)
+	}
+}
+
+func TestMergerSources(t *testing.T) {
+	logger, _ := NewLogger(2, make(chan interface{}, 10), conf.Poll{}, 0)
+	m := newMerger(logger, conf.LoggerConfiguration{ReorderWindow: time.Second}, map[int]string{0: "api] [v2", 1: "worker"})
+	start := time.Now()
+
+	m.add(0, newRecords(0, Source{Name: "api] [v2"}, []byte("2021-03-04 05:06:08 INFO api\n"), 0, start), start)
+	m.add(1, newRecords(1, Source{Name: "worker"}, []byte("2021-03-04 05:06:07 WARN worker] 1\n2021-03-04 05:06:09 worker] 2\n"), 0, start), start)
+	logger.writeRecords(m.release(start.Add(2 * time.Second)))
+
+	// the lines read again from the cache get the source they were written with, whatever their tag
+	_, _, end := logger.Offsets()
+	records := logger.RequestRecords(0, int(end))
+	expected := []struct {
+		name  string
+		level Level
+	}{{"worker", LevelWarn}, {"api] [v2", LevelInfo}, {"worker", LevelUnknown}}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected: %d records. Actual: %q", len(expected), linesOf(records))
+	}
+	for i, r := range records {
+		tag := "[" + expected[i].name + "] "
+		if r.Source.Name != expected[i].name || r.Tag != len(tag) || r.Level != expected[i].level || r.Timestamp.IsZero() {
+			t.Errorf("Expected: line of %s tagged with %q. Actual: %+v", expected[i].name, tag, r)
+		}
+	}
+}
+
+func TestLoggerManagerMerged(t *testing.T) {
+	configurations := []conf.LoggerConfiguration{
+		{Name: "api"},
+		{Name: "worker"},
+		{Name: "all", Merge: []string{"api", "worker"}, ReorderWindow: 20 * time.Millisecond},
+	}
+	lm := NewLoggerManager(configurations)
+	go lm.Run()
+	defer lm.Stop()
+
+	lm.startLogger(0, configurations[0], newGrowingReader('a', 10), nil)
+	lm.startLogger(1, configurations[1], newGrowingReader('w', 10), nil)
+
+	w := newRecordWriter()
+	if err := lm.RegisterWriter(2, w); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(map[string]bool)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sources) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected: lines of api and worker. Actual: %q", w.Data())
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		for _, r := range w.Records() {
+			sources[r.Source.Name] = true
+			tag := "[" + r.Source.Name + "] "
+			if r.LoggerID != 2 || r.Tag != len(tag) || !strings.HasPrefix(string(r.Line), tag) {
+				t.Fatalf("Expected: line of the merged logger tagged with its source. Actual: %+v", r)
+			}
+		}
+	}
+
+	// the lines read again from the cache keep their source
+	lm.mutex.Lock()
+	logger := lm.loggers[2]
+	lm.mutex.Unlock()
+	_, _, end := logger.Offsets()
+	for _, r := range logger.RequestRecords(0, int(end)) {
+		if r.Tag == 0 || (r.Source.Name != "api" && r.Source.Name != "worker") {
+			t.Errorf("Expected: record of api or worker. Actual: %+v", r)
+		}
+	}
+
+	if _, err := lm.CreateLogger(context.Background(), 3, conf.LoggerConfiguration{Name: "bad", Merge: []string{"unknown"}}); err == nil {
+		t.Error("Expected: error for an unknown service. Actual: nil")
+	}
+}
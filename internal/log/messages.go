@@ -1,10 +1,20 @@
 package log
 
+import "time"
+
 // DataNotification wil notify all the registered clients about new data arrived in the cache.
 // Size is the new size of the cache. It the cache is full (e.g. size = 10Mb) the new size
 // is set to 10Mb and the previousSize = size - number of bytes put in cache by the logger.
+// Records holds the lines written: the cache can evict lines before the notification is handled.
 type DataNotification struct {
 	ID           int
 	Size         int64
 	PreviousSize int64
+	Records      []Record
+}
+
+// PollNotification notifies the clients that the interval between two polls of the file has changed.
+type PollNotification struct {
+	ID       int
+	Interval time.Duration
 }
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+var (
+	// DefaultPollInterval is the interval between two polls when the service doesn't set one.
+	DefaultPollInterval = 1 * time.Second
+
+	// DefaultMinPollInterval is the shortest interval in adaptive mode.
+	DefaultMinPollInterval = 250 * time.Millisecond
+
+	// DefaultMaxPollInterval is the longest interval in adaptive mode.
+	DefaultMaxPollInterval = 30 * time.Second
+)
+
+// pollInterval computes the time to wait before the next poll. In adaptive mode, the interval is halved
+// each time the file grows and doubled each time it doesn't, between min and max.
+// It is used only by the fetch loop.
+type pollInterval struct {
+	adaptive bool
+	interval time.Duration
+	min      time.Duration
+	max      time.Duration
+}
+
+// newPollInterval returns the pollInterval for the settings p. The settings not set get the default values.
+func newPollInterval(p conf.Poll) (*pollInterval, error) {
+	poll := &pollInterval{
+		interval: p.Interval,
+		min:      p.Min,
+		max:      p.Max,
+	}
+
+	switch p.Mode {
+	case "", conf.PollFixed:
+	case conf.PollAdaptive:
+		poll.adaptive = true
+	default:
+		return nil, fmt.Errorf("unknown poll mode: %s", p.Mode)
+	}
+
+	if poll.interval <= 0 {
+		poll.interval = DefaultPollInterval
+	}
+	if poll.min <= 0 {
+		poll.min = DefaultMinPollInterval
+	}
+	if poll.max <= 0 {
+		poll.max = DefaultMaxPollInterval
+	}
+	if poll.min > poll.max {
+		return nil, fmt.Errorf("poll min %s greater than poll max %s", poll.min, poll.max)
+	}
+
+	if poll.adaptive {
+		poll.interval = poll.clamp(poll.interval)
+	}
+	return poll, nil
+}
+
+// current returns the interval before the next poll.
+func (p *pollInterval) current() time.Duration {
+	return p.interval
+}
+
+// update adapts the interval after a poll. grew is true if the file has grown since the last poll.
+// It returns the new interval and true if the interval has changed.
+func (p *pollInterval) update(grew bool) (time.Duration, bool) {
+	if !p.adaptive {
+		return p.interval, false
+	}
+
+	old := p.interval
+	if grew {
+		p.interval = p.clamp(p.interval / 2)
+	} else {
+		p.interval = p.clamp(p.interval * 2)
+	}
+	return p.interval, p.interval != old
+}
+
+func (p *pollInterval) clamp(d time.Duration) time.Duration {
+	if d < p.min {
+		return p.min
+	}
+	if d > p.max {
+		return p.max
+	}
+	return d
+}
@@ -0,0 +1,54 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func TestPollIntervalFixed(t *testing.T) {
+	poll, err := newPollInterval(conf.Poll{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if poll.current() != DefaultPollInterval {
+		t.Errorf("Expected: %s. Actual: %s", DefaultPollInterval, poll.current())
+	}
+
+	if _, changed := poll.update(false); changed {
+		t.Error("Expected: fixed interval. Actual: interval changed")
+	}
+}
+
+func TestPollIntervalAdaptive(t *testing.T) {
+	poll, err := newPollInterval(conf.Poll{Mode: conf.PollAdaptive, Interval: time.Second, Min: 250 * time.Millisecond, Max: 4 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is idle: back off until max
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if interval, _ := poll.update(false); interval != expected {
+			t.Errorf("Expected: %s. Actual: %s", expected, interval)
+		}
+	}
+
+	// the file grows: poll faster until min
+	for _, expected := range []time.Duration{2 * time.Second, time.Second, 500 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond} {
+		if interval, _ := poll.update(true); interval != expected {
+			t.Errorf("Expected: %s. Actual: %s", expected, interval)
+		}
+	}
+}
+
+func TestPollIntervalInvalid(t *testing.T) {
+	if _, err := newPollInterval(conf.Poll{Mode: "sometimes"}); err == nil {
+		t.Error("Expected: unknown mode error. Actual: nil")
+	}
+
+	if _, err := newPollInterval(conf.Poll{Mode: conf.PollAdaptive, Min: time.Second, Max: time.Millisecond}); err == nil {
+		t.Error("Expected: min greater than max error. Actual: nil")
+	}
+}
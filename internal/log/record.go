@@ -0,0 +1,239 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a line.
+type Level int
+
+const (
+	// LevelUnknown means that no level has been found in the line.
+	LevelUnknown Level = iota
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"", "TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return ""
+	}
+	return levelNames[l]
+}
+
+// Source is where the lines of a logger come from.
+type Source struct {
+	Name string
+	Host string
+	File string
+
+	// clock of the host minus the local clock, measured when connecting. Zero if unknown.
+	ClockOffset time.Duration
+}
+
+// correct returns the local time of t read on the clock of the host.
+func (s Source) correct(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.Add(-s.ClockOffset)
+}
+
+// Record is a line received by a logger.
+type Record struct {
+	LoggerID int
+	Source   Source
+
+	// offset of the line counted from the first byte received by the logger
+	Offset int64
+
+	// time the line has been received. Zero if the line has been read again from the cache or the file.
+	Received time.Time
+
+	// time found at the beginning of the line, corrected by the clock offset of the host. Zero if not found.
+	Timestamp time.Time
+
+	Level Level
+
+	// line with its trailing newline. A partial line written after PartialLineTimeout has no newline.
+	Line []byte
+
+	// length of the tag of the source at the beginning of Line. Only the lines of a merged logger are tagged.
+	Tag int
+}
+
+// newRecords splits data into records. offset is the offset of data counted from the first byte received by the logger.
+func newRecords(id int, source Source, data []byte, offset int64, received time.Time) []Record {
+	records := make([]Record, 0, bytes.Count(data, []byte("\n"))+1)
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+
+		line := data[:end]
+		records = append(records, Record{
+			LoggerID:  id,
+			Source:    source,
+			Offset:    offset,
+			Received:  received,
+			Timestamp: source.correct(parseTimestamp(line, received)),
+			Level:     parseLevel(line),
+			Line:      line,
+		})
+
+		offset += int64(end)
+		data = data[end:]
+	}
+	return records
+}
+
+// JoinLines returns the lines of records.
+func JoinLines(records []Record) []byte {
+	n := 0
+	for _, r := range records {
+		n += len(r.Line)
+	}
+
+	data := make([]byte, 0, n)
+	for _, r := range records {
+		data = append(data, r.Line...)
+	}
+	return data
+}
+
+var (
+	// 2006-01-02T15:04:05.000Z, 2006-01-02 15:04:05,000 +0200...
+	isoTimestamp = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?)(?: ?(Z|[+-]\d{2}:?\d{2}))?`)
+
+	// Jan _2 15:04:05 of syslog
+	syslogTimestamp = regexp.MustCompile(`^\[?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2})`)
+
+	// upper case level of log4j, logback, python logging... or level=... (logfmt) or "level":"..." (json).
+	// The json level can be a number (bunyan, pino). The field must begin the line or follow a space, { or ,.
+	levelWord    = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|SEVERE|FATAL|CRITICAL|CRIT|ALERT|EMERG|PANIC|FINE|FINER|FINEST)\b`)
+	levelField   = regexp.MustCompile(`(?i)(?:^|[\s{,])"?(?:level|lvl|severity)"?\s*[=:]\s*"?([a-z]+|\d+)`)
+	levelBracket = regexp.MustCompile(`(?i)\[(trace|debug|info|notice|warn|warning|error|err|crit|critical|alert|emerg|fatal)\]`)
+
+	// <priority> of syslog and journald, the severity is the priority modulo 8
+	syslogPriority = regexp.MustCompile(`^<(\d{1,3})>`)
+
+	// E0304 05:06:07.123456 of glog and klog
+	glogLevel = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}`)
+)
+
+// glogLevels are the levels of the first letter of the glog lines.
+var glogLevels = map[byte]Level{'I': LevelInfo, 'W': LevelWarn, 'E': LevelError, 'F': LevelFatal}
+
+// syslogSeverities are the levels of the syslog severities from 0 (emergency) to 7 (debug).
+var syslogSeverities = []Level{LevelFatal, LevelFatal, LevelFatal, LevelError, LevelWarn, LevelInfo, LevelInfo, LevelDebug}
+
+// parseTimestamp returns the time at the beginning of line. A time without zone is in the local time zone.
+// A syslog time has no year: the year of now is used. It returns the zero time if no time is found.
+func parseTimestamp(line []byte, now time.Time) time.Time {
+	if m := isoTimestamp.FindSubmatch(line); m != nil {
+		value := strings.Replace(string(m[1]), ",", ".", 1)
+		value = value[:10] + "T" + value[11:]
+
+		zone := string(m[2])
+		if len(zone) == 0 {
+			t, _ := time.ParseInLocation("2006-01-02T15:04:05.999999999", value, time.Local)
+			return t
+		}
+		if zone != "Z" && !strings.Contains(zone, ":") {
+			zone = zone[:3] + ":" + zone[3:]
+		}
+		t, _ := time.Parse(time.RFC3339Nano, value+zone)
+		return t
+	}
+
+	if m := syslogTimestamp.FindSubmatch(line); m != nil {
+		t, err := time.ParseInLocation(time.Stamp, string(m[1]), time.Local)
+		if err != nil {
+			return time.Time{}
+		}
+		if now.IsZero() {
+			now = time.Now()
+		}
+		return t.AddDate(now.Year(), 0, 0)
+	}
+
+	return time.Time{}
+}
+
+// parseLevel returns the level of line.
+func parseLevel(line []byte) Level {
+	if m := syslogPriority.FindSubmatch(line); m != nil {
+		if priority, err := strconv.Atoi(string(m[1])); err == nil && priority < 192 {
+			return syslogSeverities[priority%8]
+		}
+	}
+	if m := glogLevel.FindSubmatch(line); m != nil {
+		return glogLevels[m[1][0]]
+	}
+	// the message may hold a field which is not a level (e.g. msg="set level=high" level=info)
+	for _, m := range levelField.FindAllSubmatch(line, -1) {
+		if l := levelFromName(strings.ToUpper(string(m[1]))); l != LevelUnknown {
+			return l
+		}
+	}
+	if m := levelBracket.FindSubmatch(line); m != nil {
+		return levelFromName(strings.ToUpper(string(m[1])))
+	}
+	if m := levelWord.FindSubmatch(line); m != nil {
+		return levelFromName(string(m[1]))
+	}
+	return LevelUnknown
+}
+
+// levelFromName returns the level of an upper case name or of a number of bunyan and pino.
+func levelFromName(name string) Level {
+	switch name {
+	case "TRACE", "FINEST", "10":
+		return LevelTrace
+	case "DEBUG", "FINE", "FINER", "20":
+		return LevelDebug
+	case "INFO", "NOTICE", "30":
+		return LevelInfo
+	case "WARN", "WARNING", "40":
+		return LevelWarn
+	case "ERROR", "ERR", "SEVERE", "50":
+		return LevelError
+	case "FATAL", "CRITICAL", "CRIT", "ALERT", "EMERG", "PANIC", "60":
+		return LevelFatal
+	}
+	return LevelUnknown
+}
+
+// ByteWriter is written with the raw lines instead of records.
+type ByteWriter interface {
+	io.Writer
+	SetState(state string, err error)
+	SetPollInterval(interval time.Duration)
+}
+
+// ByteWriterAdapter is a LogWriter writing the lines of the records to a ByteWriter.
+type ByteWriterAdapter struct {
+	ByteWriter
+}
+
+// NewByteWriterAdapter returns a LogWriter writing to w. The adapter is the writer to register and unregister.
+func NewByteWriterAdapter(w ByteWriter) *ByteWriterAdapter {
+	return &ByteWriterAdapter{ByteWriter: w}
+}
+
+// WriteRecords writes the lines of records.
+func (a *ByteWriterAdapter) WriteRecords(records []Record) {
+	a.Write(JoinLines(records))
+}
@@ -0,0 +1,158 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func TestNewRecords(t *testing.T) {
+	source := Source{Name: "app", Host: "host", File: "/var/log/app.log"}
+	now := time.Now()
+
+	records := newRecords(1, source, []byte("line 1\nline 22\npartial"), 10, now)
+	if len(records) != 3 {
+		t.Fatalf("Expected: 3 records. Actual: %d", len(records))
+	}
+
+	expected := []struct {
+		offset int64
+		line   string
+	}{{10, "line 1\n"}, {17, "line 22\n"}, {25, "partial"}}
+	for i, e := range expected {
+		r := records[i]
+		if r.Offset != e.offset || string(r.Line) != e.line || r.LoggerID != 1 || r.Source != source || !r.Received.Equal(now) {
+			t.Errorf("Expected: %q at %d. Actual: %+v", e.line, e.offset, r)
+		}
+	}
+
+	if string(JoinLines(records)) != "line 1\nline 22\npartial" {
+		t.Errorf("Expected: the lines joined. Actual: %q", JoinLines(records))
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Date(2021, 3, 4, 0, 0, 0, 0, time.Local)
+	utc2 := time.FixedZone("", 2*3600)
+
+	tests := []struct {
+		line     string
+		expected time.Time
+	}{
+		{"2021-03-04T05:06:07Z INFO started", time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"2021-03-04T05:06:07.123+02:00 started", time.Date(2021, 3, 4, 5, 6, 7, 123000000, utc2)},
+		{"[2021-03-04 05:06:07,5 +0200] started", time.Date(2021, 3, 4, 5, 6, 7, 500000000, utc2)},
+		{"2021-03-04 05:06:07 started", time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)},
+		{"Mar  4 05:06:07 host app[12]: started", time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)},
+		{"started at 2021-03-04 05:06:07", time.Time{}},
+	}
+
+	for _, test := range tests {
+		if actual := parseTimestamp([]byte(test.line), now); !actual.Equal(test.expected) {
+			t.Errorf("%q: Expected: %s. Actual: %s", test.line, test.expected, actual)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Level
+	}{
+		{"2021-03-04T05:06:07Z INFO started", LevelInfo},
+		{"[WARNING] disk almost full", LevelWarn},
+		{`time=2021-03-04 level=error msg="failed"`, LevelError},
+		{`{"level":"debug","msg":"ready"}`, LevelDebug},
+		{"panic: FATAL error", LevelFatal},
+		{"information about ERRORS", LevelUnknown},
+		{"the level: high", LevelUnknown},
+		// log4j, logback
+		{"2021-03-04 05:06:07,123 ERROR [main] c.e.App - failed", LevelError},
+		{"05:06:07.123 [http-nio-8080-exec-1] WARN  c.e.App - slow", LevelWarn},
+		// python logging
+		{"WARNING:root:disk almost full", LevelWarn},
+		{"2021-03-04 05:06:07,123 - app - CRITICAL - out of memory", LevelFatal},
+		// java.util.logging
+		{"SEVERE: connection lost", LevelError},
+		// syslog priority: facility 1, severity 3 and facility 0, severity 7
+		{"<11>Mar  4 05:06:07 host app: failed", LevelError},
+		{"<7>kernel: probing", LevelDebug},
+		// nginx, apache
+		{"2021/03/04 05:06:07 [crit] 12#12: open() failed", LevelFatal},
+		{"[Thu Mar 04 05:06:07 2021] [notice] started", LevelInfo},
+		// glog, klog
+		{"E0304 05:06:07.123456    1 main.go:12] failed", LevelError},
+		// json levels as numbers (bunyan, pino) and logfmt lvl
+		{`{"level":50,"msg":"failed"}`, LevelError},
+		{"lvl=warn msg=slow", LevelWarn},
+		// level as part of another key or inside the message
+		{"access_level: admin granted", LevelUnknown},
+		{"user_level=error not a level", LevelUnknown},
+		{`msg="set level=high" level=info`, LevelInfo},
+		{`{"msg":"x","severity":"WARNING"}`, LevelWarn},
+	}
+
+	for _, test := range tests {
+		if actual := parseLevel([]byte(test.line)); actual != test.expected {
+			t.Errorf("%q: Expected: %s. Actual: %s", test.line, test.expected, actual)
+		}
+	}
+}
+
+// bytesWriter is a ByteWriter recording the data written.
+type bytesWriter struct {
+	bytes.Buffer
+}
+
+func (b *bytesWriter) SetState(state string, err error) {}
+
+func (b *bytesWriter) SetPollInterval(interval time.Duration) {}
+
+func TestLoggerManagerRecords(t *testing.T) {
+	c := conf.LoggerConfiguration{Name: "app", Host: conf.Host{Address: "host"}, File: "/var/log/app.log"}
+	lm := NewLoggerManager([]conf.LoggerConfiguration{c})
+	go lm.Run()
+	defer lm.Stop()
+
+	if _, err := lm.startLogger(0, c, newGrowingReader('a', 10), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newRecordWriter()
+	if err := lm.RegisterWriter(0, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records received after the registration have a receive time
+	var records []Record
+	deadline := time.Now().Add(5 * time.Second)
+	for len(records) == 0 || records[len(records)-1].Received.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected: records received")
+		}
+		time.Sleep(10 * time.Millisecond)
+		records = w.Records()
+	}
+
+	var offset int64
+	for _, r := range records {
+		if r.LoggerID != 0 || r.Source != (Source{Name: "app", Host: "host", File: "/var/log/app.log"}) {
+			t.Errorf("Expected: record of app. Actual: %+v", r)
+		}
+		if r.Offset != offset {
+			t.Errorf("Expected: offset %d. Actual: %d", offset, r.Offset)
+		}
+		offset += int64(len(r.Line))
+	}
+
+	// the adapter writes the same lines
+	b := &bytesWriter{}
+	adapter := NewByteWriterAdapter(b)
+	adapter.WriteRecords(records)
+	if b.String() != string(JoinLines(records)) {
+		t.Errorf("Expected: %q. Actual: %q", JoinLines(records), b.String())
+	}
+	lm.UnregisterWriter(w)
+}
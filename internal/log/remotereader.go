@@ -2,20 +2,28 @@ package log
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
 	"github.com/tupyy/lazylogger/internal/ssh"
 )
 
 var (
 	// DefaultChunkSize set to 4K
 	DefaultChunkSize = int32(4 * 1024)
+
+	// DefaultCommandTimeout is the time a remote command can take when the service doesn't set one.
+	DefaultCommandTimeout = 30 * time.Second
 )
 
 // ErrNofile means that the remote file doesn't exist or the user has no permission to read it.
@@ -23,6 +31,12 @@ var ErrNofile = errors.New("file don't exist")
 
 var ErrClient = errors.New("client error")
 
+// ErrCompressedData means that the data compressed by the host cannot be decompressed.
+var ErrCompressedData = errors.New("invalid compressed data")
+
+// ErrTimeout means that a remote command took more than the command timeout. The ssh session has been closed.
+var ErrTimeout = errors.New("command timed out")
+
 // ErrInvalidSize means that the size as string returned by the stat command
 // cannot be parsed into an uint32
 var ErrInvalidSize = errors.New("invalid size")
@@ -41,6 +55,12 @@ type logFile struct {
 
 	// size in bytes
 	Size int32
+
+	// inode of the file read up to Size. Zero if unknown.
+	Inode uint64
+
+	// inode returned by the last stat. It becomes Inode when the size is set.
+	fetchedInode uint64
 }
 
 /*
@@ -48,35 +68,164 @@ NextChunkCommand return the dd command to be executed in the shell
 in order to get the next chuck of data
 */
 func (log *logFile) NextChunkCommand(chunkSize int32) string {
-	return fmt.Sprintf("tail -c+%d %s | head -c%d",
-		log.BytesRead,
-		log.Path,
-		chunkSize)
+	return chunkCommand(log.Path, int64(log.BytesRead), int64(chunkSize))
+}
+
+// chunkCommand returns the command reading size bytes of the file at offset.
+func chunkCommand(path string, offset, size int64) string {
+	// tail counts the bytes from 1
+	return fmt.Sprintf("tail -c+%d %s | head -c%d", offset+1, shellPath(path), size)
+}
+
+/*
+NextFilteredChunkCommand returns the command reading the complete lines of the next chunk and filtering them
+on the remote host. The first line of the output is the number of bytes read from the file, the filtered lines follow.
+If the chunk has no complete line, nothing is read unless more data follows the chunk (a line longer than the chunk):
+the whole chunk is filtered then as a line of its own.
+*/
+func (log *logFile) NextFilteredChunkCommand(chunkSize int32, filter conf.Filter, more bool) string {
+	chunk := fmt.Sprintf("tail -c+%d %s | head -c%d", log.BytesRead+1, shellPath(log.Path), chunkSize)
+	lines := fmt.Sprintf(`tail -c+%d %s | head -n "$n"`, log.BytesRead+1, shellPath(log.Path))
+	grep := filterCommand(filter)
+
+	// grep exits with 1 when no line matches. The errors are read from stderr.
+	if more {
+		return fmt.Sprintf(`n=$(%s | tr -cd '\n' | wc -c); if [ "$n" -eq 0 ]; then echo %d; %s | %s; else %s | wc -c; %s | %s; fi; exit 0`,
+			chunk, chunkSize, chunk, grep, lines, lines, grep)
+	}
+	return fmt.Sprintf(`n=$(%s | tr -cd '\n' | wc -c); %s | wc -c; %s | %s; exit 0`, chunk, lines, lines, grep)
+}
+
+// filterCommand returns the grep commands selecting the lines kept by filter.
+func filterCommand(filter conf.Filter) string {
+	var cmds []string
+	if len(filter.Include) > 0 {
+		cmds = append(cmds, "grep -E"+grepExpressions(filter.Include))
+	}
+	if len(filter.Exclude) > 0 {
+		cmds = append(cmds, "grep -v -E"+grepExpressions(filter.Exclude))
+	}
+	if len(cmds) == 0 {
+		return "cat"
+	}
+	return strings.Join(cmds, " | ")
+}
 
+// grepExpressions returns the expressions as quoted -e arguments.
+func grepExpressions(expressions []string) string {
+	var args string
+	for _, e := range expressions {
+		args += " -e " + shellQuote(e)
+	}
+	return args
 }
 
 /*
-StatCommand returns the command for reading total size of file
+StatCommand returns the command for reading total size and inode of file
 */
 func (log *logFile) StatCommand() string {
-	return fmt.Sprintf("stat --format %%s %s", log.Path)
+	return fmt.Sprintf("stat --format '%%s %%i' %s", shellPath(log.Path))
+}
+
+// lineStartCommand returns the command printing the number of bytes from offset-1 to the end of the first line after it.
+// If the byte before offset ends a line, it prints 1.
+func lineStartCommand(path string, offset int64) string {
+	return fmt.Sprintf("tail -c+%d %s | head -n1 | wc -c", offset, shellPath(path))
+}
+
+// parseStat parses the output of the stat command: the size followed by the inode if known.
+func parseStat(output string) (int32, uint64, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, ErrInvalidSize
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 32)
+	if err != nil {
+		return 0, 0, ErrInvalidSize
+	}
+
+	var inode uint64
+	if len(fields) == 2 {
+		if inode, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return 0, 0, ErrInvalidSize
+		}
+	}
+	return int32(size), inode, nil
 }
 
+// compression is the state of the compression of a RemoteReader.
+type compression int
+
+const (
+	// compressionOff means the data is not compressed.
+	compressionOff compression = iota
+
+	// compressionProbe means the compression is asked but gzip has not been looked for on the host yet.
+	compressionProbe
+
+	// compressionOn means the data is compressed by gzip on the host.
+	compressionOn
+)
+
 // RemoteReader keeps track of file to be logged on a remote host.
-// Only one file can be watched at the time.
+// Only one file can be watched at the time. It is safe for concurrent use.
 type RemoteReader struct {
 	client *ssh.Client
-	file   logFile
+
+	// runs the commands on the host of client
+	runner commandRunner
+
+	// maximum time a command can take
+	commandTimeout time.Duration
+
+	// maximum number of bytes read by a command
+	chunkSize int32
+
+	// lines selected by the remote host. Empty if all the data is read.
+	filter conf.Filter
+
+	// fetches the size together with the other files of the host. If nil, the size is fetched by its own command.
+	poller *hostPoller
+
+	// compression of the data by the host
+	compression compression
+
+	// bytes transferred
+	stats Stats
+
+	// protects file. It is not held while running commands.
+	mutex *sync.Mutex
+	file  logFile
 }
 
 // NewRemoteReader returns a RemoteReader. The remoteClient has to be already connected.
 // New will try to stat each file in the filepaths in order to create a Logfile for
-// each filepath
-func NewRemoteReader(c *ssh.Client, file string) *RemoteReader {
+// each filepath. DefaultCommandTimeout and DefaultChunkSize are used if the configuration doesn't set them.
+func NewRemoteReader(c *ssh.Client, conf conf.LoggerConfiguration) *RemoteReader {
+	commandTimeout := conf.CommandTimeout
+	if commandTimeout <= 0 {
+		commandTimeout = DefaultCommandTimeout
+	}
+
+	chunkSize := DefaultChunkSize
+	if conf.ChunkSize > 0 && conf.ChunkSize <= math.MaxInt32 {
+		chunkSize = int32(conf.ChunkSize)
+	}
 
 	r := RemoteReader{
-		client: c,
-		file:   logFile{Path: file, BytesRead: 0, Skip: 0, Size: 0},
+		client:         c,
+		runner:         sshRunner{c},
+		commandTimeout: commandTimeout,
+		chunkSize:      chunkSize,
+		filter:         conf.Filter,
+		compression:    compressionOff,
+		mutex:          &sync.Mutex{},
+		file:           logFile{Path: conf.File, BytesRead: 0, Skip: 0, Size: 0},
+	}
+
+	if conf.Compression {
+		r.compression = compressionProbe
 	}
 
 	return &r
@@ -87,20 +236,127 @@ func (r *RemoteReader) Close() {
 	r.client.Close()
 }
 
+// run runs cmd. The ssh session is closed if the command takes more than commandTimeout or ctx is done.
+func (r *RemoteReader) run(ctx context.Context, cmd string, stdout, stderr *bytes.Buffer) error {
+	cmdCtx, cancel := context.WithTimeout(ctx, r.commandTimeout)
+	defer cancel()
+
+	err := r.runner.Run(cmdCtx, cmd, stdout, stderr)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		glog.Warningf("command timed out after %s: %s", r.commandTimeout, cmd)
+		return ErrTimeout
+	}
+	return err
+}
+
+// read runs cmd reading the file. If the reader has a poller, cmd runs together with the reads of the other files of the host.
+func (r *RemoteReader) read(ctx context.Context, cmd string, stdout, stderr *bytes.Buffer) error {
+	if r.poller == nil {
+		return r.run(ctx, cmd, stdout, stderr)
+	}
+	return r.poller.read(ctx, cmd, r.commandTimeout, stdout, stderr)
+}
+
+// runRead runs a command reading the file. If the compression is on, the output is compressed by the host
+// and decompressed in stdout. The bytes received are added to the wire bytes.
+func (r *RemoteReader) runRead(ctx context.Context, cmd string, stdout, stderr *bytes.Buffer) error {
+	compressed, err := r.compressed(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !compressed {
+		err := r.read(ctx, cmd, stdout, stderr)
+		r.addWireBytes(stdout.Len())
+		return err
+	}
+
+	var wire bytes.Buffer
+	err = r.read(ctx, fmt.Sprintf("{ %s; } | gzip -c", cmd), &wire, stderr)
+	r.addWireBytes(wire.Len())
+	if err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(&wire)
+	if err != nil {
+		if stderr.Len() > 0 {
+			return nil
+		}
+		return ErrCompressedData
+	}
+	if _, err := io.Copy(stdout, gz); err != nil {
+		return ErrCompressedData
+	}
+	return nil
+}
+
+// compressed returns true if the host compresses the data. The first time, it looks for gzip on the host.
+func (r *RemoteReader) compressed(ctx context.Context) (bool, error) {
+	r.mutex.Lock()
+	c := r.compression
+	r.mutex.Unlock()
+
+	if c != compressionProbe {
+		return c == compressionOn, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	err := r.run(ctx, "command -v gzip", &stdout, &stderr)
+	if err == ErrTimeout || (err != nil && err == ctx.Err()) {
+		return false, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		glog.Warningf("gzip not found on host. The data of %s is not compressed", r.file.Path)
+		r.compression = compressionOff
+	} else {
+		r.compression = compressionOn
+	}
+	r.stats.Compressed = r.compression == compressionOn
+
+	return r.stats.Compressed, nil
+}
+
+func (r *RemoteReader) addWireBytes(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats.WireBytes += int64(n)
+}
+
+// Stats returns the number of bytes transferred.
+func (r *RemoteReader) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stats
+}
+
 // ReadNextChunk reads the next chunk from file.
-func (r *RemoteReader) ReadNextChunk() ([]byte, error, error) {
+func (r *RemoteReader) ReadNextChunk(ctx context.Context) ([]byte, error, error) {
 	var (
 		stdout bytes.Buffer
 		stderr bytes.Buffer
 	)
 
-	// protect the size. We could set the new size at the same time
-	size := r.file.Size
+	if !r.filter.IsEmpty() {
+		return r.readNextFilteredChunk(ctx)
+	}
 
-	cmd := r.file.NextChunkCommand(computeNextChunkSize(size, r.file.BytesRead, DefaultChunkSize))
+	// protect the size. We could set the new size at the same time
+	r.mutex.Lock()
+	cmd := r.file.NextChunkCommand(computeNextChunkSize(r.file.Size, r.file.BytesRead, r.chunkSize))
+	r.mutex.Unlock()
 	glog.V(4).Infof("\n\n ---- Running command: %s  -----", cmd)
 
-	err := r.client.Cmd(cmd).SetStdio(&stdout, &stderr).Run()
+	err := r.runRead(ctx, cmd, &stdout, &stderr)
+	if err != nil && (err == ErrTimeout || err == ctx.Err()) {
+		return []byte{}, nil, err
+	}
+	if err == ErrCompressedData {
+		return []byte{}, err, nil
+	}
 	if err != nil && err != io.EOF {
 		return []byte{}, errors.New(string(stderr.Bytes())), err
 	}
@@ -108,53 +364,223 @@ func (r *RemoteReader) ReadNextChunk() ([]byte, error, error) {
 	bytesRead := uint32(stdout.Len())
 
 	if bytesRead > 0 {
+		r.mutex.Lock()
 		r.file.Skip++
 		r.file.BytesRead += int32(stdout.Len())
+		r.stats.FileBytes += int64(stdout.Len())
+		r.stats.DeliveredBytes += int64(stdout.Len())
+		r.mutex.Unlock()
 		return stdout.Bytes(), nil, nil
 	}
 
+	// the exit status of a pipeline is the one of the last command
+	if stderr.Len() > 0 {
+		return []byte{}, errors.New(strings.TrimSpace(stderr.String())), nil
+	}
+
 	return []byte{}, nil, nil
 
 }
 
+// readNextFilteredChunk reads the lines of the next chunk selected by the filter.
+// The offset in the file is moved by the number of bytes read, not the number of bytes received.
+// If the last line of the file is not complete, it is read once complete: the size is set to the offset until the next fetch.
+func (r *RemoteReader) readNextFilteredChunk(ctx context.Context) ([]byte, error, error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+
+	r.mutex.Lock()
+	chunkSize := computeNextChunkSize(r.file.Size, r.file.BytesRead, r.chunkSize)
+	more := r.file.BytesRead+chunkSize < r.file.Size
+	cmd := r.file.NextFilteredChunkCommand(chunkSize, r.filter, more)
+	r.mutex.Unlock()
+	glog.V(4).Infof("\n\n ---- Running command: %s  -----", cmd)
+
+	err := r.runRead(ctx, cmd, &stdout, &stderr)
+	if err != nil && (err == ErrTimeout || err == ctx.Err()) {
+		return []byte{}, nil, err
+	}
+	if err == ErrCompressedData {
+		return []byte{}, err, nil
+	}
+	if err != nil {
+		return []byte{}, errors.New(string(stderr.Bytes())), err
+	}
+	if stderr.Len() > 0 {
+		return []byte{}, errors.New(strings.TrimSpace(stderr.String())), nil
+	}
+
+	line, err := stdout.ReadString('\n')
+	if err != nil {
+		return []byte{}, ErrInvalidSize, nil
+	}
+	bytesRead, err := strconv.ParseInt(strings.TrimSpace(line), 10, 32)
+	if err != nil {
+		return []byte{}, ErrInvalidSize, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if bytesRead == 0 {
+		// wait for the end of the line
+		r.file.Size = r.file.BytesRead
+		return []byte{}, nil, nil
+	}
+	r.file.Skip++
+	r.file.BytesRead += int32(bytesRead)
+	r.stats.FileBytes += bytesRead
+	r.stats.DeliveredBytes += int64(stdout.Len())
+
+	return stdout.Bytes(), nil, nil
+}
+
 // HasNextChunk returns true if there is more data to be read from file.
 // It does not update the size of the file
 func (r *RemoteReader) HasNextChunk() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	return r.file.Size > r.file.BytesRead
 }
 
-// ReadChunk reads a single chunk at offset offset.
-// Return EOF if offset >= size
-func (r *RemoteReader) ReadChunk(offset int) (string, error) {
-	return "chunk", nil
+// ReadChunk reads size bytes at offset. It is used to read again the data evicted from the cache.
+// The lines filtered by the host cannot be found at their offset in the file so it returns ErrNoOlderData if a filter is set.
+func (r *RemoteReader) ReadChunk(ctx context.Context, offset int64, size int) ([]byte, error) {
+	if !r.filter.IsEmpty() {
+		return nil, ErrNoOlderData
+	}
+
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+
+	r.mutex.Lock()
+	cmd := chunkCommand(r.file.Path, offset, int64(size))
+	r.mutex.Unlock()
+	glog.V(4).Infof("\n\n ---- Running command: %s  -----", cmd)
+
+	err := r.runRead(ctx, cmd, &stdout, &stderr)
+	if stderr.Len() > 0 && stdout.Len() == 0 {
+		return nil, errors.New(strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	r.stats.DeliveredBytes += int64(stdout.Len())
+	r.mutex.Unlock()
+
+	return stdout.Bytes(), nil
 }
 
 // Rewind set bytesRead to zero
 func (r *RemoteReader) Rewind() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.file.BytesRead = 0
 	r.file.Size = 0
+	r.file.Inode = 0
 }
 
 // GetSize returns the size of the file
 func (r *RemoteReader) GetSize() int32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	return r.file.Size
 }
 
 // SetSize set file size
 func (r *RemoteReader) SetSize(size int32) {
-	var mutex = &sync.Mutex{}
-	mutex.Lock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.file.Size = size
-	mutex.Unlock()
+	r.file.Inode = r.file.fetchedInode
+}
+
+// StartAt sets the offset of the next read. The data before offset is never read.
+func (r *RemoteReader) StartAt(offset int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.file.BytesRead = int32(offset)
+	r.file.Size = int32(offset)
+	r.file.Inode = r.file.fetchedInode
+}
+
+// Position returns the inode of the file and the offset of the data read from it.
+// The inode is zero if the size has not been fetched yet.
+func (r *RemoteReader) Position() (uint64, int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Inode, int64(r.file.BytesRead)
+}
+
+// Filtered returns true if the host filters the lines: the data received is not at its offset in the file.
+func (r *RemoteReader) Filtered() bool {
+	return !r.filter.IsEmpty()
+}
+
+// Stat returns the inode and the size of the file.
+func (r *RemoteReader) Stat(ctx context.Context) (uint64, int64, error) {
+	size, stderr, err := r.FetchSize(ctx)
+	if err == nil {
+		err = stderr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.fetchedInode, int64(size), nil
+}
+
+// LineStart returns the offset of the first line beginning at or after offset.
+func (r *RemoteReader) LineStart(ctx context.Context, offset int64) (int64, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+
+	err := r.run(ctx, lineStartCommand(r.file.Path, offset), &stdout, &stderr)
+	if stderr.Len() > 0 {
+		return 0, errors.New(strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(stdout.String()), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidSize
+	}
+	return offset - 1 + n, nil
 }
 
 // FetchSize will fetch the size from the remote client
 // FetchSize returns two errors: the first one is when something is wrong with the file but the connection is ok, the second when the client is down.
-func (r *RemoteReader) FetchSize() (int32, error, error) {
+func (r *RemoteReader) FetchSize(ctx context.Context) (int32, error, error) {
+	if r.poller != nil {
+		res := r.poller.fetchStat(ctx, r.file.Path, r.commandTimeout)
+		if res.stderr == nil && res.err == nil {
+			r.setFetchedInode(res.inode)
+		}
+		return res.size, res.stderr, res.err
+	}
+
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	err := r.client.Cmd(r.file.StatCommand()).SetStdio(&stdout, &stderr).Run()
+	err := r.run(ctx, r.file.StatCommand(), &stdout, &stderr)
+	if err != nil && (err == ErrTimeout || err == ctx.Err()) {
+		return 0, nil, err
+	}
 	if err != nil {
 		if len(stderr.Bytes()) == 0 {
 			return 0, nil, ErrClient
@@ -163,11 +589,18 @@ func (r *RemoteReader) FetchSize() (int32, error, error) {
 		}
 	}
 
-	size, err := strconv.ParseInt(strings.Trim(stdout.String(), "\n"), 10, 32)
+	size, inode, err := parseStat(stdout.String())
 	if err != nil {
-		return 0, ErrInvalidSize, nil
+		return 0, err, nil
 	}
-	return int32(size), nil, nil
+	r.setFetchedInode(inode)
+	return size, nil, nil
+}
+
+func (r *RemoteReader) setFetchedInode(inode uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.file.fetchedInode = inode
 }
 
 // computeNextChunkSize compute the size of the next chunk in bytes
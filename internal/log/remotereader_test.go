@@ -1,6 +1,19 @@
 package log
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
 
 func TestComputeNextChunk(t *testing.T) {
 	res := computeNextChunkSize(100, 20, 20)
@@ -18,3 +31,214 @@ func TestComputeNextChunk(t *testing.T) {
 		t.Errorf("Expected: %d. Actual: %d", 10, res)
 	}
 }
+
+// runShell runs cmd with the local shell and returns its stdout.
+func runShell(t *testing.T, cmd string) string {
+	var stdout, stderr bytes.Buffer
+	if err := newShellRunner().Run(context.Background(), cmd, &stdout, &stderr); err != nil || stderr.Len() > 0 {
+		t.Fatalf("Command failed: %s %v %s", cmd, err, stderr.String())
+	}
+	return stdout.String()
+}
+
+func writeTestLog(t *testing.T, content string) (string, func()) {
+	f, err := ioutil.TempFile("", "remotereader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func TestNextChunkCommand(t *testing.T) {
+	path, remove := writeTestLog(t, "abcdef")
+	defer remove()
+
+	file := logFile{Path: path}
+	if out := runShell(t, file.NextChunkCommand(2)); out != "ab" {
+		t.Errorf("Expected: ab. Actual: %s", out)
+	}
+
+	file.BytesRead = 2
+	if out := runShell(t, file.NextChunkCommand(2)); out != "cd" {
+		t.Errorf("Expected: cd. Actual: %s", out)
+	}
+}
+
+func TestCommandsQuotePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotereader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "it's a $HOME *.log")
+	if err := ioutil.WriteFile(path, []byte("line 1\nline 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a file matching the glob must not be read instead
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.log"), []byte("other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	file := logFile{Path: path}
+	if out := runShell(t, file.StatCommand()); !strings.HasPrefix(out, "14 ") {
+		t.Errorf("Expected: size 14. Actual: %s", out)
+	}
+	if out := runShell(t, file.NextChunkCommand(6)); out != "line 1" {
+		t.Errorf("Expected: %q. Actual: %q", "line 1", out)
+	}
+	if out := runShell(t, file.NextFilteredChunkCommand(14, conf.Filter{Include: []string{"2"}}, false)); out != "14\nline 2\n" {
+		t.Errorf("Expected: %q. Actual: %q", "14\nline 2\n", out)
+	}
+	if out := runShell(t, lineStartCommand(path, 3)); strings.TrimSpace(out) != "5" {
+		t.Errorf("Expected: 5. Actual: %q", out)
+	}
+}
+
+func TestNextFilteredChunkCommand(t *testing.T) {
+	content := "INFO start\nDEBUG it's noisy\nERROR failed\nINFO partial"
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	file := logFile{Path: path}
+	size := int32(len(content))
+
+	// the partial line is not read
+	filter := conf.Filter{Include: []string{"INFO|ERROR"}, Exclude: []string{"it's"}}
+	out := runShell(t, file.NextFilteredChunkCommand(size, filter, false))
+	expected := fmt.Sprintf("%d\nINFO start\nERROR failed\n", len("INFO start\nDEBUG it's noisy\nERROR failed\n"))
+	if out != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, out)
+	}
+
+	// offsets are raw file positions
+	file.BytesRead = int32(len("INFO start\n"))
+	out = runShell(t, file.NextFilteredChunkCommand(size-file.BytesRead, conf.Filter{Exclude: []string{"noisy"}}, false))
+	expected = fmt.Sprintf("%d\nERROR failed\n", len("DEBUG it's noisy\nERROR failed\n"))
+	if out != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, out)
+	}
+
+	// no line matches
+	file.BytesRead = 0
+	out = runShell(t, file.NextFilteredChunkCommand(size, conf.Filter{Include: []string{"WARN"}}, false))
+	expected = fmt.Sprintf("%d\n", len("INFO start\nDEBUG it's noisy\nERROR failed\n"))
+	if out != expected {
+		t.Errorf("Expected: %q. Actual: %q", expected, out)
+	}
+
+	// a line longer than the chunk is read when more data follows. It is split in two lines.
+	out = runShell(t, file.NextFilteredChunkCommand(4, conf.Filter{Include: []string{"INFO"}}, true))
+	if out != "4\nINFO\n" {
+		t.Errorf("Expected: %q. Actual: %q", "4\nINFO\n", out)
+	}
+
+	// the end of the file is a partial line
+	file.BytesRead = int32(len("INFO start\nDEBUG it's noisy\nERROR failed\n"))
+	out = runShell(t, file.NextFilteredChunkCommand(size-file.BytesRead, conf.Filter{Include: []string{"INFO"}}, false))
+	if out != "0\n" {
+		t.Errorf("Expected: %q. Actual: %q", "0\n", out)
+	}
+}
+
+// noGzipRunner runs the commands like a host without gzip.
+type noGzipRunner struct {
+	*shellRunner
+}
+
+func (n noGzipRunner) Run(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	if cmd == "command -v gzip" {
+		return errors.New("exit status 1")
+	}
+	return n.shellRunner.Run(ctx, cmd, stdout, stderr)
+}
+
+func newTestRemoteReader(runner commandRunner, c conf.LoggerConfiguration, size int32) *RemoteReader {
+	r := NewRemoteReader(nil, c)
+	r.runner = runner
+	r.SetSize(size)
+	return r
+}
+
+func TestRemoteReaderCompression(t *testing.T) {
+	content := strings.Repeat("INFO the same line again and again\n", 100)
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	size := int32(len(content))
+	for _, filter := range []conf.Filter{{}, {Include: []string{"INFO"}}} {
+		r := newTestRemoteReader(newShellRunner(), conf.LoggerConfiguration{File: path, Compression: true, Filter: filter}, size)
+
+		data, stderr, err := r.ReadNextChunk(context.Background())
+		if stderr != nil || err != nil {
+			t.Fatalf("Expected: no error. Actual: %v %v", stderr, err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected: content decompressed. Actual: %q", data)
+		}
+
+		stats := r.Stats()
+		if !stats.Compressed {
+			t.Error("Expected: compressed. Actual: not compressed")
+		}
+		if stats.FileBytes != int64(size) || stats.DeliveredBytes != int64(size) {
+			t.Errorf("Expected: %d bytes read and delivered. Actual: %+v", size, stats)
+		}
+		if stats.WireBytes == 0 || stats.WireBytes >= stats.FileBytes {
+			t.Errorf("Expected: less bytes on the wire than read. Actual: %+v", stats)
+		}
+	}
+}
+
+func TestRemoteReaderCompressionFallback(t *testing.T) {
+	content := "INFO start\nERROR failed\n"
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	r := newTestRemoteReader(noGzipRunner{newShellRunner()}, conf.LoggerConfiguration{File: path, Compression: true}, int32(len(content)))
+
+	data, stderr, err := r.ReadNextChunk(context.Background())
+	if stderr != nil || err != nil {
+		t.Fatalf("Expected: no error. Actual: %v %v", stderr, err)
+	}
+	if string(data) != content {
+		t.Errorf("Expected: %q. Actual: %q", content, data)
+	}
+
+	stats := r.Stats()
+	if stats.Compressed {
+		t.Error("Expected: not compressed. Actual: compressed")
+	}
+	if stats.WireBytes != int64(len(content)) {
+		t.Errorf("Expected: %d bytes on the wire. Actual: %d", len(content), stats.WireBytes)
+	}
+}
+
+func TestRemoteReaderCompressionMissingFile(t *testing.T) {
+	r := newTestRemoteReader(newShellRunner(), conf.LoggerConfiguration{File: "/missing/file.log", Compression: true}, 10)
+
+	_, stderr, err := r.ReadNextChunk(context.Background())
+	if stderr == nil || err != nil {
+		t.Errorf("Expected: stderr of the missing file. Actual: %v %v", stderr, err)
+	}
+}
+
+func TestRemoteReaderReadChunk(t *testing.T) {
+	content := "line1\nline2\nline3\n"
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	r := newTestRemoteReader(newShellRunner(), conf.LoggerConfiguration{File: path}, 0)
+	data, err := r.ReadChunk(context.Background(), 6, 100)
+	if err != nil || string(data) != "line2\nline3\n" {
+		t.Errorf("Expected: %q. Actual: %q %v", "line2\nline3\n", data, err)
+	}
+
+	// the offsets of the filtered lines are unknown
+	r = newTestRemoteReader(newShellRunner(), conf.LoggerConfiguration{File: path, Filter: conf.Filter{Include: []string{"line"}}}, 0)
+	if _, err := r.ReadChunk(context.Background(), 0, 100); err != ErrNoOlderData {
+		t.Errorf("Expected: %s. Actual: %v", ErrNoOlderData, err)
+	}
+}
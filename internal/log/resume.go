@@ -0,0 +1,191 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+var (
+	// DefaultMaxCatchUp is the maximum number of bytes read when resuming if the configuration doesn't set it.
+	DefaultMaxCatchUp int64 = 10 * 1024 * 1024
+
+	// StateSaveInterval is how often the positions of the loggers are saved in the state file.
+	StateSaveInterval = 30 * time.Second
+)
+
+// resumableReader is implemented by the FileReaders which can start reading in the middle of the file.
+type resumableReader interface {
+	// Stat returns the inode and the size of the file.
+	Stat(ctx context.Context) (uint64, int64, error)
+
+	// LineStart returns the offset of the first line beginning at or after offset.
+	LineStart(ctx context.Context, offset int64) (int64, error)
+
+	// StartAt sets the offset of the next read.
+	StartAt(offset int64)
+
+	// Position returns the inode of the file and the offset of the data read. The inode is zero if unknown.
+	Position() (uint64, int64)
+
+	// Filtered returns true if the data received is not at its offset in the file.
+	Filtered() bool
+}
+
+// serviceState is the position reached in the file of a service.
+type serviceState struct {
+	Host  string `json:"host"`
+	File  string `json:"file"`
+	Inode uint64 `json:"inode"`
+
+	// offset in the file after the last line received
+	Offset int64 `json:"offset"`
+
+	// last lines received. Empty if the window is not saved.
+	Window []byte `json:"window,omitempty"`
+
+	Saved time.Time `json:"saved"`
+}
+
+// stateFile is the content of the state file.
+type stateFile struct {
+	Services map[string]serviceState `json:"services"`
+}
+
+// DefaultStateFile returns the state file under the user cache directory.
+func DefaultStateFile() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "lazylogger", "state.json"), nil
+}
+
+// readStateFile returns the states saved in path by service name. A missing file has no state.
+func readStateFile(path string) (map[string]serviceState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]serviceState), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f stateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Services == nil {
+		f.Services = make(map[string]serviceState)
+	}
+	return f.Services, nil
+}
+
+// writeStateFile writes the states in path. The file is replaced at once so a crash never leaves it half written.
+func writeStateFile(path string, states map[string]serviceState) error {
+	data, err := json.Marshal(stateFile{Services: states})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// maxCatchUp returns the maximum number of bytes read when resuming.
+func maxCatchUp(r conf.Resume) int64 {
+	if r.MaxCatchUp == 0 {
+		return DefaultMaxCatchUp
+	}
+	return int64(r.MaxCatchUp)
+}
+
+// resume makes the logger read from the position saved in s. It must be called before Start.
+// If the file has been rotated or truncated since, the new file is read from its beginning.
+// At most maxCatchUp bytes are read: above, the reading starts at the first line of the last maxCatchUp bytes.
+// The saved window is written to the cache if the reading continues right after it.
+func (l *Logger) resume(ctx context.Context, r resumableReader, s serviceState, maxCatchUp int64) error {
+	inode, size, err := r.Stat(ctx)
+	if err != nil {
+		return err
+	}
+
+	start, window := s.Offset, s.Window
+	if inode != s.Inode || size < s.Offset {
+		glog.V(1).Infof("File of logger %d has changed since the last run. Reading from the beginning.", l.ID)
+		start, window = 0, nil
+	}
+
+	if maxCatchUp > 0 && size-start > maxCatchUp {
+		glog.V(1).Infof("Logger %d skips %d bytes logged since the last run.", l.ID, size-maxCatchUp-start)
+		if start, err = r.LineStart(ctx, size-maxCatchUp); err != nil {
+			return err
+		}
+		window = nil
+	}
+
+	l.mutex.Lock()
+	l.fileBase = int64(len(window)) - start
+	l.mutex.Unlock()
+
+	l.cache.Write(window)
+	r.StartAt(start)
+	return nil
+}
+
+// resumeState returns the position reached by the logger and the last RequestDataMaxSize bytes of lines if window is true.
+// It returns false if the reader cannot resume or the file has not been read yet.
+func (l *Logger) resumeState(window bool) (serviceState, bool) {
+	l.mutex.Lock()
+	reader, fileBase := l.reader, l.fileBase
+	l.mutex.Unlock()
+
+	r, ok := reader.(resumableReader)
+	if !ok {
+		return serviceState{}, false
+	}
+	inode, position := r.Position()
+	if inode == 0 {
+		return serviceState{}, false
+	}
+
+	_, memory, end := l.cache.bounds()
+
+	// the data received has not been written yet if it ends with a partial line
+	s := serviceState{Inode: inode, Offset: end - fileBase, Saved: time.Now()}
+	if r.Filtered() {
+		s.Offset = position
+	}
+
+	if window {
+		start := end - RequestDataMaxSize
+		if start < memory {
+			start = memory
+		}
+		if !r.Filtered() && start < fileBase {
+			// the data before fileBase was in a file which has been rotated
+			start = fileBase
+		}
+
+		data := make([]byte, end-start)
+		n, _ := l.cache.readStream(data, start)
+		if data, _, err := alignToLine(data[:n], start, start > memory && start != fileBase); err == nil {
+			s.Window = data
+		}
+	}
+
+	return s, true
+}
@@ -0,0 +1,162 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lazylogger", "state.json")
+	states, err := readStateFile(path)
+	if err != nil || len(states) != 0 {
+		t.Fatalf("Expected: no state. Actual: %v %v", states, err)
+	}
+
+	saved := map[string]serviceState{
+		"app": {Host: "host", File: "/var/log/app.log", Inode: 12, Offset: 34, Window: []byte("line\n")},
+	}
+	if err := writeStateFile(path, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err = readStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(states, saved) {
+		t.Errorf("Expected: %v. Actual: %v", saved, states)
+	}
+}
+
+// newTestResumeLogger returns a logger and a reader of path which are not started.
+func newTestResumeLogger(t *testing.T, path string) (*Logger, *RemoteReader) {
+	logger, err := NewLogger(1, make(chan interface{}, 10), conf.Poll{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger, newTestRemoteReader(newShellRunner(), conf.LoggerConfiguration{File: path}, 0)
+}
+
+func TestLoggerResume(t *testing.T) {
+	content := "line 1\nline 2\nline 3\nline 4\n"
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	_, r := newTestResumeLogger(t, path)
+	inode, _, err := r.Stat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		state      serviceState
+		maxCatchUp int64
+		start      int64
+		cache      string
+	}{
+		{
+			name:  "continue after the window",
+			state: serviceState{Inode: inode, Offset: 14, Window: []byte("line 2\n")},
+			start: 14,
+			cache: "line 2\n",
+		},
+		{
+			name:       "skip above the maximum catch-up",
+			state:      serviceState{Inode: inode, Offset: 7, Window: []byte("line 1\n")},
+			maxCatchUp: 10,
+			start:      21,
+		},
+		{
+			name:       "catch-up ending at a line start",
+			state:      serviceState{Inode: inode},
+			maxCatchUp: 14,
+			start:      14,
+		},
+		{
+			name:  "rotated file",
+			state: serviceState{Inode: inode + 1, Offset: 14, Window: []byte("line 2\n")},
+			start: 0,
+		},
+		{
+			name:  "truncated file",
+			state: serviceState{Inode: inode, Offset: 100},
+			start: 0,
+		},
+	}
+
+	for _, test := range tests {
+		logger, r := newTestResumeLogger(t, path)
+		if err := logger.resume(context.Background(), r, test.state, test.maxCatchUp); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if gotInode, offset := r.Position(); gotInode != inode || offset != test.start {
+			t.Errorf("%s: Expected: %d at %d. Actual: %d at %d", test.name, inode, test.start, gotInode, offset)
+		}
+		data, n := logger.RequestData(0, 100)
+		if string(data[:n]) != test.cache {
+			t.Errorf("%s: Expected: cache %q. Actual: %q", test.name, test.cache, data[:n])
+		}
+
+		// the next read continues at the start
+		r.SetSize(int32(len(content)))
+		next, _, _ := r.ReadNextChunk(context.Background())
+		if string(next) != content[test.start:] {
+			t.Errorf("%s: Expected: %q. Actual: %q", test.name, content[test.start:], next)
+		}
+	}
+}
+
+func TestLoggerResumeState(t *testing.T) {
+	content := "line 1\nline 2\nline 3\n"
+	path, remove := writeTestLog(t, content)
+	defer remove()
+
+	logger, r := newTestResumeLogger(t, path)
+	if _, ok := logger.resumeState(true); ok {
+		t.Errorf("Expected: no state before the logger is started")
+	}
+
+	inode, _, err := r.Stat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.resume(context.Background(), r, serviceState{Inode: inode, Offset: 7, Window: []byte("line 1\n")}, 0); err != nil {
+		t.Fatal(err)
+	}
+	logger.reader = r
+
+	// the partial line is not received yet
+	r.SetSize(int32(len(content)))
+	data, _, _ := r.ReadNextChunk(context.Background())
+	logger.cache.Write(data[:7])
+
+	s, ok := logger.resumeState(true)
+	if !ok {
+		t.Fatal("Expected: state")
+	}
+	if s.Inode != inode || s.Offset != 14 {
+		t.Errorf("Expected: %d at 14. Actual: %d at %d", inode, s.Inode, s.Offset)
+	}
+	if string(s.Window) != "line 1\nline 2\n" {
+		t.Errorf("Expected: window with the lines received. Actual: %q", s.Window)
+	}
+
+	s, _ = logger.resumeState(false)
+	if s.Window != nil {
+		t.Errorf("Expected: no window. Actual: %q", s.Window)
+	}
+}
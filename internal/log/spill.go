@@ -0,0 +1,317 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+var (
+	// DefaultSpillMaxSize is the maximum number of compressed bytes kept on disk by a logger if its configuration doesn't set it.
+	DefaultSpillMaxSize int64 = 64 * 1024 * 1024
+
+	// DefaultSegmentSize is the number of bytes written in a segment file before it is compressed.
+	DefaultSegmentSize = 1024 * 1024
+)
+
+// segmentStore keeps the data evicted from the cache of a logger in compressed segment files.
+// The last segment is kept in memory until it is full. The oldest segments are removed when the
+// store exceeds its maximum size or when they are older than the maximum age.
+// Offsets are counted from the first byte written to the logger. It is safe for concurrent use.
+// The segments are compressed and written, and the files removed, without holding the mutex:
+// the store is written by the cache while the cache is locked.
+type segmentStore struct {
+	dir string
+
+	// retention policy
+	maxSize int64
+	maxAge  time.Duration
+
+	// number of bytes of a segment
+	segmentSize int
+
+	mutex *sync.Mutex
+
+	// segments written on disk or being written, the oldest first
+	segments []segment
+
+	// disk operations running without the mutex
+	pending *sync.WaitGroup
+
+	// true once closed. The data written after is dropped.
+	closed bool
+
+	// data of the segment not written yet and its offset
+	current      []byte
+	currentStart int64
+
+	// last segment read. Scrolling reads the same segment many times.
+	lastRead     string
+	lastReadData []byte
+}
+
+// segment is a compressed file holding the data between start and end.
+type segment struct {
+	path       string
+	start, end int64
+
+	// data of the segment while it is being written. Nil once written.
+	data []byte
+
+	// size on disk
+	size    int64
+	created time.Time
+}
+
+// newSegmentStore returns a store writing its segments in dir. The segments of a previous run are removed.
+func newSegmentStore(dir string, spill conf.Spill) (*segmentStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	maxSize := int64(spill.MaxSize)
+	if maxSize <= 0 {
+		maxSize = DefaultSpillMaxSize
+	}
+
+	return &segmentStore{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      spill.MaxAge,
+		segmentSize: DefaultSegmentSize,
+		mutex:       &sync.Mutex{},
+		pending:     &sync.WaitGroup{},
+	}, nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// spillDir returns the directory of the segments of a logger under the user cache directory.
+func spillDir(id int, name string) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "lazylogger", "spill", fmt.Sprintf("%d-%s", id, unsafePathChars.ReplaceAllString(name, "_"))), nil
+}
+
+// Write appends p to the store. The current segment is written on disk once full.
+func (s *segmentStore) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return len(p), nil
+	}
+	s.current = append(s.current, p...)
+	if len(s.current) >= s.segmentSize {
+		s.flush()
+	}
+	s.removeExpired()
+
+	return len(p), nil
+}
+
+// First returns the offset of the oldest byte in the store.
+func (s *segmentStore) First() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.segments) > 0 {
+		return s.segments[0].start
+	}
+	return s.currentStart
+}
+
+// ReadAt reads the data at offset off. It returns the number of bytes read: it is less than len(p)
+// if the data has been removed from the store or is not in the store yet.
+func (s *segmentStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for i := range s.segments {
+		seg := &s.segments[i]
+		if off+int64(n) >= seg.end || n == len(p) {
+			continue
+		}
+		if off+int64(n) < seg.start {
+			// removed from the store
+			return n, nil
+		}
+
+		data, err := s.read(seg)
+		if err != nil {
+			return n, err
+		}
+		from := off + int64(n) - seg.start
+		if from >= int64(len(data)) {
+			return n, ErrCompressedData
+		}
+		n += copy(p[n:], data[from:])
+	}
+
+	if n < len(p) && off+int64(n) >= s.currentStart {
+		from := off + int64(n) - s.currentStart
+		if from < int64(len(s.current)) {
+			n += copy(p[n:], s.current[from:])
+		}
+	}
+
+	return n, nil
+}
+
+// Close removes the segments. It waits for the segments being written.
+func (s *segmentStore) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.segments = nil
+	s.current = nil
+	s.lastRead = ""
+	s.lastReadData = nil
+	s.mutex.Unlock()
+
+	s.pending.Wait()
+	return os.RemoveAll(s.dir)
+}
+
+// flush starts writing the current segment on disk. Its data is read from memory until it is written.
+// The mutex must be held.
+func (s *segmentStore) flush() {
+	seg := segment{
+		path:    filepath.Join(s.dir, fmt.Sprintf("%020d.gz", s.currentStart)),
+		start:   s.currentStart,
+		end:     s.currentStart + int64(len(s.current)),
+		data:    s.current,
+		created: time.Now(),
+	}
+
+	s.currentStart = seg.end
+	s.current = nil
+	s.segments = append(s.segments, seg)
+
+	s.pending.Add(1)
+	go s.write(seg)
+}
+
+// write compresses seg in its file and removes the oldest segments above the maximum size.
+func (s *segmentStore) write(seg segment) {
+	defer s.pending.Done()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(seg.data)
+	gz.Close()
+	err := ioutil.WriteFile(seg.path, buf.Bytes(), 0600)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the directory is removed by Close
+	if s.closed {
+		return
+	}
+
+	i := s.index(seg.path)
+	if i < 0 {
+		// removed from the store while being written
+		os.Remove(seg.path)
+		return
+	}
+	if err != nil {
+		glog.Errorf("cannot write segment %s: %s", seg.path, err)
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		return
+	}
+	s.segments[i].size = int64(buf.Len())
+	s.segments[i].data = nil
+
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for len(s.segments) > 0 && total > s.maxSize {
+		total -= s.segments[0].size
+		s.removeOldest()
+	}
+}
+
+// removeExpired removes the segments older than the maximum age.
+func (s *segmentStore) removeExpired() {
+	for s.maxAge > 0 && len(s.segments) > 0 && time.Since(s.segments[0].created) > s.maxAge {
+		s.removeOldest()
+	}
+}
+
+// removeOldest removes the oldest segment. Its file is removed without holding the mutex.
+// A segment being written is removed once written.
+func (s *segmentStore) removeOldest() {
+	seg := s.segments[0]
+	if s.lastRead == seg.path {
+		s.lastRead = ""
+		s.lastReadData = nil
+	}
+	s.segments = s.segments[1:]
+
+	if seg.data != nil {
+		return
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		if err := os.Remove(seg.path); err != nil {
+			glog.Warningf("cannot remove segment %s: %s", seg.path, err)
+		}
+	}()
+}
+
+// index returns the index of the segment of the file path. It returns -1 if the segment is not in the store.
+func (s *segmentStore) index(path string) int {
+	for i := range s.segments {
+		if s.segments[i].path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// read returns the decompressed data of seg.
+func (s *segmentStore) read(seg *segment) ([]byte, error) {
+	if seg.data != nil {
+		return seg.data, nil
+	}
+	if s.lastRead == seg.path {
+		return s.lastReadData, nil
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lastRead = seg.path
+	s.lastReadData = data
+	return data, nil
+}
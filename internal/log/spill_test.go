@@ -0,0 +1,129 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func newTestSegmentStore(t *testing.T, spill conf.Spill, segmentSize int) (*segmentStore, string) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSegmentStore(filepath.Join(dir, "logger"), spill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.segmentSize = segmentSize
+	return s, dir
+}
+
+func TestSegmentStore(t *testing.T) {
+	s, dir := newTestSegmentStore(t, conf.Spill{}, 10)
+	defer os.RemoveAll(dir)
+
+	data := "0123456789abcdefghij012345"
+	s.Write([]byte(data[:4]))
+	s.Write([]byte(data[4:12]))
+	s.Write([]byte(data[12:]))
+
+	// read the segments being written
+	p := make([]byte, 20)
+	if n, err := s.ReadAt(p, 5); err != nil || string(p[:n]) != data[5:25] {
+		t.Errorf("Expected: %q. Actual: %q %v", data[5:25], p[:n], err)
+	}
+
+	s.pending.Wait()
+	files, _ := ioutil.ReadDir(s.dir)
+	if len(files) != 2 {
+		t.Errorf("Expected: 2 segments. Actual: %d", len(files))
+	}
+
+	// read across the segments and the current segment
+	if n, err := s.ReadAt(p, 5); err != nil || string(p[:n]) != data[5:25] {
+		t.Errorf("Expected: %q. Actual: %q %v", data[5:25], p[:n], err)
+	}
+
+	// read past the end
+	if n, _ := s.ReadAt(p, 24); string(p[:n]) != data[24:] {
+		t.Errorf("Expected: %q. Actual: %q", data[24:], p[:n])
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected: spill directory removed. Actual: %v", err)
+	}
+}
+
+func TestSegmentStoreRetention(t *testing.T) {
+	s, dir := newTestSegmentStore(t, conf.Spill{MaxAge: 200 * time.Millisecond}, 1000)
+	defer os.RemoveAll(dir)
+
+	line := strings.Repeat("x", 999) + "\n"
+	s.Write([]byte(line))
+	s.Write([]byte(line))
+	s.pending.Wait()
+
+	// the size of the 2 segments is the limit
+	s.maxSize = s.segments[0].size + s.segments[1].size
+	s.Write([]byte(line))
+	s.pending.Wait()
+
+	if len(s.segments) != 2 || s.First() != 1000 {
+		t.Errorf("Expected: oldest segment removed. Actual: %d segments starting at %d", len(s.segments), s.First())
+	}
+	if n, _ := s.ReadAt(make([]byte, 10), 0); n != 0 {
+		t.Errorf("Expected: removed data not read. Actual: %d bytes", n)
+	}
+
+	<-time.After(300 * time.Millisecond)
+	s.Write([]byte("new"))
+	if len(s.segments) != 0 || s.First() != 3000 {
+		t.Errorf("Expected: expired segments removed. Actual: %d segments starting at %d", len(s.segments), s.First())
+	}
+}
+
+func TestCacheSpill(t *testing.T) {
+	s, dir := newTestSegmentStore(t, conf.Spill{}, 8)
+	defer os.RemoveAll(dir)
+
+	c := newCache(16)
+	c.spill = s
+
+	var data string
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n", "line5\n", "line6\n"} {
+		c.Write([]byte(line))
+		data += line
+	}
+
+	first, offset, end := c.bounds()
+	if first != 0 || offset != 24 || end != int64(len(data)) {
+		t.Errorf("Expected: bounds 0 24 %d. Actual: %d %d %d", len(data), first, offset, end)
+	}
+
+	// read from disk and memory
+	p := make([]byte, len(data))
+	if n, err := c.readStream(p, 0); err != nil || string(p[:n]) != data {
+		t.Errorf("Expected: %q. Actual: %q %v", data, p[:n], err)
+	}
+
+	// the data freed by the budget is spilled too
+	c.shrink(c.Memory())
+	if n, err := c.readStream(p, 0); err != nil || string(p[:n]) != data {
+		t.Errorf("Expected: %q. Actual: %q %v", data, p[:n], err)
+	}
+
+	c.clear()
+	if _, err := os.Stat(s.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected: spill directory removed. Actual: %v", err)
+	}
+}
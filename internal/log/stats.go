@@ -0,0 +1,31 @@
+package log
+
+// Stats holds the number of bytes transferred by a reader.
+type Stats struct {
+	// FileBytes is the number of bytes read from the file.
+	FileBytes int64
+
+	// WireBytes is the number of bytes received from the host.
+	WireBytes int64
+
+	// DeliveredBytes is the number of bytes delivered to the logger, once filtered and decompressed.
+	DeliveredBytes int64
+
+	// Compressed is true if the host compresses the data.
+	Compressed bool
+}
+
+// statsReader is implemented by the FileReaders counting the bytes transferred.
+type statsReader interface {
+	Stats() Stats
+}
+
+// LoggerStats holds the stats of a running logger.
+type LoggerStats struct {
+	ID   int
+	Name string
+	Host string
+	File string
+
+	Stats
+}
@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Authentication methods which can be listed in conf.Host.Auth.
+const (
+	// AuthAgent authenticates with the keys held by the ssh-agent listening on SSH_AUTH_SOCK.
+	AuthAgent = "agent"
+
+	// AuthKey authenticates with the private key file set in conf.Host.Key.
+	AuthKey = "key"
+
+	// AuthPassword authenticates with conf.Host.Password. If the password is "prompt", it is asked to the user.
+	AuthPassword = "password"
+
+	// AuthKeyboardInteractive lets the user answer the questions of the server (e.g. OTP).
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// ErrNoAgent means that SSH_AUTH_SOCK is not set.
+var ErrNoAgent = errors.New("ssh-agent not available: SSH_AUTH_SOCK is not set")
+
+// ErrNoAuthMethod means that none of the authentication methods of a host can be used.
+var ErrNoAuthMethod = errors.New("no authentication method available")
+
+// authOrder returns the authentication methods of host in the order they are tried.
+// If host.Auth is empty, the key or the password is used if set. Otherwise, the agent is used.
+// In both cases, keyboard-interactive comes last.
+func authOrder(host conf.Host) []string {
+	if len(host.Auth) > 0 {
+		order := make([]string, 0, len(host.Auth))
+		for _, method := range host.Auth {
+			order = append(order, strings.ToLower(strings.TrimSpace(method)))
+		}
+		return order
+	}
+
+	switch {
+	case len(host.Key) > 0:
+		return []string{AuthKey, AuthKeyboardInteractive}
+	case len(host.Password) > 0:
+		return []string{AuthPassword, AuthKeyboardInteractive}
+	default:
+		return []string{AuthAgent, AuthKeyboardInteractive}
+	}
+}
+
+// usesAgent returns true if any of the hosts authenticates with the agent.
+func usesAgent(hosts ...conf.Host) bool {
+	for _, host := range hosts {
+		for _, method := range authOrder(host) {
+			if method == AuthAgent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostAgent connects to the ssh-agent if one of the hosts authenticates with it.
+// The returned function closes the connection to the agent and it is never nil.
+// If the agent cannot be reached, a nil agent is returned and the agent method will be skipped.
+func hostAgent(hosts ...conf.Host) (agent.Agent, func()) {
+	noop := func() {}
+	if !usesAgent(hosts...) {
+		return nil, noop
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if len(socket) == 0 {
+		glog.Warning(ErrNoAgent)
+		return nil, noop
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		glog.Warningf("cannot connect to ssh-agent: %s", err)
+		return nil, noop
+	}
+
+	return agent.NewClient(conn), func() { conn.Close() }
+}
+
+// authMethods returns the ssh auth methods for host at addr in the order set by authOrder.
+// Agent and key signers are merged into a single publickey method because the ssh client tries
+// every method type only once. A method which cannot be used (agent down, key unreadable) is skipped
+// as long as another method is left. Secrets missing from the configuration are asked with creds.
+func authMethods(host conf.Host, addr string, agentClient agent.Agent, creds *Credentials) ([]ssh.AuthMethod, error) {
+	var (
+		methods   []ssh.AuthMethod
+		signers   []ssh.Signer
+		hasPubKey bool
+		lastErr   error
+	)
+
+	for _, method := range authOrder(host) {
+		switch method {
+		case AuthAgent:
+			if agentClient == nil {
+				lastErr = ErrNoAgent
+				continue
+			}
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				glog.Warningf("cannot read keys from ssh-agent: %s", err)
+				lastErr = err
+				continue
+			}
+			signers = append(signers, agentSigners...)
+		case AuthKey:
+			if len(host.Key) == 0 {
+				continue
+			}
+			signer, err := privateKeyFile(host, creds)
+			if err != nil {
+				glog.Warningf("cannot read private key %s: %s", host.Key, err)
+				lastErr = err
+				continue
+			}
+			signers = append(signers, signer)
+		case AuthPassword:
+			if host.Password == conf.Prompt {
+				user := host.Username
+				methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+					return creds.password(user, addr)
+				}))
+			} else {
+				methods = append(methods, ssh.Password(host.Password))
+			}
+			continue
+		case AuthKeyboardInteractive:
+			if creds == nil {
+				continue
+			}
+			methods = append(methods, ssh.KeyboardInteractive(creds.challenge(host.Username, addr)))
+			continue
+		default:
+			return nil, fmt.Errorf("unknown authentication method: %s", method)
+		}
+
+		// the publickey method takes the place of the first agent or key entry
+		if !hasPubKey {
+			hasPubKey = true
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return signers, nil
+			}))
+		}
+	}
+
+	if len(methods) == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("%w for %s: %s", ErrNoAuthMethod, host.Address, lastErr)
+		}
+		return nil, fmt.Errorf("%w for %s", ErrNoAuthMethod, host.Address)
+	}
+
+	return methods, nil
+}
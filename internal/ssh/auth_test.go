@@ -0,0 +1,298 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testServer is an in-process ssh server accepting one public key and one password.
+// User certificates signed by the authorized key are accepted too.
+// The password is accepted with keyboard-interactive too, followed by the one time code testCode.
+// Every command succeeds without output except "sleep" which never exits.
+type testServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	// protects config which can get more host keys while serving
+	mutex  sync.Mutex
+	config *ssh.ServerConfig
+}
+
+const testCode = "123456"
+
+func newTestServer(t *testing.T, authorizedKey ssh.PublicKey, password string) *testServer {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if cert, ok := key.(*ssh.Certificate); ok && authorizedKey != nil {
+				checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return bytes.Equal(auth.Marshal(), authorizedKey.Marshal())
+				}}
+				return checker.Authenticate(conn, cert)
+			}
+			if authorizedKey != nil && bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, pwd []byte) (*ssh.Permissions, error) {
+			if len(password) > 0 && string(pwd) == password {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			if len(password) == 0 {
+				return nil, ssh.ErrNoAuth
+			}
+			answers, err := challenge("", "Two factor authentication", []string{"Password: ", "Verification code: "}, []bool{false, true})
+			if err != nil || len(answers) != 2 || answers[0] != password || answers[1] != testCode {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	hostKey := newTestSigner(t)
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{listener: listener, config: config, hostKey: hostKey}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// addHostKey adds a host key to the server config.
+func (s *testServer) addHostKey(key ssh.Signer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config.AddHostKey(key)
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		config := *s.config
+		s.mutex.Unlock()
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, &config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for ch := range chans {
+				if ch.ChannelType() != "session" {
+					ch.Reject(ssh.Prohibited, "only sessions are allowed")
+					continue
+				}
+				go serveSession(ch)
+			}
+		}()
+	}
+}
+
+// serveSession runs the commands of a session. Each command exits with status 0, "sleep" hangs until the session is closed.
+func serveSession(newChannel ssh.NewChannel) {
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		var exec struct{ Command string }
+		ssh.Unmarshal(req.Payload, &exec)
+		if strings.HasPrefix(exec.Command, "sleep") {
+			ssh.DiscardRequests(reqs)
+			return
+		}
+
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestAgent serves an in-process agent holding keys on a unix socket and sets SSH_AUTH_SOCK.
+// It returns a function which stops the agent and restores SSH_AUTH_SOCK.
+func startTestAgent(t *testing.T, keys ...interface{}) func() {
+	dir, err := ioutil.TempDir("", "lazylogger-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	oldSocket, hadSocket := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+
+	return func() {
+		listener.Close()
+		os.RemoveAll(dir)
+		if hadSocket {
+			os.Setenv("SSH_AUTH_SOCK", oldSocket)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	}
+}
+
+// noHostKeyCheck disables the host key verification in tests which are not about it.
+var noHostKeyCheck = &HostKeyVerifier{policy: HostKeyOff}
+
+func TestDialWithAgent(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+
+	stopAgent := startTestAgent(t, key)
+	defer stopAgent()
+
+	server := newTestServer(t, signer.PublicKey(), "")
+	defer server.Close()
+
+	// DialWithAgent verifies the host key against ~/.ssh/known_hosts
+	restoreHome := setTestHome(t)
+	defer restoreHome()
+	trustTestServer(t, server, filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+
+	client, err := DialWithAgent(server.Addr(), "foo")
+	if err != nil {
+		t.Fatalf("Expected: connected with agent. Actual: %s", err)
+	}
+	client.Close()
+}
+
+func TestAgentIsDefault(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+
+	stopAgent := startTestAgent(t, key)
+	defer stopAgent()
+
+	server := newTestServer(t, signer.PublicKey(), "")
+	defer server.Close()
+
+	// no key and no password: the agent must be used
+	client, err := DialHost(context.Background(), server.Addr(), conf.Host{Username: "foo"}, DialOptions{HostKeys: noHostKeyCheck})
+	if err != nil {
+		t.Fatalf("Expected: connected with agent. Actual: %s", err)
+	}
+	client.Close()
+
+	// a password is configured: the agent must not be used
+	_, err = DialHost(context.Background(), server.Addr(), conf.Host{Username: "foo", Password: "wrong"}, DialOptions{HostKeys: noHostKeyCheck})
+	if err == nil {
+		t.Error("Expected: authentication error. Actual: nil")
+	}
+}
+
+func TestAuthFallback(t *testing.T) {
+	_, unknownKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	stopAgent := startTestAgent(t, unknownKey)
+	defer stopAgent()
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	// the agent key is refused, the key file doesn't exist so the password must be used
+	host := conf.Host{
+		Username: "foo",
+		Password: "bar",
+		Key:      "/nonexistent/key",
+		Auth:     []string{"agent", "key", "password"},
+	}
+	client, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: noHostKeyCheck})
+	if err != nil {
+		t.Fatalf("Expected: connected with password. Actual: %s", err)
+	}
+	client.Close()
+}
+
+func TestAuthMethodsOrder(t *testing.T) {
+	methods, err := authMethods(conf.Host{Password: "bar", Auth: []string{"password", "agent"}}, "127.0.0.1:22", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// agent is not available so only the password is left
+	if len(methods) != 1 {
+		t.Errorf("Expected: 1 method. Actual: %d", len(methods))
+	}
+
+	_, err = authMethods(conf.Host{Auth: []string{"agent"}}, "127.0.0.1:22", nil, nil)
+	if err == nil {
+		t.Error("Expected: error when no method is available. Actual: nil")
+	}
+
+	_, err = authMethods(conf.Host{Auth: []string{"kerberos"}}, "127.0.0.1:22", nil, nil)
+	if err == nil {
+		t.Error("Expected: error for unknown method. Actual: nil")
+	}
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateFile returns the path of the user certificate of host: host.Certificate if set,
+// otherwise <key>-cert.pub if it exists next to the key. It returns an empty string if host has no certificate.
+func certificateFile(host conf.Host) string {
+	if len(host.Certificate) > 0 {
+		return host.Certificate
+	}
+
+	if len(host.Key) > 0 {
+		file := host.Key + "-cert.pub"
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+
+	return ""
+}
+
+// loadCertificate reads the OpenSSH user certificate of host. It returns nil if host has no certificate.
+func loadCertificate(host conf.Host) (*ssh.Certificate, error) {
+	file := certificateFile(host)
+	if len(file) == 0 {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse certificate %s: %w", file, err)
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", file)
+	}
+
+	return cert, nil
+}
+
+// certSigner wraps signer so it presents the certificate of host. If host has no certificate, signer is returned.
+func certSigner(host conf.Host, signer ssh.Signer) (ssh.Signer, error) {
+	cert, err := loadCertificate(host)
+	if err != nil || cert == nil {
+		return signer, err
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate %s doesn't match key %s", certificateFile(host), host.Key)
+	}
+
+	if expiry, ok := certExpiry(cert); ok && time.Now().After(expiry) {
+		glog.Warningf("certificate %s expired at %s", certificateFile(host), expiry)
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// certExpiry returns the end of validity of cert. It returns false if the certificate never expires.
+func certExpiry(cert *ssh.Certificate) (time.Time, bool) {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), true
+}
+
+// certificatesExpiry returns the earliest end of validity of the certificates of hosts.
+// It returns false if none of the hosts authenticates with an expiring certificate.
+func certificatesExpiry(hosts ...conf.Host) (time.Time, bool) {
+	var (
+		earliest time.Time
+		found    bool
+	)
+
+	for _, host := range hosts {
+		cert, err := loadCertificate(host)
+		if err != nil || cert == nil {
+			continue
+		}
+		if expiry, ok := certExpiry(cert); ok && (!found || expiry.Before(earliest)) {
+			earliest = expiry
+			found = true
+		}
+	}
+
+	return earliest, found
+}
+
+// readAuthorities reads the public keys of certificate authorities from file.
+// The file has the authorized_keys format, one key per line.
+func readAuthorities(file string) ([]ssh.PublicKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(content)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate authority in %s: %w", file, err)
+		}
+		keys = append(keys, key)
+		content = rest
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,129 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh"
+)
+
+// signTestCert signs a certificate of type certType for key with ca.
+func signTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principal string, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertificateAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazylogger-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	userKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(userKey)
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	ca := newTestSigner(t)
+	server := newTestServer(t, ca.PublicKey(), "")
+	defer server.Close()
+
+	// without certificate the key is refused
+	host := conf.Host{Username: "foo", Key: keyFile}
+	if _, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: noHostKeyCheck}); err == nil {
+		t.Fatal("Expected: key refused without certificate. Actual: connected")
+	}
+
+	userSigner, _ := ssh.NewSignerFromKey(userKey)
+	validBefore := time.Now().Add(10 * time.Minute)
+	cert := signTestCert(t, ca, userSigner.PublicKey(), ssh.UserCert, "foo", validBefore)
+	ioutil.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600)
+
+	client, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: noHostKeyCheck})
+	if err != nil {
+		t.Fatalf("Expected: connected with certificate. Actual: %s", err)
+	}
+	defer client.Close()
+
+	expiry, ok := client.CertificateExpiry()
+	if !ok || expiry.Unix() != validBefore.Unix() {
+		t.Errorf("Expected: expiry %s. Actual: %s %v", validBefore, expiry, ok)
+	}
+
+	// a certificate for another key must be refused
+	other := newTestSigner(t)
+	otherCert := signTestCert(t, ca, other.PublicKey(), ssh.UserCert, "foo", validBefore)
+	certFile := filepath.Join(dir, "other-cert.pub")
+	ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(otherCert), 0600)
+
+	host.Certificate = certFile
+	if _, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: noHostKeyCheck}); err == nil {
+		t.Error("Expected: error for certificate not matching the key. Actual: connected")
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	restoreHome := setTestHome(t)
+	defer restoreHome()
+
+	dir := os.Getenv("HOME")
+	hostCA := newTestSigner(t)
+	caFile := filepath.Join(dir, "host_ca.pub")
+	ioutil.WriteFile(caFile, ssh.MarshalAuthorizedKey(hostCA.PublicKey()), 0600)
+
+	otherCA := newTestSigner(t)
+	otherCAFile := filepath.Join(dir, "other_ca.pub")
+	ioutil.WriteFile(otherCAFile, ssh.MarshalAuthorizedKey(otherCA.PublicKey()), 0600)
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	cert := signTestCert(t, hostCA, server.hostKey.PublicKey(), ssh.HostCert, "127.0.0.1", time.Now().Add(time.Hour))
+	certSigner, err := ssh.NewCertSigner(cert, server.hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.addHostKey(certSigner)
+
+	host := conf.Host{Username: "foo", Password: "bar"}
+
+	// the host is not in known_hosts but its certificate is signed by the authority
+	verifier, err := NewHostKeyVerifier(HostKeyStrict, "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier})
+	if err != nil {
+		t.Fatalf("Expected: host certificate accepted. Actual: %s", err)
+	}
+	client.Close()
+
+	verifier, err = NewHostKeyVerifier(HostKeyStrict, "", otherCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier}); err == nil {
+		t.Error("Expected: host certificate signed by another authority refused. Actual: connected")
+	}
+}
@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ClockSamples is the number of times the clock of a host is read. The sample with the shortest round trip is kept.
+	ClockSamples = 3
+
+	// ClockTimeout is the maximum time taken to measure the clock offset of a host.
+	ClockTimeout = 5 * time.Second
+)
+
+// ErrInvalidClock means the output of the date command cannot be parsed.
+var ErrInvalidClock = errors.New("invalid clock")
+
+// clockCommand prints the time of the host in seconds since the epoch. Without %N (e.g. busybox), the fraction is not a number.
+const clockCommand = "date +%s.%N"
+
+// runFunc runs a command on a host.
+type runFunc func(ctx context.Context, cmd string, stdout io.Writer) error
+
+// measureClockOffset reads the clock of a host samples times and returns the offset of the sample with the shortest
+// round trip: the clock of the host minus the local clock at the middle of the round trip, and the round trip.
+func measureClockOffset(ctx context.Context, run runFunc, samples int, now func() time.Time) (offset, rtt time.Duration, err error) {
+	rtt = -1
+	for i := 0; i < samples; i++ {
+		var stdout bytes.Buffer
+
+		start := now()
+		if err := run(ctx, clockCommand, &stdout); err != nil {
+			return 0, 0, err
+		}
+		end := now()
+
+		remote, err := parseClock(stdout.String())
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sampleRTT := end.Sub(start)
+		if rtt < 0 || sampleRTT < rtt {
+			rtt = sampleRTT
+			offset = remote.Sub(start.Add(sampleRTT / 2))
+		}
+	}
+
+	if rtt < 0 {
+		return 0, 0, ErrInvalidClock
+	}
+	return offset, rtt, nil
+}
+
+// parseClock parses the output of clockCommand. The fraction is ignored if it is not a number.
+func parseClock(output string) (time.Time, error) {
+	parts := strings.SplitN(strings.TrimSpace(output), ".", 2)
+
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidClock
+	}
+
+	var nsec int64
+	if len(parts) == 2 {
+		// nanoseconds with 9 digits
+		fraction := (parts[1] + "000000000")[:9]
+		if n, err := strconv.ParseInt(fraction, 10, 64); err == nil {
+			nsec = n
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// measureClock measures the clock offset of the host of the client. It returns as soon as ctx is done.
+// It must be called before the client is shared: the offset is not protected by a mutex.
+func (c *Client) measureClock(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ClockTimeout)
+	defer cancel()
+
+	run := func(ctx context.Context, cmd string, stdout io.Writer) error {
+		return c.Cmd(cmd).SetStdio(stdout, ioutil.Discard).RunContext(ctx)
+	}
+
+	offset, rtt, err := measureClockOffset(ctx, run, ClockSamples, time.Now)
+	if err != nil {
+		return err
+	}
+	c.clockOffset = offset
+	c.clockRTT = rtt
+	c.clockMeasured = true
+	return nil
+}
+
+// ClockOffset returns the clock of the host minus the local clock, measured when connecting, and the round trip
+// of the measure. It returns false if the offset could not be measured.
+func (c *Client) ClockOffset() (offset, rtt time.Duration, ok bool) {
+	return c.clockOffset, c.clockRTT, c.clockMeasured
+}
@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected time.Time
+		err      bool
+	}{
+		{"1614834367.123456789\n", time.Unix(1614834367, 123456789), false},
+		{"1614834367.5", time.Unix(1614834367, 500000000), false},
+		// busybox doesn't know %N
+		{"1614834367.%N\n", time.Unix(1614834367, 0), false},
+		{"1614834367", time.Unix(1614834367, 0), false},
+		{"", time.Time{}, true},
+		{"date: invalid date", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		actual, err := parseClock(test.output)
+		if (err != nil) != test.err || !actual.Equal(test.expected) {
+			t.Errorf("%q: Expected: %s (error %v). Actual: %s (%v)", test.output, test.expected, test.err, actual, err)
+		}
+	}
+}
+
+func TestMeasureClockOffset(t *testing.T) {
+	local := time.Unix(1614834367, 0)
+	// the host is 3s ahead. The round trips are 400ms, 100ms and 200ms.
+	rtts := []time.Duration{400 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+	// the host answers after 10ms in the second sample: the offset is off by the asymmetry.
+	delays := []time.Duration{300 * time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond}
+
+	sample := 0
+	now := func() time.Time { return local }
+	run := func(ctx context.Context, cmd string, stdout io.Writer) error {
+		if cmd != clockCommand {
+			t.Fatalf("Expected: %q. Actual: %q", clockCommand, cmd)
+		}
+		remote := local.Add(delays[sample]).Add(3 * time.Second)
+		fmt.Fprintf(stdout, "%d.%09d\n", remote.Unix(), remote.Nanosecond())
+		local = local.Add(rtts[sample])
+		sample++
+		return nil
+	}
+
+	offset, rtt, err := measureClockOffset(context.Background(), run, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt != 100*time.Millisecond {
+		t.Errorf("Expected: round trip of the fastest sample 100ms. Actual: %s", rtt)
+	}
+	if expected := 3*time.Second - 40*time.Millisecond; offset != expected {
+		t.Errorf("Expected: offset %s. Actual: %s", expected, offset)
+	}
+
+	failure := errors.New("session closed")
+	run = func(ctx context.Context, cmd string, stdout io.Writer) error { return failure }
+	if _, _, err := measureClockOffset(context.Background(), run, 3, now); err != failure {
+		t.Errorf("Expected: %s. Actual: %v", failure, err)
+	}
+}
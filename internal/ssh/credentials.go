@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoPrompt means that a secret is required but the user cannot be asked for it.
+var ErrNoPrompt = errors.New("secret required but no prompt available")
+
+// ErrPromptCanceled is returned by a PromptFunc when the user cancels the prompt.
+var ErrPromptCanceled = errors.New("prompt canceled by user")
+
+// Question is asked to the user by a PromptFunc.
+type Question struct {
+	Label string
+
+	// Secret is true if the answer must be masked.
+	Secret bool
+}
+
+// PromptFunc asks the questions to the user and returns the answers in the same order.
+// It blocks until the user answers. It is called from the goroutine dialing the connection.
+type PromptFunc func(title string, questions []Question) ([]string, error)
+
+// Credentials asks the user for the secrets missing from the configuration: passwords set to "prompt",
+// passphrases of encrypted keys and keyboard-interactive challenges.
+// Passwords and passphrases are kept in memory, per host and per key, for the whole session. The answers to
+// keyboard-interactive questions are kept only for password questions; one time codes are always asked.
+type Credentials struct {
+	prompt PromptFunc
+
+	// mutex protects secrets. It is held during prompts so the user is asked one question at a time
+	// and concurrent dials to the same host share the answer.
+	mutex   sync.Mutex
+	secrets map[string]string
+}
+
+// NewCredentials returns a Credentials asking the secrets with prompt.
+func NewCredentials(prompt PromptFunc) *Credentials {
+	return &Credentials{
+		prompt:  prompt,
+		secrets: make(map[string]string),
+	}
+}
+
+func passwordID(user, addr string) string {
+	return fmt.Sprintf("password:%s@%s", user, addr)
+}
+
+func passphraseID(keyFile string) string {
+	return fmt.Sprintf("passphrase:%s", keyFile)
+}
+
+// password returns the password of user on addr.
+func (c *Credentials) password(user, addr string) (string, error) {
+	title := fmt.Sprintf(" Password for %s@%s ", user, addr)
+	return c.secret(passwordID(user, addr), title, Question{Label: "Password", Secret: true})
+}
+
+// passphrase returns the passphrase of the private key keyFile.
+func (c *Credentials) passphrase(keyFile string) (string, error) {
+	title := fmt.Sprintf(" Passphrase for %s ", keyFile)
+	return c.secret(passphraseID(keyFile), title, Question{Label: "Passphrase", Secret: true})
+}
+
+// secret returns the cached secret id or asks it to the user.
+func (c *Credentials) secret(id, title string, question Question) (string, error) {
+	if c == nil {
+		return "", ErrNoPrompt
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if s, ok := c.secrets[id]; ok {
+		return s, nil
+	}
+
+	answers, err := c.prompt(title, []Question{question})
+	if err != nil {
+		return "", err
+	}
+	if len(answers) != 1 {
+		return "", ErrPromptCanceled
+	}
+
+	c.secrets[id] = answers[0]
+	return answers[0], nil
+}
+
+// challenge returns the keyboard-interactive challenge for user on addr.
+func (c *Credentials) challenge(user, addr string) ssh.KeyboardInteractiveChallenge {
+	return func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		if len(questions) == 0 {
+			return answers, nil
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		var (
+			toAsk []Question
+			index []int
+		)
+		for i, q := range questions {
+			if isPasswordQuestion(q) {
+				if s, ok := c.secrets[passwordID(user, addr)]; ok {
+					answers[i] = s
+					continue
+				}
+			}
+			toAsk = append(toAsk, Question{Label: strings.TrimSpace(q), Secret: !echos[i]})
+			index = append(index, i)
+		}
+
+		if len(toAsk) == 0 {
+			return answers, nil
+		}
+
+		title := fmt.Sprintf(" %s@%s ", user, addr)
+		if len(instruction) > 0 {
+			title = fmt.Sprintf(" %s@%s: %s ", user, addr, strings.TrimSpace(instruction))
+		}
+
+		asked, err := c.prompt(title, toAsk)
+		if err != nil {
+			return nil, err
+		}
+		if len(asked) != len(toAsk) {
+			return nil, ErrPromptCanceled
+		}
+
+		for i, answer := range asked {
+			answers[index[i]] = answer
+			if isPasswordQuestion(questions[index[i]]) {
+				c.secrets[passwordID(user, addr)] = answer
+			}
+		}
+		return answers, nil
+	}
+}
+
+// forget removes a secret from the cache.
+func (c *Credentials) forget(id string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	delete(c.secrets, id)
+	c.mutex.Unlock()
+}
+
+// forgetOnAuthError removes the password of user on addr if the authentication failed,
+// so a wrong password is asked again at the next connection.
+func (c *Credentials) forgetOnAuthError(user, addr string, err error) {
+	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		c.forget(passwordID(user, addr))
+	}
+}
+
+func isPasswordQuestion(q string) bool {
+	return strings.Contains(strings.ToLower(q), "password")
+}
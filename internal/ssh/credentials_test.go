@@ -0,0 +1,148 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh"
+)
+
+// mockPrompt answers the questions from answers and records the questions asked.
+type mockPrompt struct {
+	answers map[string][]string
+	asked   []string
+}
+
+func (m *mockPrompt) prompt(title string, questions []Question) ([]string, error) {
+	var answers []string
+	for _, q := range questions {
+		m.asked = append(m.asked, q.Label)
+		a, ok := m.answers[q.Label]
+		if !ok || len(a) == 0 {
+			return nil, ErrPromptCanceled
+		}
+		answers = append(answers, a[0])
+		if len(a) > 1 {
+			m.answers[q.Label] = a[1:]
+		}
+	}
+	return answers, nil
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	m := &mockPrompt{answers: map[string][]string{"Password": {"wrong", "bar"}}}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Credentials: NewCredentials(m.prompt)}
+	host := conf.Host{Username: "foo", Password: conf.Prompt, Auth: []string{AuthPassword}}
+
+	if _, err := DialHost(context.Background(), server.Addr(), host, opts); err == nil {
+		t.Fatal("Expected: authentication error with wrong password. Actual: nil")
+	}
+
+	// the wrong password must be forgotten and asked again
+	for i := 0; i < 2; i++ {
+		client, err := DialHost(context.Background(), server.Addr(), host, opts)
+		if err != nil {
+			t.Fatalf("Expected: connected. Actual: %s", err)
+		}
+		client.Close()
+	}
+
+	if len(m.asked) != 2 {
+		t.Errorf("Expected: password asked 2 times. Actual: %d", len(m.asked))
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	m := &mockPrompt{answers: map[string][]string{
+		"Password:":          {"bar"},
+		"Verification code:": {testCode},
+	}}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Credentials: NewCredentials(m.prompt)}
+	host := conf.Host{Username: "foo", Auth: []string{AuthKeyboardInteractive}}
+
+	for i := 0; i < 2; i++ {
+		client, err := DialHost(context.Background(), server.Addr(), host, opts)
+		if err != nil {
+			t.Fatalf("Expected: connected. Actual: %s", err)
+		}
+		client.Close()
+	}
+
+	// the password is cached but the code is asked each time
+	expected := []string{"Password:", "Verification code:", "Verification code:"}
+	if len(m.asked) != len(expected) {
+		t.Fatalf("Expected: %v. Actual: %v", expected, m.asked)
+	}
+	for i := range expected {
+		if m.asked[i] != expected[i] {
+			t.Errorf("Expected: %v. Actual: %v", expected, m.asked)
+		}
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(key)
+
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "lazylogger-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServer(t, signer.PublicKey(), "")
+	defer server.Close()
+
+	// without prompt, the connection must fail
+	host := conf.Host{Username: "foo", Key: keyFile}
+	if _, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: noHostKeyCheck}); err == nil {
+		t.Error("Expected: error without passphrase. Actual: nil")
+	}
+
+	m := &mockPrompt{answers: map[string][]string{"Passphrase": {"secret"}}}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Credentials: NewCredentials(m.prompt)}
+	client, err := DialHost(context.Background(), server.Addr(), host, opts)
+	if err != nil {
+		t.Fatalf("Expected: connected with prompted passphrase. Actual: %s", err)
+	}
+	client.Close()
+
+	// the passphrase from the configuration is used without asking
+	host.Passphrase = "secret"
+	m.asked = nil
+	client, err = DialHost(context.Background(), server.Addr(), host, opts)
+	if err != nil {
+		t.Fatalf("Expected: connected with configured passphrase. Actual: %s", err)
+	}
+	client.Close()
+	if len(m.asked) != 0 {
+		t.Errorf("Expected: no question asked. Actual: %v", m.asked)
+	}
+}
@@ -0,0 +1,207 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies. The policy is set per service in conf.LoggerConfiguration.HostKeyPolicy.
+const (
+	// HostKeyStrict refuses any host whose key is not found in the known_hosts files.
+	HostKeyStrict = "strict"
+
+	// HostKeyAcceptNew refuses changed keys but lets the user trust the key of an unknown host.
+	HostKeyAcceptNew = "accept-new"
+
+	// HostKeyOff disables the host key verification.
+	HostKeyOff = "off"
+
+	// DefaultHostKeyPolicy is the policy of the services without one and of the dials without verifier.
+	DefaultHostKeyPolicy = HostKeyAcceptNew
+)
+
+// ErrHostKeyPolicy means that the host key policy is not one of strict, accept-new or off.
+var ErrHostKeyPolicy = errors.New("invalid host key policy")
+
+// UnknownHostKeyError is returned by the dial functions in accept-new mode when the key of the host
+// is not found in the known_hosts files. The connection can be retried once the key is trusted.
+type UnknownHostKeyError struct {
+	Hostname string
+	Key      ssh.PublicKey
+
+	// file where the key is added when trusted
+	file string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key for %s: %s %s", e.Hostname, e.Key.Type(), e.Fingerprint())
+}
+
+// Fingerprint returns the SHA256 fingerprint of the host key.
+func (e *UnknownHostKeyError) Fingerprint() string {
+	return ssh.FingerprintSHA256(e.Key)
+}
+
+// Trust adds the host key to the known_hosts file.
+func (e *UnknownHostKeyError) Trust() error {
+	if err := os.MkdirAll(filepath.Dir(e.file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(e.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	glog.Infof("Adding host key of %s to %s", e.Hostname, e.file)
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{e.Hostname}, e.Key))
+	return err
+}
+
+// HostKeyVerifier verifies the host keys against known_hosts files according to a policy.
+type HostKeyVerifier struct {
+	policy string
+
+	// known_hosts files. New keys are added to the first one.
+	files []string
+
+	// authorities signing the host certificates
+	authorities []ssh.PublicKey
+}
+
+// NewHostKeyVerifier returns a verifier checking the keys against knownHostsFile, if not empty, and ~/.ssh/known_hosts.
+// If hostCAFile is not empty, host certificates signed by one of its authorities are accepted.
+// An empty policy means DefaultHostKeyPolicy.
+func NewHostKeyVerifier(policy, knownHostsFile, hostCAFile string) (*HostKeyVerifier, error) {
+	switch policy {
+	case "":
+		policy = DefaultHostKeyPolicy
+	case HostKeyStrict, HostKeyAcceptNew, HostKeyOff:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrHostKeyPolicy, policy)
+	}
+
+	var files []string
+	if len(knownHostsFile) > 0 {
+		files = append(files, knownHostsFile)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+
+	if len(files) == 0 && policy != HostKeyOff {
+		return nil, errors.New("no known_hosts file found")
+	}
+
+	v := &HostKeyVerifier{policy: policy, files: files}
+	if len(hostCAFile) > 0 {
+		authorities, err := readAuthorities(hostCAFile)
+		if err != nil {
+			return nil, err
+		}
+		v.authorities = authorities
+	}
+
+	return v, nil
+}
+
+// isHostAuthority returns true if auth is one of the configured authorities.
+func (v *HostKeyVerifier) isHostAuthority(auth ssh.PublicKey, address string) bool {
+	for _, a := range v.authorities {
+		if bytes.Equal(a.Marshal(), auth.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultVerifier returns a verifier with the default policy using ~/.ssh/known_hosts.
+func defaultVerifier() (*HostKeyVerifier, error) {
+	return NewHostKeyVerifier(DefaultHostKeyPolicy, "", "")
+}
+
+// hostKeyCheck holds the state of the verification during one dial.
+type hostKeyCheck struct {
+	verifier *HostKeyVerifier
+
+	mutex   sync.Mutex
+	unknown *UnknownHostKeyError
+}
+
+func (v *HostKeyVerifier) newCheck() *hostKeyCheck {
+	return &hostKeyCheck{verifier: v}
+}
+
+// callback implements ssh.HostKeyCallback.
+func (c *hostKeyCheck) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v := c.verifier
+	if v.policy == HostKeyOff {
+		glog.Warningf("Host key verification is off for %s", hostname)
+		return nil
+	}
+
+	// a host certificate must be signed by one of the configured authorities
+	if cert, ok := key.(*ssh.Certificate); ok && len(v.authorities) > 0 {
+		checker := &ssh.CertChecker{IsHostAuthority: v.isHostAuthority}
+		if err := checker.CheckHostKey(hostname, remote, cert); err != nil {
+			return fmt.Errorf("invalid host certificate for %s: %w", hostname, err)
+		}
+		return nil
+	}
+
+	// the files are read at each verification to take into account the keys trusted in the meantime.
+	var files []string
+	for _, f := range v.files {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	if len(files) > 0 {
+		check, err := knownhosts.New(files...)
+		if err != nil {
+			return err
+		}
+
+		err = check(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			// either the key is known or it changed. A changed key is never accepted.
+			return err
+		}
+	}
+
+	if v.policy == HostKeyStrict {
+		return fmt.Errorf("host key for %s not found in %v", hostname, v.files)
+	}
+
+	unknown := &UnknownHostKeyError{Hostname: hostname, Key: key, file: v.files[0]}
+	c.mutex.Lock()
+	c.unknown = unknown
+	c.mutex.Unlock()
+
+	return unknown
+}
+
+// err returns the UnknownHostKeyError if the dial failed because of an unknown host key.
+// The ssh package doesn't wrap the error returned by the callback so it has to be retrieved from here.
+func (c *hostKeyCheck) err(err error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.unknown != nil {
+		return c.unknown
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// setTestHome sets HOME to a temporary directory. It returns a function restoring HOME.
+func setTestHome(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "lazylogger-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+
+	return func() {
+		os.Setenv("HOME", oldHome)
+		os.RemoveAll(dir)
+	}
+}
+
+// trustTestServer adds the host key of the server to file.
+func trustTestServer(t *testing.T, server *testServer, file string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{server.Addr()}, server.hostKey.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostKeyStrict(t *testing.T) {
+	restoreHome := setTestHome(t)
+	defer restoreHome()
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	host := conf.Host{Username: "foo", Password: "bar"}
+	verifier, err := NewHostKeyVerifier(HostKeyStrict, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier})
+	var unknownErr *UnknownHostKeyError
+	if err == nil || errors.As(err, &unknownErr) {
+		t.Fatalf("Expected: host key error. Actual: %v", err)
+	}
+
+	trustTestServer(t, server, filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"))
+	client, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier})
+	if err != nil {
+		t.Fatalf("Expected: connected. Actual: %s", err)
+	}
+	client.Close()
+}
+
+func TestHostKeyAcceptNew(t *testing.T) {
+	restoreHome := setTestHome(t)
+	defer restoreHome()
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	knownHostsFile := filepath.Join(os.Getenv("HOME"), "known_hosts")
+	host := conf.Host{Username: "foo", Password: "bar"}
+	verifier, err := NewHostKeyVerifier(HostKeyAcceptNew, knownHostsFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier})
+	var unknownErr *UnknownHostKeyError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("Expected: UnknownHostKeyError. Actual: %v", err)
+	}
+
+	if err := unknownErr.Trust(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := DialHost(context.Background(), server.Addr(), host, DialOptions{HostKeys: verifier})
+	if err != nil {
+		t.Fatalf("Expected: connected after trusting the key. Actual: %s", err)
+	}
+	client.Close()
+
+	// otherServer is known with another key: it must be refused even in accept-new mode
+	otherServer := newTestServer(t, nil, "bar")
+	defer otherServer.Close()
+
+	data, _ := ioutil.ReadFile(knownHostsFile)
+	wrongKey := knownhosts.Line([]string{otherServer.Addr()}, server.hostKey.PublicKey()) + "\n"
+	ioutil.WriteFile(knownHostsFile, append(data, []byte(wrongKey)...), 0600)
+
+	unknownErr = nil
+	_, err = DialHost(context.Background(), otherServer.Addr(), host, DialOptions{HostKeys: verifier})
+	if err == nil || errors.As(err, &unknownErr) {
+		t.Errorf("Expected: changed key refused. Actual: %v", err)
+	}
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	if _, err := NewHostKeyVerifier("ask", "", ""); !errors.Is(err, ErrHostKeyPolicy) {
+		t.Errorf("Expected: ErrHostKeyPolicy. Actual: %v", err)
+	}
+
+	v, err := NewHostKeyVerifier("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.policy != HostKeyAcceptNew {
+		t.Errorf("Expected: accept-new by default. Actual: %s", v.policy)
+	}
+}
+
+func TestHostKeyDefaultVerifier(t *testing.T) {
+	restoreHome := setTestHome(t)
+	defer restoreHome()
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	// without verifier, the unknown host can be trusted like with an empty policy
+	_, err := DialHost(context.Background(), server.Addr(), conf.Host{Username: "foo", Password: "bar"}, DialOptions{})
+	var unknownErr *UnknownHostKeyError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("Expected: UnknownHostKeyError. Actual: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tupyy/lazylogger/internal/conf"
+	"golang.org/x/net/proxy"
+)
+
+// ErrProxyScheme means that the proxy url is neither socks5 nor http.
+var ErrProxyScheme = errors.New("unsupported proxy scheme")
+
+// maxProxyStderr is the number of bytes kept from the end of the error output of a proxy command.
+const maxProxyStderr = 4 * 1024
+
+// proxyStderrDelay is how long a failed dial waits for the end of the error output of the proxy command.
+var proxyStderrDelay = 100 * time.Millisecond
+
+// dialFunc opens the connection to addr which carries the ssh connection.
+// ctx only bounds the opening of the connection, not its lifetime.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// directDial dials addr without proxy.
+func directDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// proxyDialer returns the dial function connecting through p. If p is empty, addr is dialed directly.
+// The command has precedence over the url.
+func proxyDialer(p conf.Proxy) (dialFunc, error) {
+	if len(p.Command) > 0 {
+		return commandDialer(p.Command), nil
+	}
+
+	if len(p.URL) == 0 {
+		return directDial, nil
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := dialer.(proxy.ContextDialer); ok {
+			return d.DialContext, nil
+		}
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}, nil
+	case "http":
+		return httpConnectDialer(u), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrProxyScheme, u.Scheme)
+	}
+}
+
+// httpConnectDialer returns a dial function opening a tunnel with the CONNECT method of the http proxy u.
+func httpConnectDialer(u *url.URL) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("dial error to proxy %s: %w", u.Host, err)
+		}
+
+		// the proxy may never answer
+		stop := closeOnDone(ctx, conn)
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+
+		var resp *http.Response
+		reader := bufio.NewReader(conn)
+		err = req.Write(conn)
+		if err == nil {
+			resp, err = http.ReadResponse(reader, req)
+		}
+		if ctxErr := stop(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", u.Host, addr, resp.Status)
+		}
+
+		// the reader may hold the first bytes sent by the ssh server
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+}
+
+// bufferedConn reads from reader the data already buffered from Conn.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// commandDialer returns a dial function running command in a local shell. The stdin and stdout
+// of the command carry the connection, like the ProxyCommand of OpenSSH. %h and %p are replaced by the
+// host and the port of addr. The error output of the command is logged and kept to explain a failed dial.
+// The command lives as long as the connection: it is killed by closing the connection, not by ctx.
+func commandDialer(command string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cmdline := strings.NewReplacer("%h", host, "%p", port, "%%", "%").Replace(command)
+		glog.V(2).Infof("Running proxy command: %s", cmdline)
+
+		// the terminal is drawn by the gui so the command must not write to it. The error output is read from
+		// a pipe of our own: Wait would wait for the children of the command holding it otherwise.
+		stderrReader, stderrWriter, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("/bin/sh", "-c", cmdline)
+		cmd.Stderr = stderrWriter
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			stderrReader.Close()
+			stderrWriter.Close()
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			stderrReader.Close()
+			stderrWriter.Close()
+			return nil, err
+		}
+
+		err = cmd.Start()
+		stderrWriter.Close()
+		if err != nil {
+			stderrReader.Close()
+			return nil, fmt.Errorf("cannot start proxy command: %w", err)
+		}
+
+		stderr := &stderrBuffer{done: make(chan struct{})}
+		go func() {
+			io.Copy(stderr, stderrReader)
+			stderrReader.Close()
+			close(stderr.done)
+
+			if s := stderr.String(); len(s) > 0 {
+				glog.V(2).Infof("Proxy command to %s: %s", addr, s)
+			}
+		}()
+
+		return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, stderr: stderr, addr: addr}, nil
+	}
+}
+
+// proxyCommandError adds to err the error output of the proxy command carrying conn, if any.
+// It waits at most proxyStderrDelay for the end of the output.
+func proxyCommandError(conn net.Conn, err error) error {
+	c, ok := conn.(*commandConn)
+	if !ok {
+		return err
+	}
+
+	select {
+	case <-c.stderr.done:
+	case <-time.After(proxyStderrDelay):
+	}
+	if stderr := c.stderr.String(); len(stderr) > 0 {
+		return fmt.Errorf("%w (proxy command: %s)", err, stderr)
+	}
+	return err
+}
+
+// stderrBuffer keeps the end of the error output of a proxy command. It is safe for concurrent use.
+type stderrBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+
+	// closed at the end of the output
+	done chan struct{}
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.data = append(b.data, p...)
+	if len(b.data) > maxProxyStderr {
+		b.data = b.data[len(b.data)-maxProxyStderr:]
+	}
+	return len(p), nil
+}
+
+func (b *stderrBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return strings.TrimSpace(string(b.data))
+}
+
+// commandConn implements net.Conn over the stdio of a command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr *stderrBuffer
+	addr   string
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close closes the stdin of the command and kills it.
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr("proxy-command")
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr(c.addr)
+}
+
+// deadlines are not supported by pipes
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// commandAddr is the net.Addr of a commandConn.
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "proxy-command"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+// startTestProxy serves handle on a local listener. It returns the address of the proxy.
+func startTestProxy(t *testing.T, handle func(conn net.Conn)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// pipe copies data between conn and a new connection to addr.
+func pipe(conn net.Conn, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+	target.Close()
+	conn.Close()
+}
+
+// handleHTTPConnect is a http proxy accepting CONNECT requests authenticated as foo:bar.
+func handleHTTPConnect(conn net.Conn) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic Zm9vOmJhcg==" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(conn, req.Host)
+}
+
+// handleSOCKS5 is a SOCKS5 proxy accepting connections authenticated as foo:bar. Only IPv4 addresses are supported.
+func handleSOCKS5(conn net.Conn) {
+	buf := make([]byte, 256)
+
+	// greeting: version, methods. Username/password (2) is required.
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		conn.Close()
+		return
+	}
+	io.ReadFull(conn, buf[:buf[1]])
+	conn.Write([]byte{5, 2})
+
+	// username/password auth
+	io.ReadFull(conn, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(conn, password)
+	if string(user) != "foo" || string(password) != "bar" {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect request: version, cmd, reserved, address type, ipv4, port
+	io.ReadFull(conn, buf[:4])
+	io.ReadFull(conn, buf[:6])
+	addr := (&net.TCPAddr{IP: net.IP(buf[:4]), Port: int(binary.BigEndian.Uint16(buf[4:6]))}).String()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, addr)
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	proxyAddr, stopProxy := startTestProxy(t, handleHTTPConnect)
+	defer stopProxy()
+
+	host := conf.Host{Username: "foo", Password: "bar"}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Proxy: conf.Proxy{URL: "http://foo:bar@" + proxyAddr}}
+	client, err := DialHost(context.Background(), server.Addr(), host, opts)
+	if err != nil {
+		t.Fatalf("Expected: connected through proxy. Actual: %s", err)
+	}
+	client.Close()
+
+	opts.Proxy.URL = "http://foo:wrong@" + proxyAddr
+	if _, err := DialHost(context.Background(), server.Addr(), host, opts); err == nil {
+		t.Error("Expected: proxy authentication error. Actual: connected")
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	proxyAddr, stopProxy := startTestProxy(t, handleSOCKS5)
+	defer stopProxy()
+
+	host := conf.Host{Username: "foo", Password: "bar"}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Proxy: conf.Proxy{URL: "socks5://foo:bar@" + proxyAddr}}
+	client, err := DialHost(context.Background(), server.Addr(), host, opts)
+	if err != nil {
+		t.Fatalf("Expected: connected through proxy. Actual: %s", err)
+	}
+	client.Close()
+}
+
+func TestProxyCommand(t *testing.T) {
+	if _, err := exec.LookPath("nc"); err != nil {
+		t.Skip("nc not found")
+	}
+
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	host := conf.Host{Username: "foo", Password: "bar"}
+	opts := DialOptions{HostKeys: noHostKeyCheck, Proxy: conf.Proxy{Command: "nc %h %p"}}
+	client, err := DialHost(context.Background(), server.Addr(), host, opts)
+	if err != nil {
+		t.Fatalf("Expected: connected through proxy command. Actual: %s", err)
+	}
+	client.Close()
+}
+
+func TestProxyScheme(t *testing.T) {
+	if _, err := proxyDialer(conf.Proxy{URL: "ftp://proxy:21"}); !errors.Is(err, ErrProxyScheme) {
+		t.Errorf("Expected: ErrProxyScheme. Actual: %v", err)
+	}
+}
+
+func TestCommandConn(t *testing.T) {
+	// cat echoes the data written to the connection
+	conn, err := commandDialer("cat # %h %p")(context.Background(), "tcp", "example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != "example.com:22" {
+		t.Errorf("Expected: example.com:22. Actual: %s", conn.RemoteAddr())
+	}
+
+	conn.Write([]byte("hello"))
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "hello" {
+		t.Errorf("Expected: hello. Actual: %s %v", data, err)
+	}
+}
+
+func TestProxyCommandStderr(t *testing.T) {
+	opts := DialOptions{HostKeys: noHostKeyCheck, Proxy: conf.Proxy{Command: "echo cannot reach %h >&2; exit 1"}}
+	_, err := DialHost(context.Background(), "example.com:22", conf.Host{Username: "foo", Password: "bar"}, opts)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach example.com") {
+		t.Errorf("Expected: error with the output of the proxy command. Actual: %v", err)
+	}
+}
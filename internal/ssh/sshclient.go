@@ -2,17 +2,24 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/tupyy/lazylogger/internal/conf"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+// DialTimeout is the maximum time taken to open the connection to a host, before the ssh handshake.
+var DialTimeout = 30 * time.Second
+
 type remoteScriptType byte
 type remoteShellType byte
 
@@ -27,6 +34,20 @@ const (
 
 type Client struct {
 	client *ssh.Client
+
+	// end of validity of the user certificates used to connect. Zero if no certificate expires.
+	certExpiry time.Time
+
+	// clock of the host minus the local clock and round trip of its measure, set by measureClock
+	clockOffset   time.Duration
+	clockRTT      time.Duration
+	clockMeasured bool
+}
+
+// CertificateExpiry returns the earliest end of validity of the user certificates used to connect.
+// It returns false if no certificate was used or if the certificates never expire.
+func (c *Client) CertificateExpiry() (time.Time, bool) {
+	return c.certExpiry, !c.certExpiry.IsZero()
 }
 
 // DialWithPasswd starts a client connection to the given SSH server with passwd authmethod.
@@ -36,13 +57,13 @@ func DialWithPasswd(addr, user, passwd string) (*Client, error) {
 		Auth: []ssh.AuthMethod{
 			ssh.Password(passwd),
 		},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
 	}
 
-	return Dial("tcp", addr, config)
+	return dialVerified(context.Background(), addr, config, nil, nil)
 }
 
 // DialWithKey starts a client connection to the given SSH server with key authmethod.
+// If <keyfile>-cert.pub exists, the certificate is presented instead of the key.
 func DialWithKey(addr, user, keyfile string) (*Client, error) {
 	key, err := ioutil.ReadFile(keyfile)
 	if err != nil {
@@ -54,15 +75,19 @@ func DialWithKey(addr, user, keyfile string) (*Client, error) {
 		return nil, err
 	}
 
+	signer, err = certSigner(conf.Host{Key: keyfile}, signer)
+	if err != nil {
+		return nil, err
+	}
+
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
 	}
 
-	return Dial("tcp", addr, config)
+	return dialVerified(context.Background(), addr, config, nil, nil)
 }
 
 // DialWithKeyWithPassphrase same as DialWithKey but with a passphrase to decrypt the private key
@@ -77,79 +102,281 @@ func DialWithKeyWithPassphrase(addr, user, keyfile string, passphrase string) (*
 		return nil, err
 	}
 
+	signer, err = certSigner(conf.Host{Key: keyfile}, signer)
+	if err != nil {
+		return nil, err
+	}
+
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil }),
 	}
 
-	return Dial("tcp", addr, config)
+	return dialVerified(context.Background(), addr, config, nil, nil)
 }
 
-func DialWithJumpHost(jumpHost, host conf.Host) (*Client, error) {
+// DialWithAgent starts a client connection to the given SSH server using the keys
+// held by the ssh-agent listening on SSH_AUTH_SOCK.
+func DialWithAgent(addr, user string) (*Client, error) {
+	return DialHost(context.Background(), addr, conf.Host{Username: user, Auth: []string{AuthAgent}}, DialOptions{})
+}
+
+// DialOptions holds the optional settings of DialHost and DialWithJumpHost.
+type DialOptions struct {
+	// HostKeys verifies the host keys. If nil, the keys are verified against ~/.ssh/known_hosts
+	// with DefaultHostKeyPolicy.
+	HostKeys *HostKeyVerifier
+
+	// Credentials asks the user for the secrets missing from the configuration.
+	// If nil, the user is never asked.
+	Credentials *Credentials
+
+	// Proxy is used to reach the host, or the jump host if any. If empty, the host is dialed directly.
+	Proxy conf.Proxy
+}
 
-	var auth ssh.AuthMethod
-	var err error
-	if len(jumpHost.Key) > 0 {
-		auth, err = privateKeyFile(jumpHost.Key)
+func (opts DialOptions) verifier() (*HostKeyVerifier, error) {
+	if opts.HostKeys != nil {
+		return opts.HostKeys, nil
+	}
+	return defaultVerifier()
+}
+
+// DialHost starts a client connection to addr authenticating with the methods configured in host.
+// The dial is aborted as soon as ctx is done. ctx doesn't bound the lifetime of the client.
+func DialHost(ctx context.Context, addr string, host conf.Host, opts DialOptions) (*Client, error) {
+	verifier, err := opts.verifier()
+	if err != nil {
+		return nil, err
+	}
+
+	dial, err := proxyDialer(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	agentClient, closeAgent := hostAgent(host)
+	defer closeAgent()
+
+	config, err := clientConfig(host, addr, agentClient, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dialVerified(ctx, addr, config, verifier, dial)
+	if err != nil {
+		opts.Credentials.forgetOnAuthError(host.Username, addr, err)
+		return nil, err
+	}
+
+	if expiry, ok := certificatesExpiry(host); ok {
+		client.certExpiry = expiry
+	}
+	return client, nil
+}
+
+// dialVerified dials addr with dial and verifies the host key with verifier.
+// If verifier is nil, the default verifier is used. If dial is nil, addr is dialed directly.
+func dialVerified(ctx context.Context, addr string, config *ssh.ClientConfig, verifier *HostKeyVerifier, dial dialFunc) (*Client, error) {
+	if verifier == nil {
+		v, err := defaultVerifier()
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		auth = ssh.Password(jumpHost.Password)
+		verifier = v
+	}
+
+	if dial == nil {
+		dial = directDial
+	}
+
+	check := verifier.newCheck()
+	config.HostKeyCallback = check.callback
+
+	client, err := dialClient(ctx, dial, addr, config)
+	if err != nil {
+		return nil, check.err(err)
+	}
+	return &Client{client: client}, nil
+}
+
+// dialClient opens the connection to addr with dial and starts the ssh client on it.
+// Opening the connection takes at most DialTimeout.
+func dialClient(ctx context.Context, dial dialFunc, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	conn, err := dial(dialCtx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return nil, err
 	}
+	return newClientConn(ctx, conn, addr, config)
+}
 
-	jumpHostConfig := &ssh.ClientConfig{
-		User:            jumpHost.Username,
-		Auth:            []ssh.AuthMethod{auth},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil },
+// newClientConn starts the ssh client on conn. conn is closed if ctx is done before the end of the handshake.
+func newClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	stop := closeOnDone(ctx, conn)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if ctxErr := stop(); ctxErr != nil {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, proxyCommandError(conn, err)
 	}
 
-	jumpConn, err := ssh.Dial("tcp", jumpHost.String(), jumpHostConfig)
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeOnDone closes conn if ctx is done before the returned function is called.
+// The ssh handshake has no context: closing the connection is the only way to abort it.
+// The returned function returns the error of ctx if conn has been closed.
+func closeOnDone(ctx context.Context, conn io.Closer) func() error {
+	done := make(chan struct{})
+	closed := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- ctx.Err()
+		case <-done:
+			closed <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return <-closed
+	}
+}
+
+// DialWithJumpHost starts a client connection to host through jumpHost.
+// The dial is aborted as soon as ctx is done. ctx doesn't bound the lifetime of the client.
+func DialWithJumpHost(ctx context.Context, jumpHost, host conf.Host, opts DialOptions) (*Client, error) {
+	verifier, err := opts.verifier()
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy is used to reach the jump host. The host is reached through the jump host.
+	dial, err := proxyDialer(opts.Proxy)
 	if err != nil {
-		return nil, fmt.Errorf("dial error to jump host: %w", err)
+		return nil, err
 	}
 
+	// the same agent signs for both hops. The target is authenticated locally
+	// through the tunnel so the keys never leave this machine.
+	agentClient, closeAgent := hostAgent(jumpHost, host)
+	defer closeAgent()
+
+	jumpHostConfig, err := clientConfig(jumpHost, jumpHost.String(), agentClient, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	jumpHostCheck := verifier.newCheck()
+	jumpHostConfig.HostKeyCallback = jumpHostCheck.callback
+
+	jumpConn, err := dialClient(ctx, dial, jumpHost.String(), jumpHostConfig)
+	if err != nil {
+		opts.Credentials.forgetOnAuthError(jumpHost.Username, jumpHost.String(), err)
+		return nil, fmt.Errorf("dial error to jump host: %w", jumpHostCheck.err(err))
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	stop := closeOnDone(dialCtx, jumpConn)
 	remoteConn, err := jumpConn.Dial("tcp", host.String())
+	ctxErr := stop()
+	cancel()
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
 	if err != nil {
+		jumpConn.Close()
 		return nil, fmt.Errorf("dial error from jumphost to remote: %w", err)
 	}
 
-	if len(host.Key) > 0 {
-		auth, err = privateKeyFile(host.Key)
-		if err != nil {
+	remoteHostConfig, err := clientConfig(host, host.String(), agentClient, opts.Credentials)
+	if err != nil {
+		jumpConn.Close()
+		return nil, err
+	}
+
+	hostCheck := verifier.newCheck()
+	remoteHostConfig.HostKeyCallback = hostCheck.callback
+
+	remoteClient, err := newClientConn(ctx, remoteConn, host.String(), remoteHostConfig)
+	if err != nil {
+		jumpConn.Close()
+		if err == ctx.Err() {
 			return nil, err
 		}
-	} else {
-		auth = ssh.Password(host.Password)
+		opts.Credentials.forgetOnAuthError(host.Username, host.String(), err)
+		return nil, fmt.Errorf("create ssh client error: %w", hostCheck.err(err))
 	}
 
-	remoteHostConfig := &ssh.ClientConfig{
-		User:            host.Username,
-		Auth:            []ssh.AuthMethod{auth},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error { return nil },
+	client := &Client{client: remoteClient}
+	if expiry, ok := certificatesExpiry(jumpHost, host); ok {
+		client.certExpiry = expiry
 	}
+	return client, nil
+}
 
-	c, chans, reqs, err := ssh.NewClientConn(remoteConn, host.String(), remoteHostConfig)
+// privateKeyFile returns the signer of the private key of host.
+// If the key is encrypted, the passphrase is taken from host.Passphrase or asked to the user.
+// If host has a certificate, the signer presents the certificate instead of the key.
+func privateKeyFile(host conf.Host, creds *Credentials) (ssh.Signer, error) {
+	signer, err := parsePrivateKeyFile(host, creds)
 	if err != nil {
-		return nil, fmt.Errorf("create ssh client error: %w", err)
+		return nil, err
 	}
-
-	return &Client{ssh.NewClient(c, chans, reqs)}, nil
+	return certSigner(host, signer)
 }
 
-func privateKeyFile(file string) (ssh.AuthMethod, error) {
-	buffer, err := ioutil.ReadFile(file)
+func parsePrivateKeyFile(host conf.Host, creds *Credentials) (ssh.Signer, error) {
+	buffer, err := ioutil.ReadFile(host.Key)
 	if err != nil {
 		return nil, err
 	}
-	key, err := ssh.ParsePrivateKey(buffer)
+
+	signer, err := ssh.ParsePrivateKey(buffer)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return signer, err
+	}
+
+	passphrase := host.Passphrase
+	if len(passphrase) == 0 || passphrase == conf.Prompt {
+		passphrase, err = creds.passphrase(host.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(buffer, []byte(passphrase))
+	if err != nil {
+		creds.forget(passphraseID(host.Key))
+		return nil, fmt.Errorf("cannot decrypt private key %s: %w", host.Key, err)
+	}
+	return signer, nil
+}
+
+// clientConfig returns the client configuration used to authenticate on host at addr.
+// The HostKeyCallback is set by the caller.
+func clientConfig(host conf.Host, addr string, agentClient agent.Agent, creds *Credentials) (*ssh.ClientConfig, error) {
+	auth, err := authMethods(host, addr, agentClient, creds)
 	if err != nil {
 		return nil, err
 	}
-	return ssh.PublicKeys(key), nil
+
+	return &ssh.ClientConfig{
+		User: host.Username,
+		Auth: auth,
+	}, nil
 }
 
 // Dial starts a client connection to the given SSH server.
@@ -208,10 +435,20 @@ type remoteScript struct {
 
 	stdout io.Writer
 	stderr io.Writer
+
+	// the session is closed when ctx is done
+	ctx context.Context
 }
 
 // Run
 func (rs *remoteScript) Run() error {
+	return rs.RunContext(context.Background())
+}
+
+// RunContext runs the script. If ctx is done before the script exits, the session is closed
+// and ctx.Err() is returned. Nothing is written to stdout or stderr after RunContext returns.
+func (rs *remoteScript) RunContext(ctx context.Context) error {
+	rs.ctx = ctx
 	if rs.err != nil {
 		fmt.Println(rs.err)
 		return rs.err
@@ -274,19 +511,19 @@ func (rs *remoteScript) SetStdio(stdout, stderr io.Writer) *remoteScript {
 }
 
 func (rs *remoteScript) runCmd(cmd string) error {
-	session, err := rs.client.NewSession()
-	if err != nil {
+	if err := rs.ctx.Err(); err != nil {
 		return err
 	}
-	defer session.Close()
 
-	session.Stdout = rs.stdout
-	session.Stderr = rs.stderr
-
-	if err := session.Run(cmd); err != nil {
+	session, err := newSession(rs.ctx, rs.client)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer session.Close()
+
+	return runSession(rs.ctx, session, rs.stdout, rs.stderr, func() error {
+		return session.Run(cmd)
+	})
 }
 
 func (rs *remoteScript) runCmds() error {
@@ -308,23 +545,98 @@ func (rs *remoteScript) runCmds() error {
 }
 
 func (rs *remoteScript) runScript() error {
-	session, err := rs.client.NewSession()
+	if err := rs.ctx.Err(); err != nil {
+		return err
+	}
+
+	session, err := newSession(rs.ctx, rs.client)
 	if err != nil {
 		return err
 	}
+	defer session.Close()
 
 	session.Stdin = rs.script
-	session.Stdout = rs.stdout
-	session.Stderr = rs.stderr
 
-	if err := session.Shell(); err != nil {
-		return err
+	return runSession(rs.ctx, session, rs.stdout, rs.stderr, func() error {
+		if err := session.Shell(); err != nil {
+			return err
+		}
+		return session.Wait()
+	})
+}
+
+// newSession opens a session on client. It returns as soon as ctx is done, for instance when the connection
+// is half-open: the session opened afterwards is closed.
+func newSession(ctx context.Context, client *ssh.Client) (*ssh.Session, error) {
+	type result struct {
+		session *ssh.Session
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		session, err := client.NewSession()
+		done <- result{session, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.session, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				r.session.Close()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	if err := session.Wait(); err != nil {
+}
+
+// runSession calls run with the output of the session going to stdout and stderr.
+// If ctx is done first, the session is closed and the output discarded.
+func runSession(ctx context.Context, session *ssh.Session, stdout, stderr io.Writer, run func() error) error {
+	out := &guardedWriter{w: stdout}
+	errOut := &guardedWriter{w: stderr}
+	session.Stdout = out
+	session.Stderr = errOut
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
+
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		out.detach()
+		errOut.detach()
+		return ctx.Err()
 	}
+}
 
-	return nil
+// guardedWriter forwards the writes to w until detach is called.
+type guardedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.w == nil {
+		return len(p), nil
+	}
+	return g.w.Write(p)
+}
+
+// detach drops the writes from now on.
+func (g *guardedWriter) detach() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.w = nil
 }
 
 func (rs *remoteScript) runScriptFile() error {
@@ -0,0 +1,84 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+func TestRunContextTimeout(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	client, err := DialHost(context.Background(), server.Addr(), conf.Host{Username: "foo", Password: "bar"}, DialOptions{HostKeys: noHostKeyCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := client.Cmd("echo").SetStdio(&stdout, &stderr).RunContext(context.Background()); err != nil {
+		t.Errorf("Expected: nil. Actual: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = client.Cmd("sleep 60").SetStdio(&stdout, &stderr).RunContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected: %s. Actual: %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected: command aborted after the timeout. Actual: aborted after %s", elapsed)
+	}
+
+	// the connection is still usable
+	if !isAlive(context.Background(), client) {
+		t.Error("Expected: connection alive. Actual: closed")
+	}
+
+	// a canceled context doesn't run the command
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := client.Cmd("echo").RunContext(ctx); err != context.Canceled {
+		t.Errorf("Expected: %s. Actual: %v", context.Canceled, err)
+	}
+}
+
+func TestDialHostCanceled(t *testing.T) {
+	// the server accepts the connection but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = DialHost(ctx, listener.Addr().String(), conf.Host{Username: "foo", Password: "bar"}, DialOptions{HostKeys: noHostKeyCheck})
+	if err != context.Canceled {
+		t.Errorf("Expected: %s. Actual: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected: dial aborted when canceled. Actual: aborted after %s", elapsed)
+	}
+}
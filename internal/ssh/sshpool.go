@@ -2,18 +2,35 @@ package ssh
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/tupyy/lazylogger/internal/conf"
 )
 
+// AliveTimeout is the time after which a pooled connection not answering is considered down.
+var AliveTimeout = 5 * time.Second
+
+// SSHPool shares the ssh connections between the loggers. It is safe for concurrent use.
 type SSHPool struct {
+	// protects clients and credentials. It is not held while dialing.
+	mutex *sync.Mutex
+
 	clients map[string]*Client
+
+	// asks the user for the secrets missing from the configuration
+	credentials *Credentials
 }
 
 func NewSSHPool() *SSHPool {
-	return &SSHPool{clients: make(map[string]*Client)}
+	return &SSHPool{
+		mutex:   &sync.Mutex{},
+		clients: make(map[string]*Client),
+	}
 }
 
 // Returns a hash created from Host as string.
@@ -25,74 +42,87 @@ func createHash(addr, user, pwd string) string {
 
 // Connect looks for a existing client in clients. If a client is found, returns it.
 // If not, it dials a new connection.
-// Connect doesn't check if a connection is still alive
-func (sshPool *SSHPool) Connect(conf conf.LoggerConfiguration) (*Client, error) {
+// If the client found is not alive anymore, it dials a new connection. The dial is aborted as soon as ctx is done.
+func (sshPool *SSHPool) Connect(ctx context.Context, conf conf.LoggerConfiguration) (*Client, error) {
 	host := conf.Host
-	hashID := createHash(host.String(), host.Username, host.Password)
+	hashID := createHash(host.String(), host.Username, host.Password+host.Key)
+
+	sshPool.mutex.Lock()
 	v, ok := sshPool.clients[hashID]
+	sshPool.mutex.Unlock()
+
 	if !ok {
-		glog.Infof("Connection exists for %s with user %s:", host.String(), host.Username)
-		if len(conf.JumpHost.Address) > 0 {
-			return sshPool.connectWithJumpHost(host, conf.JumpHost)
-		} else {
-			if len(host.Key) > 0 {
-				return sshPool.connectToHostWithKey(host.String(), host.Username, host.Key)
-			} else {
-				return sshPool.connectToHost(host.String(), host.Username, host.Password)
-			}
-		}
+		glog.Infof("No connection found for %s with user %s", host.String(), host.Username)
+		return sshPool.connect(ctx, hashID, conf, nil)
 	}
 
 	// if the connection is not alive, try to reconnect
-	if !isAlive(v) {
-		if len(host.Key) > 0 {
-			return sshPool.connectToHostWithKey(host.String(), host.Username, host.Key)
-		} else {
-			return sshPool.connectToHost(host.String(), host.Username, host.Password)
-		}
+	if !isAlive(ctx, v) {
+		glog.Infof("Connection to %s with user %s is down. Reconnecting", host.String(), host.Username)
+		return sshPool.connect(ctx, hashID, conf, v)
 	}
 
 	return v, nil
 }
 
+// SetPromptFunc sets the function used to ask the user for passwords, passphrases and
+// keyboard-interactive answers. The secrets are kept in memory for the whole session.
+func (sshPool *SSHPool) SetPromptFunc(prompt PromptFunc) {
+	sshPool.mutex.Lock()
+	defer sshPool.mutex.Unlock()
+	sshPool.credentials = NewCredentials(prompt)
+}
+
 func (sshPool *SSHPool) Disconnect() {
-	for _, c := range sshPool.clients {
+	sshPool.mutex.Lock()
+	defer sshPool.mutex.Unlock()
+
+	for hashID, c := range sshPool.clients {
 		c.Close()
+		delete(sshPool.clients, hashID)
 	}
 }
 
-// dial the connection and save the client to clients
-func (sshPool *SSHPool) connectToHostWithKey(addr, user, key string) (*Client, error) {
-	hashID := createHash(addr, user, key)
-	client, err := DialWithKey(addr, user, key)
+// dial the connection and save the client to clients. previous is the client found down, if any.
+func (sshPool *SSHPool) connect(ctx context.Context, hashID string, conf conf.LoggerConfiguration, previous *Client) (*Client, error) {
+	var (
+		client *Client
+		err    error
+	)
+
+	verifier, err := NewHostKeyVerifier(conf.HostKeyPolicy, conf.KnownHosts, conf.HostCA)
 	if err != nil {
 		return nil, err
 	}
-	sshPool.clients[hashID] = client
 
-	glog.Infof("Connected to: %s with user: %s", addr, user)
-	return client, nil
-}
+	sshPool.mutex.Lock()
+	opts := DialOptions{
+		HostKeys:    verifier,
+		Credentials: sshPool.credentials,
+		Proxy:       conf.Proxy,
+	}
+	sshPool.mutex.Unlock()
 
-// dial the connection and save the client to clients
-func (sshPool *SSHPool) connectToHost(addr, user, pwd string) (*Client, error) {
-	hashID := createHash(addr, user, pwd)
-	client, err := DialWithPasswd(addr, user, pwd)
+	host := conf.Host
+	if len(conf.JumpHost.Address) > 0 {
+		client, err = DialWithJumpHost(ctx, conf.JumpHost, host, opts)
+	} else {
+		client, err = DialHost(ctx, host.String(), host, opts)
+	}
 	if err != nil {
 		return nil, err
 	}
-	sshPool.clients[hashID] = client
 
-	glog.Infof("Connected to: %s with user: %s", addr, user)
-	return client, nil
-}
+	if err := client.measureClock(ctx); err != nil {
+		glog.Warningf("cannot measure the clock offset of %s: %s", host.String(), err)
+	}
 
-// dial the connection and save the client to clients
-func (sshPool *SSHPool) connectWithJumpHost(host, jumpHost conf.Host) (*Client, error) {
-	hashID := createHash(host.String(), host.Username, host.Key)
-	client, err := DialWithJumpHost(jumpHost, host)
-	if err != nil {
-		return nil, err
+	// another logger could have connected to the same host while dialing. Keep the first connection.
+	sshPool.mutex.Lock()
+	defer sshPool.mutex.Unlock()
+	if other, ok := sshPool.clients[hashID]; ok && other != previous {
+		client.Close()
+		return other, nil
 	}
 	sshPool.clients[hashID] = client
 
@@ -100,10 +130,14 @@ func (sshPool *SSHPool) connectWithJumpHost(host, jumpHost conf.Host) (*Client,
 	return client, nil
 }
 
-func isAlive(client *Client) bool {
+// isAlive returns true if the client runs a command within AliveTimeout. A half-open connection never answers.
+func isAlive(ctx context.Context, client *Client) bool {
+	ctx, cancel := context.WithTimeout(ctx, AliveTimeout)
+	defer cancel()
+
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	err := client.Cmd("echo stdout").Cmd(">&2 echo stderr").SetStdio(&stdout, &stderr).Run()
+	err := client.Cmd("echo stdout").Cmd(">&2 echo stderr").SetStdio(&stdout, &stderr).RunContext(ctx)
 	if err != nil {
 		return false
 	}
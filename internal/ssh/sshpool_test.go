@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tupyy/lazylogger/internal/conf"
+)
+
+// testPoolConfiguration returns a configuration of a logger reaching server.
+// The pool always dials port 22 so the host is reached through a proxy forwarding every connection to server.
+func testPoolConfiguration(t *testing.T, server *testServer) (conf.LoggerConfiguration, func()) {
+	proxyAddr, stopProxy := startTestProxy(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			conn.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		pipe(conn, server.Addr())
+	})
+
+	c := conf.LoggerConfiguration{
+		Host:          conf.Host{Address: "127.0.0.1", Username: "foo", Password: "bar"},
+		HostKeyPolicy: HostKeyOff,
+		Proxy:         conf.Proxy{URL: "http://" + proxyAddr},
+	}
+	return c, stopProxy
+}
+
+func TestSSHPoolConcurrentConnect(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	c, stopProxy := testPoolConfiguration(t, server)
+	defer stopProxy()
+
+	pool := NewSSHPool()
+
+	var wg sync.WaitGroup
+	clients := make([]*Client, 20)
+	errs := make([]error, len(clients))
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				pool.SetPromptFunc(nil)
+			}
+			clients[i], errs[i] = pool.Connect(context.Background(), c)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Expected: connected. Actual: %s", err)
+		}
+		if !isAlive(context.Background(), clients[i]) {
+			t.Errorf("Expected: connection %d alive. Actual: closed", i)
+		}
+	}
+
+	if len(pool.clients) != 1 {
+		t.Errorf("Expected: 1 connection in pool. Actual: %d", len(pool.clients))
+	}
+
+	client, err := pool.Connect(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != clients[0] {
+		t.Error("Expected: connection shared. Actual: new connection")
+	}
+
+	pool.Disconnect()
+	if len(pool.clients) != 0 {
+		t.Errorf("Expected: no connection in pool. Actual: %d", len(pool.clients))
+	}
+}
+
+// freezingRelay forwards the connections to addr until freeze is called. The data is dropped afterwards,
+// like on a half-open connection.
+type freezingRelay struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	frozen   bool
+}
+
+func newFreezingRelay(t *testing.T, addr string) *freezingRelay {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &freezingRelay{listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go r.copy(target, conn)
+			go r.copy(conn, target)
+		}
+	}()
+	return r
+}
+
+func (r *freezingRelay) copy(dst, src net.Conn) {
+	defer dst.Close()
+	buffer := make([]byte, 4096)
+	for {
+		n, err := src.Read(buffer)
+		if err != nil {
+			return
+		}
+		r.mutex.Lock()
+		frozen := r.frozen
+		r.mutex.Unlock()
+		if !frozen {
+			dst.Write(buffer[:n])
+		}
+	}
+}
+
+func (r *freezingRelay) freeze() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.frozen = true
+}
+
+func TestIsAliveHalfOpen(t *testing.T) {
+	server := newTestServer(t, nil, "bar")
+	defer server.Close()
+
+	relay := newFreezingRelay(t, server.Addr())
+	defer relay.listener.Close()
+
+	client, err := DialHost(context.Background(), relay.listener.Addr().String(), conf.Host{Username: "foo", Password: "bar"}, DialOptions{HostKeys: noHostKeyCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if !isAlive(context.Background(), client) {
+		t.Fatal("Expected: connection alive. Actual: down")
+	}
+
+	oldTimeout := AliveTimeout
+	AliveTimeout = 200 * time.Millisecond
+	defer func() { AliveTimeout = oldTimeout }()
+
+	relay.freeze()
+	start := time.Now()
+	if isAlive(context.Background(), client) {
+		t.Error("Expected: half-open connection down. Actual: alive")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected: check aborted after the timeout. Actual: aborted after %s", elapsed)
+	}
+}
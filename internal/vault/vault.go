@@ -0,0 +1,197 @@
+package vault
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrWrongPassphrase means that the vault cannot be decrypted with the passphrase.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted vault")
+
+// ErrNotFound means that the secret is not in the vault.
+var ErrNotFound = errors.New("secret not found in vault")
+
+const (
+	version = 1
+
+	saltSize  = 32
+	nonceSize = 24
+	keySize   = 32
+
+	// scrypt parameters recommended for interactive logins.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// vaultFile is the content of the vault file. Data holds the secrets encrypted with secretbox
+// using a key derived from the master passphrase with scrypt.
+type vaultFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Vault holds the secrets referenced from the configuration as vault:<name>.
+// The secrets are kept in memory only once the vault is unlocked.
+type Vault struct {
+	path string
+
+	salt []byte
+	key  [keySize]byte
+
+	secrets map[string]string
+}
+
+// DefaultPath returns the path of the vault in the user config directory.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "lazylogger", "vault.json")
+}
+
+// Exists returns true if the vault file exists.
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Open decrypts the vault at path with passphrase.
+// If the file doesn't exist, a new empty vault is returned. It is written only by Save.
+func Open(path string, passphrase []byte) (*Vault, error) {
+	if !Exists(path) {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		return newVault(path, salt, passphrase, make(map[string]string))
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f vaultFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("cannot read vault %s: %w", path, err)
+	}
+	if f.Version != version {
+		return nil, fmt.Errorf("unsupported vault version: %d", f.Version)
+	}
+	if len(f.Nonce) != nonceSize {
+		return nil, ErrWrongPassphrase
+	}
+
+	v, err := newVault(path, f.Salt, passphrase, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], f.Nonce)
+	plain, ok := secretbox.Open(nil, f.Data, &nonce, &v.key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+
+	if err := json.Unmarshal(plain, &v.secrets); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if v.secrets == nil {
+		v.secrets = make(map[string]string)
+	}
+
+	return v, nil
+}
+
+func newVault(path string, salt, passphrase []byte, secrets map[string]string) (*Vault, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{path: path, salt: salt, secrets: secrets}
+	copy(v.key[:], key)
+	return v, nil
+}
+
+// Secret returns the secret name.
+func (v *Vault) Secret(name string) (string, error) {
+	s, ok := v.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return s, nil
+}
+
+// Set adds or replaces the secret name.
+func (v *Vault) Set(name, secret string) {
+	v.secrets[name] = secret
+}
+
+// Remove removes the secret name. It returns false if the secret is not in the vault.
+func (v *Vault) Remove(name string) bool {
+	if _, ok := v.secrets[name]; !ok {
+		return false
+	}
+	delete(v.secrets, name)
+	return true
+}
+
+// Names returns the sorted names of the secrets.
+func (v *Vault) Names() []string {
+	names := make([]string, 0, len(v.secrets))
+	for name := range v.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save encrypts the secrets and writes the vault file. A new nonce is used at each save.
+func (v *Vault) Save() error {
+	plain, err := json.Marshal(v.secrets)
+	if err != nil {
+		return err
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(vaultFile{
+		Version: version,
+		Salt:    v.salt,
+		Nonce:   nonce[:],
+		Data:    secretbox.Seal(nil, plain, &nonce, &v.key),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(v.path), 0700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so the vault is never left half written
+	tmp := v.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
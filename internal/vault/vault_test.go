@@ -0,0 +1,62 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazylogger-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vault.json")
+	v, err := Open(path, []byte("master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Set("prod", "secret")
+	v.Set("dev", "other")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	for _, s := range []string{"secret", "other", "prod"} {
+		if bytes.Contains(content, []byte(s)) {
+			t.Errorf("Expected: %s encrypted. Actual: found in vault file", s)
+		}
+	}
+
+	if _, err := Open(path, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Expected: ErrWrongPassphrase. Actual: %v", err)
+	}
+
+	v, err = Open(path, []byte("master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := v.Secret("prod"); err != nil || s != "secret" {
+		t.Errorf("Expected: secret. Actual: %s %v", s, err)
+	}
+
+	if names := v.Names(); len(names) != 2 || names[0] != "dev" || names[1] != "prod" {
+		t.Errorf("Expected: [dev prod]. Actual: %v", names)
+	}
+
+	if !v.Remove("dev") || v.Remove("dev") {
+		t.Error("Expected: dev removed once")
+	}
+
+	if _, err := v.Secret("dev"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected: ErrNotFound. Actual: %v", err)
+	}
+}
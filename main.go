@@ -12,6 +12,7 @@ import (
 	"github.com/tupyy/lazylogger/internal/conf"
 	"github.com/tupyy/lazylogger/internal/gui"
 	"github.com/tupyy/lazylogger/internal/log"
+	"github.com/tupyy/lazylogger/internal/vault"
 )
 
 // build flags
@@ -24,6 +25,8 @@ var (
 
 	configurationFile string
 
+	vaultFile string
+
 	// app
 	app = tview.NewApplication()
 
@@ -37,8 +40,17 @@ func main() {
 	// Read configuration
 	flag.StringVar(&configurationFile, "config", "nodata", "JSON configuration file")
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	flag.StringVar(&vaultFile, "vault", vault.DefaultPath(), "Encrypted vault holding the secrets referenced as vault:<name>")
 	flag.Parse()
 
+	if flag.Arg(0) == "vault" {
+		if err := vaultCommand(vaultFile, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *version {
 		fmt.Printf("LazyLogger:\n %-8s: %-10s\n %-8s: %-10s\n %-8s: %-10s\n",
 			"Version", Version,
@@ -60,17 +72,38 @@ func main() {
 	config := conf.ReadConfigurationFile(configurationFile)
 	glog.Infof("Configuration has %d.", len(config.LoggerConfigurations))
 
+	// unlock the vault only if the configuration needs it
+	if refs := config.VaultReferences(); len(refs) > 0 {
+		glog.Infof("Configuration references %d secrets from vault.", len(refs))
+		v, err := unlockVault(vaultFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := config.ResolveSecrets(v.Secret); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	// create the loggerManager
 	glog.Info("Create logger manager")
 	loggerManager = log.NewLoggerManager(config.LoggerConfigurations)
+	loggerManager.SetCacheBudget(int64(config.CacheBudget))
+	if stateFile, err := log.DefaultStateFile(); err != nil {
+		glog.Warningf("cannot find state file: %s", err)
+	} else if err := loggerManager.SetStateFile(stateFile); err != nil {
+		glog.Warningf("cannot read state file %s: %s", stateFile, err)
+	}
 	go loggerManager.Run()
 	defer loggerManager.Stop()
 
 	gui := gui.NewGui(app, loggerManager)
+	loggerManager.SetPromptFunc(gui.Prompt)
 
 	// ESC exits
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		if event.Key() == tcell.KeyEsc {
+		if event.Key() == tcell.KeyEsc && !gui.IsTyping() {
 			gui.Stop()
 			loggerManager.Stop()
 			app.Stop()
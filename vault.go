@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/tupyy/lazylogger/internal/vault"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const vaultUsage = `usage: lazylogger [-vault file] vault <command>
+
+Commands:
+  add <name>      add or replace the secret <name>
+  list            list the names of the secrets
+  remove <name>   remove the secret <name>
+
+Secrets are referenced in the configuration as password: vault:<name> or passphrase: vault:<name>.`
+
+// maximum number of attempts to enter the master passphrase
+const unlockAttempts = 3
+
+// vaultCommand runs the vault subcommands.
+func vaultCommand(path string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(vaultUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 2 {
+			return errors.New(vaultUsage)
+		}
+
+		var (
+			v   *vault.Vault
+			err error
+		)
+		if vault.Exists(path) {
+			v, err = unlockVault(path)
+		} else {
+			v, err = createVault(path)
+		}
+		if err != nil {
+			return err
+		}
+
+		secret, err := readConfirmedSecret(fmt.Sprintf("Secret for %s: ", args[1]))
+		if err != nil {
+			return err
+		}
+		v.Set(args[1], string(secret))
+		return v.Save()
+	case "list":
+		v, err := unlockVault(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range v.Names() {
+			fmt.Println(name)
+		}
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return errors.New(vaultUsage)
+		}
+		v, err := unlockVault(path)
+		if err != nil {
+			return err
+		}
+		if !v.Remove(args[1]) {
+			return fmt.Errorf("%w: %s", vault.ErrNotFound, args[1])
+		}
+		return v.Save()
+	default:
+		return errors.New(vaultUsage)
+	}
+}
+
+// unlockVault asks for the master passphrase and decrypts the vault.
+func unlockVault(path string) (*vault.Vault, error) {
+	if !vault.Exists(path) {
+		return nil, fmt.Errorf("vault %s not found. Add secrets with: lazylogger vault add <name>", path)
+	}
+
+	var err error
+	for i := 0; i < unlockAttempts; i++ {
+		var passphrase []byte
+		passphrase, err = readSecret(fmt.Sprintf("Master passphrase for %s: ", path))
+		if err != nil {
+			return nil, err
+		}
+
+		var v *vault.Vault
+		v, err = vault.Open(path, passphrase)
+		if err == nil {
+			return v, nil
+		}
+		if !errors.Is(err, vault.ErrWrongPassphrase) {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return nil, err
+}
+
+// createVault asks for the master passphrase of a new vault.
+func createVault(path string) (*vault.Vault, error) {
+	fmt.Fprintf(os.Stderr, "Creating vault %s\n", path)
+	passphrase, err := readConfirmedSecret("New master passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	return vault.Open(path, passphrase)
+}
+
+// readConfirmedSecret reads a secret twice and checks that both are equal.
+func readConfirmedSecret(prompt string) ([]byte, error) {
+	secret, err := readSecret(prompt)
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := readSecret("Confirm: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(secret, confirmation) {
+		return nil, errors.New("the secrets don't match")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	return secret, nil
+}
+
+// readSecret reads a secret from the terminal without echo.
+func readSecret(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return terminal.ReadPassword(int(os.Stdin.Fd()))
+}